@@ -0,0 +1,373 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-choria/build"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/choria-io/go-choria/config"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// Agent is a machine room agent that can be embedded in other programs without using the command line
+type Agent struct {
+	opts     *Options
+	cfgFile  string
+	log      *logrus.Entry
+	isLeader bool
+
+	// revisions of CONFIG values seen by the ConfigChanged hook watcher, nil until the first watch
+	configRevisions map[string]uint64
+
+	wg           sync.WaitGroup
+	restart      chan struct{}
+	ready        chan struct{}
+	done         chan struct{}
+	readyOnce    sync.Once
+	shutdownOnce sync.Once
+	decommOnce   sync.Once
+	cancel       context.CancelFunc
+	started      bool
+	err          error
+	mu           sync.Mutex
+}
+
+// NewAgent creates an agent using configFile as its configuration, when log is nil warnings and errors are logged to stderr
+func NewAgent(o Options, configFile string, log *logrus.Entry) (*Agent, error) {
+	if configFile == "" {
+		return nil, fmt.Errorf("configuration file is required")
+	}
+
+	err := o.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err = filepath.Abs(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	o.configurePaths(configFile)
+
+	if log == nil {
+		logger := logrus.New()
+		logger.SetLevel(logrus.WarnLevel)
+		log = logrus.NewEntry(logger)
+	}
+
+	err = loadPlugins(&o, log.WithField("stage", "plugins"))
+	if err != nil {
+		return nil, fmt.Errorf("loading plugins failed: %v", err)
+	}
+
+	return newAgent(&o, configFile, log), nil
+}
+
+func newAgent(opts *Options, configFile string, log *logrus.Entry) *Agent {
+	return &Agent{
+		opts:    opts,
+		cfgFile: configFile,
+		log:     log,
+		restart: make(chan struct{}, 1),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Options provides read only access to the run-time state and configuration of the agent
+func (a *Agent) Options() RuntimeOptions {
+	return a.opts.roCopy()
+}
+
+// Start starts the broker, replication and server, errors will be one of BrokerError, ReplicationError or ServerError
+func (a *Agent) Start(ctx context.Context) error {
+	a.mu.Lock()
+	if a.started {
+		a.mu.Unlock()
+		return fmt.Errorf("agent already started")
+	}
+	a.started = true
+	ctx, a.cancel = context.WithCancel(ctx)
+	a.mu.Unlock()
+
+	// catches the parent context being cancelled, Stop and fail call the hook before cancelling
+	go func() {
+		<-ctx.Done()
+		a.shutdownStarted(context.Background(), a.Err())
+	}()
+
+	err := a.start(ctx)
+	if err != nil {
+		a.fail(err)
+	}
+
+	go func() {
+		a.wg.Wait()
+
+		// only once the server and machines stopped
+		if errors.Is(a.Err(), ErrDecommissioned) {
+			a.removeDecommissioned()
+		}
+
+		close(a.done)
+	}()
+
+	return err
+}
+
+// Stop shuts down the agent and waits for it to finish
+func (a *Agent) Stop() {
+	a.mu.Lock()
+	cancel := a.cancel
+	a.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	a.shutdownStarted(context.Background(), nil)
+
+	cancel()
+	<-a.done
+}
+
+// Ready is closed once the agent is provisioned and fully initialized
+func (a *Agent) Ready() <-chan struct{} {
+	return a.ready
+}
+
+// Done is closed once the agent has stopped
+func (a *Agent) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err is the error that caused the agent to stop, nil when it was stopped normally
+func (a *Agent) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.err
+}
+
+// fail records the first failure and stops the agent
+func (a *Agent) fail(err error) {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	cancel := a.cancel
+	a.mu.Unlock()
+
+	a.log.Errorf("Stopping after failure: %v", err)
+
+	a.shutdownStarted(context.Background(), a.Err())
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+func (a *Agent) start(ctx context.Context) error {
+	if choria.FileExist(a.cfgFile) {
+		cfg, err := config.NewConfig(a.cfgFile)
+		if err != nil {
+			return err
+		}
+
+		a.isLeader = cfg.Option(configKeyRole, "follower") == "leader"
+		a.opts.Identity = cfg.Identity
+		a.opts.Site = cfg.Option(configKeySite, "")
+		a.opts.Role = cfg.Option(configKeyRole, "follower")
+	}
+
+	a.log = a.log.WithFields(logrus.Fields{"leader": a.isLeader})
+
+	a.log.Warnf("Starting %s version %s with config file %s", a.opts.Name, a.opts.Version, a.cfgFile)
+
+	for _, dir := range []string{a.opts.ServerStorageDirectory, filepath.Dir(a.opts.ServerStatusFile)} {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return fmt.Errorf("could not create directory %s: %w", dir, err)
+		}
+	}
+
+	err := a.createServerNKey()
+	if err != nil {
+		a.log.Errorf("Could not create nkey: %v", err)
+	}
+
+	// makes sure we have some facts to send during provisioning
+	to, cancel := context.WithTimeout(ctx, 30*time.Second)
+	err = saveFacts(to, *a.opts, a.log)
+	cancel()
+	if err != nil {
+		a.log.Errorf("Could not write initial facts: %v", err)
+	}
+
+	var inproc nats.InProcessConnProvider
+	if a.isLeader {
+		b, err := newBroker(a.opts, a.cfgFile, &build.Info{}, a.log)
+		if err != nil {
+			return &BrokerError{err}
+		}
+
+		err = b.Start(ctx, &a.wg)
+		if err != nil {
+			return &BrokerError{err}
+		}
+
+		if a.opts.Hooks.BrokerStarted != nil {
+			a.opts.Hooks.BrokerStarted(ctx, BrokerStartedEvent{
+				Identity:   a.opts.Identity,
+				Site:       b.cfg.Option(configKeySite, ""),
+				ClientPort: defaultNetworkClientPort,
+				Time:       time.Now().UTC(),
+			})
+		}
+
+		inproc = b.InProcessConnProvider()
+
+		b.WatchCertificate(ctx, &a.wg, func() { a.restartProcess("broker certificate renewed") })
+		b.CleanPluginArtifacts(ctx, &a.wg)
+
+		err = b.StartReplication(ctx, &a.wg)
+		if err != nil {
+			return &ReplicationError{err}
+		}
+	}
+
+	srv, srvCtx, srvCancel, srvWg, err := a.startServer(ctx, inproc)
+	if err != nil {
+		return err
+	}
+
+	a.wg.Add(1)
+	go a.superviseServer(ctx, inproc, srv, srvCtx, srvCancel, srvWg)
+
+	a.verifyUpgrade(ctx)
+
+	if !a.opts.DisableUpgrades {
+		a.wg.Add(1)
+		go a.watchUpgrades(ctx)
+	}
+
+	return nil
+}
+
+// startServer creates and starts a server with its own context so it can be restarted without affecting the broker
+func (a *Agent) startServer(ctx context.Context, inproc nats.InProcessConnProvider) (*server, context.Context, context.CancelFunc, *sync.WaitGroup, error) {
+	srv, err := newServer(a.opts, a.cfgFile, inproc, a.log)
+	if err != nil {
+		return nil, nil, nil, nil, &ServerError{err}
+	}
+
+	srvCtx, cancel := context.WithCancel(ctx)
+	srvWg := &sync.WaitGroup{}
+
+	srv.onReady = func(ctx context.Context) {
+		a.provisioningCompleted(ctx)
+		a.readyOnce.Do(func() { close(a.ready) })
+
+		srvWg.Add(1)
+		go func() {
+			defer srvWg.Done()
+			a.completeTokenRenewal(ctx)
+		}()
+	}
+	srv.onFailure = func(err error) { a.fail(&ServerError{err}) }
+
+	if srv.IsProvisioning() {
+		a.provisioningStarted(ctx)
+	}
+
+	err = srv.Start(srvCtx, srvWg)
+	if err != nil {
+		cancel()
+		return nil, nil, nil, nil, &ServerError{err}
+	}
+
+	return srv, srvCtx, cancel, srvWg, nil
+}
+
+// superviseServer restarts the server when requested, for example to renew its credentials
+func (a *Agent) superviseServer(ctx context.Context, inproc nats.InProcessConnProvider, srv *server, srvCtx context.Context, cancel context.CancelFunc, srvWg *sync.WaitGroup) {
+	defer a.wg.Done()
+
+	for {
+		// workers are tracked with the server so restarts and shutdown wait for them
+		if !srv.IsProvisioning() {
+			for _, worker := range []func(context.Context){a.watchTokenExpiry, a.runJobs, a.manageMachines, a.watchConfig, a.resolveConfig, a.watchDecommission, a.servePluginArtifacts} {
+				srvWg.Add(1)
+				go func(ctx context.Context, wg *sync.WaitGroup) {
+					defer wg.Done()
+					worker(ctx)
+				}(srvCtx, srvWg)
+			}
+		}
+
+		select {
+		case <-a.restart:
+			a.log.Warnf("Restarting the machine room server")
+
+			cancel()
+			srvWg.Wait()
+
+			var err error
+			srv, srvCtx, cancel, srvWg, err = a.startServer(ctx, inproc)
+			if err != nil {
+				a.fail(err)
+				return
+			}
+
+		case <-ctx.Done():
+			cancel()
+			srvWg.Wait()
+			return
+		}
+	}
+}
+
+// restartServer requests that the server be restarted
+func (a *Agent) restartServer() {
+	select {
+	case a.restart <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Agent) createServerNKey() error {
+	if a.opts.NatsNkeySeedFile == "" {
+		return fmt.Errorf("no nkey seed configured")
+	}
+	if choria.FileExist(a.opts.NatsNkeySeedFile) {
+		return nil
+	}
+
+	ukp, err := nkeys.CreateUser()
+	if err != nil {
+		return fmt.Errorf("could not generate user nkey: %v", err)
+	}
+	ukps, err := ukp.Seed()
+	if err != nil {
+		return fmt.Errorf("could not generate user nkey: %v", err)
+	}
+	err = os.WriteFile(a.opts.NatsNkeySeedFile, ukps, 0400)
+	if err != nil {
+		return fmt.Errorf("could not generate user nkey: %v", err)
+	}
+
+	return nil
+}
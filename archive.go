@@ -0,0 +1,250 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifest stored first in reset archives
+const archiveManifestName = "machine-room-archive.json"
+
+// archiveManifest describes what a reset archive holds
+type archiveManifest struct {
+	Scope   string    `json:"scope"`
+	Created time.Time `json:"created"`
+	Paths   []string  `json:"paths"`
+}
+
+// writeResetArchive stores paths, with their absolute location, in a compressed tar file
+func writeResetArchive(file string, scope string, paths []string) error {
+	var abs []string
+	for _, p := range paths {
+		a, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		abs = append(abs, a)
+	}
+
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(file), fmt.Sprintf(".%s-*", filepath.Base(file)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	gz := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gz)
+
+	err = writeArchive(tw, scope, abs)
+	if err != nil {
+		tf.Close()
+		return err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		tf.Close()
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		tf.Close()
+		return err
+	}
+	err = tf.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), file)
+}
+
+func writeArchive(tw *tar.Writer, scope string, paths []string) error {
+	mj, err := json.Marshal(&archiveManifest{Scope: scope, Created: time.Now().UTC(), Paths: paths})
+	if err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{Name: archiveManifestName, Mode: 0600, Size: int64(len(mj)), ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(mj)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range paths {
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			nfo, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			// sockets, links and the like are recreated by the agent
+			if !nfo.Mode().IsRegular() && !nfo.IsDir() {
+				return nil
+			}
+
+			hdr, err := tar.FileInfoHeader(nfo, "")
+			if err != nil {
+				return err
+			}
+			hdr.Name = strings.TrimPrefix(filepath.ToSlash(path), "/")
+			if nfo.IsDir() {
+				hdr.Name += "/"
+			}
+
+			err = tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+
+			if nfo.IsDir() {
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(tw, f)
+
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not archive %s: %w", root, err)
+		}
+	}
+
+	return nil
+}
+
+// restoreResetArchive extracts an archive made by reset back into place, only paths listed in the manifest that are
+// also in allowed are restored
+func restoreResetArchive(file string, allowed []string) (*archiveManifest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != archiveManifestName {
+		return nil, fmt.Errorf("%s is not a reset archive", file)
+	}
+
+	var manifest archiveManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive manifest: %w", err)
+	}
+
+	for _, p := range manifest.Paths {
+		if !pathWithin(p, allowed) {
+			return nil, fmt.Errorf("archive holds %s which is not managed by this agent", p)
+		}
+	}
+
+	for {
+		hdr, err = tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		target := filepath.Clean("/" + hdr.Name)
+		if !pathWithin(target, manifest.Paths) {
+			return nil, fmt.Errorf("archive entry %s is outside the archived paths", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return nil, err
+			}
+
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), 0700)
+			if err != nil {
+				return nil, err
+			}
+
+			// seeds are read only so existing files are replaced rather than written to
+			err = os.Remove(target)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return nil, fmt.Errorf("could not restore %s: %w", target, err)
+			}
+
+			err = os.Chmod(target, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &manifest, nil
+}
+
+// pathWithin determines if path is one of roots or inside one of them
+func pathWithin(path string, roots []string) bool {
+	path = filepath.Clean(path)
+
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
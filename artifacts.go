@@ -0,0 +1,244 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// plugin sources starting with this are artifacts in the PLUGINS object store
+	pluginsSourceScheme = "obj://"
+
+	// how often chunks of replaced artifacts are removed, chunks have to be this old to be removed
+	defaultPluginsCleanInterval = time.Hour
+)
+
+// localPluginSources points plugins with sources in the PLUGINS object store to the artifact server on port, the plugins
+// manager only downloads over HTTP
+func localPluginSources(plugins []map[string]any, port int) {
+	for _, p := range plugins {
+		source, ok := p["source"].(string)
+		if !ok || !strings.HasPrefix(source, pluginsSourceScheme) {
+			continue
+		}
+
+		p["source"] = fmt.Sprintf("http://127.0.0.1:%d/%s", port, url.PathEscape(strings.TrimPrefix(source, pluginsSourceScheme)))
+	}
+}
+
+// pluginsReplicationName is the name of the replication copying plugin artifacts from the backend to a site, each site
+// needs its own consumer on the backend as sites sharing one would each receive only some of the chunks
+func pluginsReplicationName(site string) string {
+	return "OBJ_" + pluginsBucket + "_" + invalidTokenChars.ReplaceAllString(site, "_")
+}
+
+// servePluginArtifacts serves the artifacts in the PLUGINS object store on the loopback interface until ctx is canceled,
+// when another agent on the host already serves them on the port that server is used and this one takes over once it stops
+func (a *Agent) servePluginArtifacts(ctx context.Context) {
+	shared := false
+
+	backoff.Default.For(ctx, func(try int) error {
+		err := a.servePluginArtifactsLoop(ctx)
+		switch {
+		case errors.Is(err, syscall.EADDRINUSE):
+			if !shared {
+				a.log.Infof("Plugin artifacts are served by another process on port %d", a.opts.PluginsPort)
+				shared = true
+			}
+			return err
+
+		case err != nil && ctx.Err() == nil:
+			a.log.Errorf("Serving plugin artifacts failed: %v", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (a *Agent) servePluginArtifactsLoop(ctx context.Context) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(a.opts.PluginsPort)))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	_, nc, err := connectSiteBroker(ctx, a.opts, a.cfgFile, "plugin_artifacts", a.log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	obs, err := js.ObjectStore(pluginsBucket)
+	if err != nil {
+		return fmt.Errorf("could not access %s bucket: %w", pluginsBucket, err)
+	}
+
+	srv := &http.Server{
+		Handler:           pluginArtifactsHandler(obs, a.log),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	a.log.Infof("Serving plugin artifacts from the %s bucket on %s", pluginsBucket, listener.Addr())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(listener)
+	}()
+
+	select {
+	case err = <-errs:
+		return err
+	case <-ctx.Done():
+		return srv.Close()
+	}
+}
+
+// CleanPluginArtifacts regularly removes chunks no artifact refers to, the backend purges the chunks of replaced and
+// deleted artifacts and purges are not replicated so the site would otherwise keep them forever
+func (b *broker) CleanPluginArtifacts(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(defaultPluginsCleanInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := b.cleanPluginArtifacts(ctx)
+				if err != nil {
+					b.log.Errorf("Could not clean plugin artifacts: %v", err)
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (b *broker) cleanPluginArtifacts(ctx context.Context) error {
+	conn, err := b.fw.NewConnector(ctx, b.fw.MiddlewareServers, "plugins_cleanup", b.log)
+	if err != nil {
+		return err
+	}
+	nc := conn.Nats()
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	obs, err := js.ObjectStore(pluginsBucket)
+	if err != nil {
+		return fmt.Errorf("could not access %s bucket: %w", pluginsBucket, err)
+	}
+
+	referenced := map[string]bool{}
+	objects, err := obs.List()
+	if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+		return err
+	}
+	for _, o := range objects {
+		referenced[o.NUID] = true
+	}
+
+	stream := "OBJ_" + pluginsBucket
+	prefix := fmt.Sprintf("$O.%s.C.", pluginsBucket)
+
+	nfo, err := js.StreamInfo(stream, &nats.StreamInfoRequest{SubjectsFilter: prefix + ">"})
+	if err != nil {
+		return err
+	}
+
+	for subj := range nfo.State.Subjects {
+		if referenced[strings.TrimPrefix(subj, prefix)] {
+			continue
+		}
+
+		// chunks are replicated before the metadata of the artifact that refers to them
+		msg, err := js.GetLastMsg(stream, subj)
+		if err != nil {
+			return err
+		}
+		if time.Since(msg.Time) < defaultPluginsCleanInterval {
+			continue
+		}
+
+		b.log.Infof("Removing chunks %s that are not part of any plugin artifact", subj)
+		err = js.PurgeStream(stream, &nats.StreamPurgeRequest{Subject: subj})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pluginArtifactsHandler(obs nats.ObjectStore, log *logrus.Entry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/")
+
+		res, err := obs.Get(name, nats.Context(r.Context()))
+		switch {
+		case errors.Is(err, nats.ErrObjectNotFound):
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		case err != nil:
+			log.Errorf("Could not retrieve plugin artifact %s: %v", name, err)
+			http.Error(w, "artifact unavailable", http.StatusBadGateway)
+			return
+		}
+		defer res.Close()
+
+		nfo, err := res.Info()
+		if err != nil {
+			http.Error(w, "artifact unavailable", http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatUint(nfo.Size, 10))
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		// a failed digest check ends the response early so the partial artifact fails its checksum
+		_, err = io.Copy(w, res)
+		if err != nil {
+			log.Errorf("Could not send plugin artifact %s: %v", name, err)
+		}
+	}
+}
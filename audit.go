@@ -0,0 +1,642 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/go-choria/choria"
+	srcfg "github.com/choria-io/stream-replicator/config"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	auditSent     = "sent"
+	auditQueued   = "queued"
+	auditReceived = "received"
+
+	// the file being written in the audit directory, rotated files are named audit-<time>.log
+	auditCurrentFile = "audit.log"
+	auditFilePrefix  = "audit-"
+	auditFileSuffix  = ".log"
+
+	// the signed position of the newest entry, written with every sync
+	auditAnchorFile = "audit.anchor"
+)
+
+var invalidConsumerChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// AuditEntry records a message sent to or received from the backend, every entry includes the hash of the previous
+// one so changes to the log can be detected
+type AuditEntry struct {
+	// Sequence is the position of the entry in the log
+	Sequence uint64 `json:"seq"`
+	// Time is when the entry was recorded
+	Time time.Time `json:"time"`
+	// Direction is queued for data handed to replication to the backend, sent for data exported to bundles and received
+	// for data replicated or imported from the backend
+	Direction string `json:"direction"`
+	// Replication is the name of the replication that moved the message
+	Replication string `json:"replication"`
+	// Stream is the site stream holding the message
+	Stream string `json:"stream"`
+	// StreamSequence is the sequence of the message in Stream
+	StreamSequence uint64 `json:"stream_seq"`
+	// Subject is the subject of the message
+	Subject string `json:"subject"`
+	// Operation is the Key-Value operation for bucket changes
+	Operation string `json:"operation,omitempty"`
+	// Size is the size of the message body
+	Size int `json:"size"`
+	// Digest is the sha256 of the message body
+	Digest string `json:"digest"`
+	// Previous is the hash of the previous entry
+	Previous string `json:"previous"`
+	// Hash is the sha256 of this entry with an empty Hash
+	Hash string `json:"hash"`
+}
+
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	j, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(j)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditAnchor is the newest entry of the log signed using the server seed, rewriting the chain or removing its end
+// requires the seed to sign a new anchor
+type auditAnchor struct {
+	Sequence  uint64    `json:"seq"`
+	Hash      string    `json:"hash"`
+	Time      time.Time `json:"time"`
+	PublicKey string    `json:"public_key"`
+	Signature string    `json:"signature"`
+}
+
+func (a *auditAnchor) signedContent() []byte {
+	return []byte(fmt.Sprintf("%d\n%s\n%d", a.Sequence, a.Hash, a.Time.UnixNano()))
+}
+
+func readAuditAnchor(dir string) (*auditAnchor, error) {
+	aj, err := os.ReadFile(filepath.Join(dir, auditAnchorFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var anchor auditAnchor
+	err = json.Unmarshal(aj, &anchor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &anchor, nil
+}
+
+// auditLog is the append only hash chained log written by leaders
+type auditLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	seedFile string
+
+	f    *os.File
+	size int64
+	seq  uint64
+	last string
+	mu   sync.Mutex
+}
+
+// openAuditLog opens the log in dir, the anchor is signed using the server seed in seedFile
+func openAuditLog(dir string, maxSize int64, maxFiles int, seedFile string) (*auditLog, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &auditLog{dir: dir, maxSize: maxSize, maxFiles: maxFiles, seedFile: seedFile}
+
+	files, err := auditLogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// continue the chain from the newest entry, an incomplete last line from a crash is removed
+	for i := len(files) - 1; i >= 0; i-- {
+		entry, err := lastAuditEntry(files[i], files[i] == filepath.Join(dir, auditCurrentFile))
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			l.seq = entry.Sequence
+			l.last = entry.Hash
+			break
+		}
+	}
+
+	l.f, err = os.OpenFile(filepath.Join(dir, auditCurrentFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	nfo, err := l.f.Stat()
+	if err != nil {
+		l.f.Close()
+		return nil, err
+	}
+	l.size = nfo.Size()
+
+	return l, nil
+}
+
+// auditLogFiles are the audit logs in dir, oldest first
+func auditLogFiles(dir string) ([]string, error) {
+	rotated, err := filepath.Glob(filepath.Join(dir, auditFilePrefix+"*"+auditFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+
+	current := filepath.Join(dir, auditCurrentFile)
+	if FileExist(current) {
+		rotated = append(rotated, current)
+	}
+
+	return rotated, nil
+}
+
+func lastAuditEntry(file string, repair bool) (*AuditEntry, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		if !repair {
+			return nil, fmt.Errorf("%s: incomplete last entry", file)
+		}
+
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+		err = os.Truncate(file, int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return nil, nil
+	}
+
+	var entry AuditEntry
+	err = json.Unmarshal(last, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid last entry: %w", file, err)
+	}
+
+	return &entry, nil
+}
+
+// append adds entry to the log, setting its sequence and hashes
+func (l *auditLog) append(entry *AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Sequence = l.seq + 1
+	entry.Previous = l.last
+
+	var err error
+	entry.Hash, err = entry.computeHash()
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	l.seq = entry.Sequence
+	l.last = entry.Hash
+
+	return nil
+}
+
+// sync writes the log to disk and anchors the newest entry
+func (l *auditLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	return l.anchor()
+}
+
+// anchor signs the newest entry, the seed is read every time as renewing the token replaces it
+func (l *auditLog) anchor() error {
+	if l.seq == 0 {
+		return nil
+	}
+
+	pub, pri, err := choria.Ed25519KeyPairFromSeedFile(l.seedFile)
+	if err != nil {
+		return fmt.Errorf("could not load server seed: %w", err)
+	}
+
+	anchor := &auditAnchor{
+		Sequence:  l.seq,
+		Hash:      l.last,
+		Time:      time.Now().UTC(),
+		PublicKey: hex.EncodeToString(pub),
+	}
+	anchor.Signature = hex.EncodeToString(ed25519.Sign(pri, anchor.signedContent()))
+
+	aj, err := json.Marshal(anchor)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(l.dir, auditAnchorFile), aj, 0600)
+}
+
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Close()
+}
+
+// rotate renames the current log and removes the oldest logs beyond maxFiles, the chain continues in the new file
+func (l *auditLog) rotate() error {
+	err := l.f.Sync()
+	if err != nil {
+		return err
+	}
+	err = l.f.Close()
+	if err != nil {
+		return err
+	}
+
+	current := filepath.Join(l.dir, auditCurrentFile)
+	rotated := filepath.Join(l.dir, auditFilePrefix+time.Now().UTC().Format("20060102T150405.000000000")+auditFileSuffix)
+	err = os.Rename(current, rotated)
+	if err != nil {
+		return err
+	}
+
+	l.f, err = os.OpenFile(current, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	l.size = 0
+
+	files, err := auditLogFiles(l.dir)
+	if err != nil {
+		return err
+	}
+
+	// files includes the new current log
+	for len(files) > l.maxFiles+1 {
+		err = os.Remove(files[0])
+		if err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
+
+// auditResult is the outcome of verifying the audit log chain
+type auditResult struct {
+	Files    []string `json:"files"`
+	Entries  uint64   `json:"entries"`
+	First    uint64   `json:"first"`
+	Last     uint64   `json:"last"`
+	Anchored uint64   `json:"anchored"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// verifyAuditLog verifies the chain and that it includes the entry anchored using the server seed in seedFile, entries
+// recorded after the anchor were not synced yet
+func verifyAuditLog(dir string, seedFile string) (*auditResult, error) {
+	var anchor *auditAnchor
+	if FileExist(filepath.Join(dir, auditAnchorFile)) {
+		var err error
+		anchor, err = readAuditAnchor(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid anchor: %w", err)
+		}
+	}
+
+	anchored := ""
+	res, err := walkAuditLog(dir, true, func(entry *AuditEntry) error {
+		if anchor != nil && entry.Sequence == anchor.Sequence {
+			anchored = entry.Hash
+		}
+
+		return nil
+	})
+	if err != nil || res.Entries == 0 {
+		return res, err
+	}
+
+	if anchor == nil {
+		return res, fmt.Errorf("no anchor found in %s", dir)
+	}
+
+	pub, _, err := choria.Ed25519KeyPairFromSeedFile(seedFile)
+	if err != nil {
+		return res, fmt.Errorf("could not load server seed: %w", err)
+	}
+
+	sig, err := hex.DecodeString(anchor.Signature)
+	switch {
+	case err != nil:
+		return res, fmt.Errorf("invalid anchor signature: %w", err)
+	case anchor.PublicKey != hex.EncodeToString(pub):
+		return res, fmt.Errorf("anchor was signed by %s, not the server seed", anchor.PublicKey)
+	case !ed25519.Verify(pub, anchor.signedContent(), sig):
+		return res, fmt.Errorf("invalid anchor signature")
+	case anchored == "":
+		return res, fmt.Errorf("anchored entry %d was removed", anchor.Sequence)
+	case anchored != anchor.Hash:
+		return res, fmt.Errorf("anchored entry %d was modified", anchor.Sequence)
+	}
+
+	res.Anchored = anchor.Sequence
+
+	return res, nil
+}
+
+// walkAuditLog calls cb for every entry in the audit log, oldest first, verifying the chain when verify is set
+func walkAuditLog(dir string, verify bool, cb func(*AuditEntry) error) (*auditResult, error) {
+	files, err := auditLogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &auditResult{Files: files}
+
+	var prev *AuditEntry
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return res, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		line := 0
+		for scanner.Scan() {
+			line++
+
+			var entry AuditEntry
+			err = json.Unmarshal(scanner.Bytes(), &entry)
+			if err != nil {
+				f.Close()
+				return res, fmt.Errorf("%s:%d: invalid entry: %w", file, line, err)
+			}
+
+			if verify {
+				hash, err := entry.computeHash()
+				if err != nil {
+					f.Close()
+					return res, err
+				}
+
+				switch {
+				case hash != entry.Hash:
+					err = fmt.Errorf("%s:%d: entry %d was modified", file, line, entry.Sequence)
+				case prev != nil && entry.Sequence != prev.Sequence+1:
+					err = fmt.Errorf("%s:%d: expected entry %d but found %d", file, line, prev.Sequence+1, entry.Sequence)
+				case prev != nil && entry.Previous != prev.Hash:
+					err = fmt.Errorf("%s:%d: entry %d does not follow entry %d", file, line, entry.Sequence, prev.Sequence)
+				}
+				if err != nil {
+					f.Close()
+					return res, err
+				}
+			}
+
+			if prev == nil {
+				res.First = entry.Sequence
+			}
+			res.Last = entry.Sequence
+			res.Entries++
+			prev = &entry
+
+			if cb != nil {
+				err = cb(&entry)
+				if err != nil {
+					f.Close()
+					return res, err
+				}
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	return res, nil
+}
+
+// auditSource is a site stream holding data moved by a replication
+type auditSource struct {
+	replication string
+	stream      string
+	filter      string
+	direction   string
+}
+
+// auditSources are the local streams holding what replications sent and received, uploads are read from the stream
+// being replicated and downloads from the stream they are copied into. Uploads are recorded as queued as they are
+// read before the replicator sends them
+func auditSources(streams []*srcfg.Stream) []auditSource {
+	var sources []auditSource
+
+	for _, s := range streams {
+		if s.SourceProcess != nil {
+			sources = append(sources, auditSource{replication: s.Name, stream: s.Stream, filter: s.FilterSubject, direction: auditQueued})
+		} else {
+			sources = append(sources, auditSource{replication: s.Name, stream: s.TargetStream, direction: auditReceived})
+		}
+	}
+
+	return sources
+}
+
+// startAudit records everything the replications in streams send and receive in the audit log
+func (b *broker) startAudit(ctx context.Context, wg *sync.WaitGroup, streams []*srcfg.Stream) error {
+	if b.opts.NoAuditLog {
+		return nil
+	}
+
+	alog, err := openAuditLog(b.opts.AuditDirectory, b.opts.AuditLogMaxSize, b.opts.AuditLogMaxFiles, b.opts.ServerSeedFile)
+	if err != nil {
+		return err
+	}
+
+	b.log.Infof("Recording replicated data in audit log %s", b.opts.AuditDirectory)
+
+	var workers sync.WaitGroup
+	for _, s := range auditSources(streams) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+
+			backoff.Default.For(ctx, func(try int) error {
+				err := b.runAudit(ctx, alog, s)
+				if err != nil && ctx.Err() == nil {
+					b.log.Errorf("Audit of %s failed: %v", s.replication, err)
+					return err
+				}
+
+				return nil
+			})
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		workers.Wait()
+		err := alog.close()
+		if err != nil {
+			b.log.Errorf("Could not close audit log: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+func (b *broker) runAudit(ctx context.Context, alog *auditLog, source auditSource) error {
+	// every leader keeps a complete log so consumers are per leader
+	consumer := invalidConsumerChars.ReplaceAllString(fmt.Sprintf("machine_room_audit_%s_%s", b.cfg.Identity, source.replication), "_")
+
+	return b.consumeSiteStream(ctx, "audit_"+strings.ToLower(source.replication), source.stream, consumer, source.filter, func(_ nats.JetStreamContext, msgs []*nats.Msg) error {
+		for _, msg := range msgs {
+			entry := &AuditEntry{
+				Time:        time.Now().UTC(),
+				Direction:   source.direction,
+				Replication: source.replication,
+				Stream:      source.stream,
+				Subject:     msg.Subject,
+				Size:        len(msg.Data),
+			}
+
+			if msg.Header != nil {
+				entry.Operation = msg.Header.Get("KV-Operation")
+			}
+
+			meta, err := msg.Metadata()
+			if err == nil {
+				entry.StreamSequence = meta.Sequence.Stream
+			}
+
+			sum := sha256.Sum256(msg.Data)
+			entry.Digest = hex.EncodeToString(sum[:])
+
+			err = alog.append(entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := alog.sync()
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			msg.Ack()
+		}
+
+		return nil
+	})
+}
+
+// consumeSiteStream passes batches of messages from a durable pull consumer on the site broker to handler, messages are acknowledged by handler
+func (b *broker) consumeSiteStream(ctx context.Context, name string, stream string, consumer string, filter string, handler func(js nats.JetStreamContext, msgs []*nats.Msg) error) error {
+	conn, err := b.fw.NewConnector(ctx, b.fw.MiddlewareServers, name, b.log)
+	if err != nil {
+		return err
+	}
+	nc := conn.Nats()
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	sub, err := js.PullSubscribe(filter, consumer, nats.BindStream(stream), nats.AckExplicit(), nats.DeliverAll())
+	if err != nil {
+		return err
+	}
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		msgs, err := sub.Fetch(100, nats.MaxWait(time.Second))
+		if errors.Is(err, nats.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = handler(js, msgs)
+		if err != nil {
+			return err
+		}
+	}
+}
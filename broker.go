@@ -5,18 +5,9 @@
 package machineroom
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"errors"
 	"fmt"
-	"math/big"
-	"net"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -39,6 +30,7 @@ type broker struct {
 	log    *logrus.Entry
 	opts   *Options
 	broker *network.Server
+	ca     *localCA
 }
 
 func newBroker(opts *Options, configFile string, bi *build.Info, log *logrus.Entry) (*broker, error) {
@@ -76,13 +68,20 @@ func newBroker(opts *Options, configFile string, bi *build.Info, log *logrus.Ent
 	instance.cfg.Choria.NetworkLeafPort = 0
 	instance.cfg.Choria.NetworkWebSocketPort = 0
 	instance.cfg.Choria.NetworkPeerPort = 0
+	instance.cfg.Choria.NetworkPeers = []string{}
 	instance.cfg.Choria.BrokerAdapters = []string{}
 
+	// peers are only enabled when leaders are clustered using machine_room.broker.peers
+	err = instance.configureCluster()
+	if err != nil {
+		return nil, err
+	}
+
 	// forcing here disables the delay in stream creation at first start
-	instance.cfg.Choria.NetworkEventStoreReplicas = 1
-	instance.cfg.Choria.NetworkLeaderElectionReplicas = 1
-	instance.cfg.Choria.NetworkMachineStoreReplicas = 1
-	instance.cfg.Choria.NetworkStreamAdvisoryReplicas = 1
+	instance.cfg.Choria.NetworkEventStoreReplicas = instance.replicas()
+	instance.cfg.Choria.NetworkLeaderElectionReplicas = instance.replicas()
+	instance.cfg.Choria.NetworkMachineStoreReplicas = instance.replicas()
+	instance.cfg.Choria.NetworkStreamAdvisoryReplicas = instance.replicas()
 	instance.cfg.Choria.NetworkExecutorStoreDuration = 0 // we create a broader submission stream
 
 	// always be running jetstream
@@ -113,110 +112,48 @@ func newBroker(opts *Options, configFile string, bi *build.Info, log *logrus.Ent
 	return instance, nil
 }
 
-// creates a single use CA just enough to start the broker and allow local
-// access, does not allow RPC using the cert that's created
-//
-// also does not store the CA key so no new certs can be made, remade at every
-// start for the moment.
+// maintains a persistent local CA and broker certificate in the configuration
+// directory, both are kept between restarts and renewed ahead of expiry. The
+// CA does not allow RPC using the certs that it issues, it's only there to
+// allow local access and, optionally, followers to verify the broker.
 func (b *broker) saveCert() error {
-	// TODO: if these are valid keep them, eventually we might have more than one process using them so need to not rip it out under that
-
-	ca := &x509.Certificate{
-		SerialNumber: big.NewInt(2019),
-		Subject: pkix.Name{
-			Organization: []string{"Choria.IO"},
-			Country:      []string{"MT"},
-		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-	}
+	dir := b.opts.ConfigurationDirectory
 
-	// create our private and public key
-	caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		return err
-	}
-
-	// create the CA
-	caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
-	if err != nil {
-		return err
+	names := append([]string{}, b.opts.BrokerTLSNames...)
+	for _, n := range strings.Split(b.cfg.Option(configKeyBrokerTLSNames, ""), ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
 	}
 
-	// pem encode
-	caPEM := new(bytes.Buffer)
-	pem.Encode(caPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	})
-
-	caPrivKeyPEM := new(bytes.Buffer)
-	pem.Encode(caPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(caPrivKey),
-	})
-
-	cert := &x509.Certificate{
-		SerialNumber: big.NewInt(2019),
-		Subject: pkix.Name{
-			Organization: []string{"Choria.IO"},
-			Country:      []string{"MT"},
-			CommonName:   b.cfg.Identity,
-		},
-		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(10, 0, 0),
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-		DNSNames:    []string{"localhost", b.cfg.Identity},
+	ca := &localCA{
+		caFile:    filepath.Join(dir, defaultCaFile),
+		caKey:     filepath.Join(dir, defaultCaKeyFile),
+		crossFile: filepath.Join(dir, defaultCaCrossFile),
+		certFile:  filepath.Join(dir, defaultCertFile),
+		keyFile:   filepath.Join(dir, defaultKeyFile),
+		keyType:   b.opts.BrokerTLSKeyType,
+		identity:  b.cfg.Identity,
+		names:     names,
+		log:       b.log.WithField("component", "tls"),
 	}
 
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		return err
+	// clustered leaders share the CA so only the first leader creates and renews it
+	if peers := b.clusterPeers(); len(peers) > 0 && peers[0] != b.cfg.Identity {
+		ca.managedBy = peers[0]
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, cert, ca, &certPrivKey.PublicKey, caPrivKey)
+	_, err := ca.Ensure(time.Now())
 	if err != nil {
 		return err
 	}
-
-	certPEM := new(bytes.Buffer)
-	pem.Encode(certPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certBytes,
-	})
-
-	certPrivKeyPEM := new(bytes.Buffer)
-	pem.Encode(certPrivKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKey),
-	})
+	b.ca = ca
 
 	b.cfg.Choria.SecurityProvider = "choria"
-	b.cfg.Choria.ChoriaSecuritySeedFile = filepath.Join(filepath.Dir(b.cfg.ConfigFile), defaultServerSeedFileName)
-	b.cfg.Choria.ChoriaSecurityCA = filepath.Join(filepath.Dir(b.cfg.ConfigFile), defaultCaFile)
-	b.cfg.Choria.ChoriaSecurityCertificate = filepath.Join(filepath.Dir(b.cfg.ConfigFile), defaultCertFile)
-	b.cfg.Choria.ChoriaSecurityKey = filepath.Join(filepath.Dir(b.cfg.ConfigFile), defaultKeyFile)
-
-	err = os.WriteFile(b.cfg.Choria.ChoriaSecurityCA, caPEM.Bytes(), 0644)
-	if err != nil {
-		return fmt.Errorf("could not write certificate: %v", err)
-	}
-
-	err = os.WriteFile(b.cfg.Choria.ChoriaSecurityCertificate, certPEM.Bytes(), 0644)
-	if err != nil {
-		return fmt.Errorf("could not write certificate: %v", err)
-	}
-
-	err = os.WriteFile(b.cfg.Choria.ChoriaSecurityKey, certPrivKeyPEM.Bytes(), 0400)
-	if err != nil {
-		return fmt.Errorf("could not write certificate: %v", err)
-	}
+	b.cfg.Choria.ChoriaSecuritySeedFile = filepath.Join(dir, defaultServerSeedFileName)
+	b.cfg.Choria.ChoriaSecurityCA = ca.caFile
+	b.cfg.Choria.ChoriaSecurityCertificate = ca.certFile
+	b.cfg.Choria.ChoriaSecurityKey = ca.keyFile
 
 	return nil
 }
@@ -262,28 +199,81 @@ func (b *broker) Start(ctx context.Context, wg *sync.WaitGroup) error {
 	return nil
 }
 
+// WatchCertificate renews the broker certificate and CA ahead of expiry, the broker only loads them when it starts so
+// renewed is called to restart it
+func (b *broker) WatchCertificate(ctx context.Context, wg *sync.WaitGroup, renewed func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(defaultCertCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				issued, err := b.ca.Ensure(time.Now())
+				if err != nil {
+					b.log.Errorf("Could not renew the broker certificate: %v", err)
+					continue
+				}
+
+				if issued {
+					renewed()
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
 func (b *broker) createDesiredStateBucket(ctx context.Context, nc *nats.Conn) error {
 	js, err := nc.JetStream(nats.Context(ctx))
 	if err != nil {
 		return err
 	}
 
-	_, err = js.KeyValue("CONFIG")
-	if err == nil {
-		return nil
+	// CONFIG is replicated from the backend, MACHINES holds the plugins selected by each node and NODE_CONFIG the CONFIG values resolved for each node
+	for _, bucket := range []string{"CONFIG", machinesBucket, resolvedConfigBucket} {
+		_, err = js.KeyValue(bucket)
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, nats.ErrBucketNotFound) {
+			_, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket, History: 1, Storage: nats.FileStorage, Replicas: b.replicas()})
+			if err != nil {
+				return err
+			}
+			b.log.Infof("Creating %s bucket", bucket)
+		} else if err != nil {
+			return err
+		}
 	}
 
-	if errors.Is(err, nats.ErrBucketNotFound) {
-		_, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "CONFIG", History: 1, Storage: nats.FileStorage})
+	return nil
+}
+
+// createPluginsBucket creates the object store holding plugin artifacts replicated from the backend or imported from bundles
+func (b *broker) createPluginsBucket(ctx context.Context, nc *nats.Conn) error {
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	_, err = js.ObjectStore(pluginsBucket)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.CreateObjectStore(&nats.ObjectStoreConfig{Bucket: pluginsBucket, Storage: nats.FileStorage, Replicas: b.replicas()})
 		if err != nil {
 			return err
 		}
-		b.log.Infof("Creating CONFIG bucket")
-	} else if err != nil {
-		return err
+		b.log.Infof("Created %s bucket", pluginsBucket)
 	}
 
-	return nil
+	return err
 }
 
 func (b *broker) createRegistrationStream(ctx context.Context, nc *nats.Conn) error {
@@ -301,6 +291,7 @@ func (b *broker) createRegistrationStream(ctx context.Context, nc *nats.Conn) er
 			MaxAge:            24 * time.Hour,
 			MaxMsgsPerSubject: 5,
 			Storage:           nats.FileStorage,
+			Replicas:          b.replicas(),
 		})
 		if err != nil {
 			return err
@@ -327,6 +318,7 @@ func (b *broker) createSubmitStream(ctx context.Context, nc *nats.Conn) error {
 			Subjects: []string{"choria.submission.in.>"},
 			MaxAge:   24 * time.Hour,
 			Storage:  nats.FileStorage,
+			Replicas: b.replicas(),
 		})
 		if err != nil {
 			return err
@@ -339,6 +331,59 @@ func (b *broker) createSubmitStream(ctx context.Context, nc *nats.Conn) error {
 	return nil
 }
 
+func (b *broker) createJobStreams(ctx context.Context, nc *nats.Conn) error {
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		b.log.Errorf("Could not connect to Machine Room JetStream: %v", err)
+		return err
+	}
+
+	for name, subject := range map[string]string{jobsStream: jobsSubjectPrefix + ">", jobResultsStream: jobResultsSubjectPrefix + ">"} {
+		_, err = js.StreamInfo(name)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			_, err = js.AddStream(&nats.StreamConfig{
+				Name:     name,
+				Subjects: []string{subject},
+				MaxAge:   defaultJobsMaxAge,
+				Storage:  nats.FileStorage,
+				Replicas: b.replicas(),
+			})
+			if err != nil {
+				return err
+			}
+			b.log.Infof("Created %s stream", name)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *broker) createAdditionalStreams(ctx context.Context, nc *nats.Conn) error {
+	if len(b.opts.AdditionalStreams) == 0 {
+		return nil
+	}
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		b.log.Errorf("Could not connect to Machine Room JetStream: %v", err)
+		return err
+	}
+
+	for _, s := range b.opts.AdditionalStreams {
+		created, err := s.createSiteStream(js, b.replicas())
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+		if created {
+			b.log.Infof("Created %s stream for %s replication", s.siteStreamName(), s.Name)
+		}
+	}
+
+	return nil
+}
+
 func (b *broker) setupStreams(ctx context.Context) {
 	b.log.Infof("Setting up Machine Room Streams")
 
@@ -359,7 +404,13 @@ func (b *broker) setupStreams(ctx context.Context) {
 
 		err = b.createDesiredStateBucket(ctx, nc)
 		if err != nil {
-			b.log.Errorf("Could not create CONFIG bucket: %v", err)
+			b.log.Errorf("Could not create CONFIG, %s and %s buckets: %v", machinesBucket, resolvedConfigBucket, err)
+			return err
+		}
+
+		err = b.createPluginsBucket(ctx, nc)
+		if err != nil {
+			b.log.Errorf("Could not create %s bucket: %v", pluginsBucket, err)
 			return err
 		}
 
@@ -375,6 +426,30 @@ func (b *broker) setupStreams(ctx context.Context) {
 			return err
 		}
 
+		err = b.createJobStreams(ctx, nc)
+		if err != nil {
+			b.log.Errorf("Could not create job streams: %v", err)
+			return err
+		}
+
+		err = b.createAdditionalStreams(ctx, nc)
+		if err != nil {
+			b.log.Errorf("Could not create additional streams: %v", err)
+			return err
+		}
+
+		err = b.createOutboundStream(ctx, nc)
+		if err != nil {
+			b.log.Errorf("Could not create %s stream: %v", outboundStream, err)
+			return err
+		}
+
+		err = b.scaleStreams(ctx, nc)
+		if err != nil {
+			b.log.Errorf("Could not scale streams: %v", err)
+			return err
+		}
+
 		return nil
 	})
 	if err == nil {
@@ -0,0 +1,885 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/choria-io/go-choria/choria"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// BundleKindSite is a bundle exported by a leader holding site data for the backend
+	BundleKindSite = "site"
+	// BundleKindBackend is a bundle produced by the backend holding CONFIG values and plugin artifacts for a site
+	BundleKindBackend = "backend"
+
+	bundleManifestName  = "bundle.json"
+	bundleSignatureName = "bundle.sig"
+	bundleConfigName    = "config.json"
+	bundleStreamsDir    = "streams/"
+	bundleArtifactsDir  = "artifacts/"
+
+	// replication name used for bundle transfers in the audit log
+	bundleReplication = "bundle"
+)
+
+// BundleManifest describes the files in a bundle, the manifest is signed by whoever produced the bundle
+type BundleManifest struct {
+	// Kind is BundleKindSite or BundleKindBackend
+	Kind string `json:"kind"`
+	// Site is the site the bundle was exported from or is for
+	Site string `json:"site"`
+	// Identity is the leader that exported a site bundle
+	Identity string `json:"identity,omitempty"`
+	// PublicKey is the hex encoded ed25519 key of the leader that signed a site bundle
+	PublicKey string `json:"public_key,omitempty"`
+	// Created is when the bundle was made
+	Created time.Time `json:"created"`
+	// Files are the files in the bundle
+	Files []BundleFile `json:"files"`
+}
+
+// BundleFile is a file in a bundle
+type BundleFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// BundleMessage is a stream message in a site bundle
+type BundleMessage struct {
+	Stream   string      `json:"stream"`
+	Sequence uint64      `json:"seq"`
+	Subject  string      `json:"subject"`
+	Time     time.Time   `json:"time"`
+	Header   nats.Header `json:"header,omitempty"`
+	Data     []byte      `json:"data"`
+}
+
+// bundleExportState records the last message exported from each stream so bundles only hold new data
+type bundleExportState struct {
+	Exported time.Time         `json:"exported"`
+	Streams  map[string]uint64 `json:"streams"`
+}
+
+// bundleImportState records the newest backend bundle imported so an older one can not roll the site back
+type bundleImportState struct {
+	Created  time.Time `json:"created"`
+	Imported time.Time `json:"imported"`
+}
+
+// bundleResult counts what was exported or imported
+type bundleResult struct {
+	Messages  map[string]int `json:"messages,omitempty"`
+	Config    int            `json:"config,omitempty"`
+	Artifacts int            `json:"artifacts,omitempty"`
+}
+
+// bundleWriter stages files in a temporary directory so the manifest can hold their digests before they are archived
+type bundleWriter struct {
+	dir      string
+	names    []string
+	manifest *BundleManifest
+}
+
+func newBundleWriter(manifest *BundleManifest) (*bundleWriter, error) {
+	dir, err := os.MkdirTemp("", "machine-room-bundle-*")
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Created = time.Now().UTC()
+
+	return &bundleWriter{dir: dir, manifest: manifest}, nil
+}
+
+// create adds a file to the bundle, the caller has to close it
+func (w *bundleWriter) create(name string) (*os.File, error) {
+	if !validBundleFileName(name) || slices.Contains(w.names, name) {
+		return nil, fmt.Errorf("invalid bundle file name %q", name)
+	}
+
+	path := filepath.Join(w.dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	w.names = append(w.names, name)
+
+	return f, nil
+}
+
+// add adds a file to the bundle holding the data read from r
+func (w *bundleWriter) add(name string, r io.Reader) error {
+	f, err := w.create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// write signs the manifest using key and saves the bundle in file
+func (w *bundleWriter) write(file string, key ed25519.PrivateKey) error {
+	w.manifest.Files = []BundleFile{}
+
+	for _, name := range w.names {
+		f, err := os.Open(filepath.Join(w.dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		size, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		w.manifest.Files = append(w.manifest.Files, BundleFile{Name: name, Size: size, Digest: hex.EncodeToString(h.Sum(nil))})
+	}
+
+	mj, err := json.Marshal(w.manifest)
+	if err != nil {
+		return err
+	}
+	sig := []byte(hex.EncodeToString(ed25519.Sign(key, mj)))
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	tf, err := os.CreateTemp(filepath.Dir(abs), fmt.Sprintf(".%s-*", filepath.Base(abs)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+
+	gz := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gz)
+
+	err = w.writeArchive(tw, mj, sig)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		tf.Close()
+		return err
+	}
+
+	err = tf.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tf.Name(), abs)
+}
+
+func (w *bundleWriter) writeArchive(tw *tar.Writer, manifest []byte, sig []byte) error {
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{bundleManifestName, manifest}, {bundleSignatureName, sig}} {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data)), ModTime: w.manifest.Created, Typeflag: tar.TypeReg})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(f.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range w.manifest.Files {
+		err := tw.WriteHeader(&tar.Header{Name: file.Name, Mode: 0600, Size: file.Size, ModTime: w.manifest.Created, Typeflag: tar.TypeReg})
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(filepath.Join(w.dir, filepath.FromSlash(file.Name)))
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *bundleWriter) close() {
+	os.RemoveAll(w.dir)
+}
+
+func validBundleFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "/") && !slices.Contains(strings.Split(name, "/"), "..")
+}
+
+// openBundle opens a bundle and reads its manifest and signature
+func openBundle(file string) (*tar.Reader, func(), []byte, []byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	closer := func() {
+		gz.Close()
+		f.Close()
+	}
+
+	tr := tar.NewReader(gz)
+
+	var parts [][]byte
+	for _, name := range []string{bundleManifestName, bundleSignatureName} {
+		hdr, err := tr.Next()
+		if err != nil {
+			closer()
+			return nil, nil, nil, nil, fmt.Errorf("%s is not a bundle: %w", file, err)
+		}
+		if hdr.Name != name {
+			closer()
+			return nil, nil, nil, nil, fmt.Errorf("%s is not a bundle: expected %s but found %s", file, name, hdr.Name)
+		}
+
+		data, err := io.ReadAll(io.LimitReader(tr, 10*1024*1024))
+		if err != nil {
+			closer()
+			return nil, nil, nil, nil, err
+		}
+		parts = append(parts, data)
+	}
+
+	return tr, closer, parts[0], parts[1], nil
+}
+
+// stagedBundle is a verified bundle extracted to a private directory, its files are read from there so the bundle can
+// not be changed between verifying and using it
+type stagedBundle struct {
+	dir      string
+	manifest *BundleManifest
+}
+
+// stageBundle verifies the manifest was signed using the hex encoded publicKey and extracts the files, each is checked
+// against the manifest while it is extracted
+func stageBundle(file string, publicKey string) (*stagedBundle, error) {
+	pk, err := hex.DecodeString(publicKey)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid bundle signing key")
+	}
+
+	tr, closer, mj, sig, err := openBundle(file)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+
+	s, err := hex.DecodeString(string(sig))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle signature: %w", err)
+	}
+	if !ed25519.Verify(pk, mj, s) {
+		return nil, fmt.Errorf("bundle signature verification failed")
+	}
+
+	var manifest BundleManifest
+	err = json.Unmarshal(mj, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %w", err)
+	}
+
+	expected := map[string]BundleFile{}
+	for _, f := range manifest.Files {
+		if !validBundleFileName(f.Name) {
+			return nil, fmt.Errorf("invalid bundle file name %q", f.Name)
+		}
+		expected[f.Name] = f
+	}
+
+	dir, err := os.MkdirTemp("", "machine-room-bundle-*")
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedBundle{dir: dir, manifest: &manifest}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			staged.close()
+			return nil, err
+		}
+
+		f, ok := expected[hdr.Name]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			staged.close()
+			return nil, fmt.Errorf("bundle entry %s is not in the manifest", hdr.Name)
+		}
+		delete(expected, hdr.Name)
+
+		err = staged.extract(f, tr)
+		if err != nil {
+			staged.close()
+			return nil, err
+		}
+	}
+
+	if len(expected) > 0 {
+		staged.close()
+		return nil, fmt.Errorf("bundle is missing %d files listed in the manifest", len(expected))
+	}
+
+	return staged, nil
+}
+
+func (b *stagedBundle) path(name string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(name))
+}
+
+// extract saves a bundle entry and checks it matches f
+func (b *stagedBundle) extract(f BundleFile, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(b.path(f.Name)), 0700)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(b.path(f.Name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, h), io.LimitReader(r, f.Size+1))
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	if size != f.Size || hex.EncodeToString(h.Sum(nil)) != f.Digest {
+		return fmt.Errorf("bundle entry %s does not match the manifest", f.Name)
+	}
+
+	return nil
+}
+
+// walk calls cb for every file in the order of the manifest
+func (b *stagedBundle) walk(cb func(name string, r io.Reader) error) error {
+	for _, f := range b.manifest.Files {
+		r, err := os.Open(b.path(f.Name))
+		if err != nil {
+			return err
+		}
+
+		err = cb(f.Name, r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *stagedBundle) close() {
+	os.RemoveAll(b.dir)
+}
+
+// WriteConfigBundle creates a bundle for a site without connectivity to the backend holding CONFIG values and plugin
+// artifacts, artifacts maps the name of the artifact to a local file. The bundle is signed using the private key matching
+// the MachineSigningKey of the site and loaded using the bundle import command
+func WriteConfigBundle(file string, site string, values map[string][]byte, artifacts map[string]string, key ed25519.PrivateKey) error {
+	if site == "" {
+		return fmt.Errorf("site is required")
+	}
+
+	w, err := newBundleWriter(&BundleManifest{Kind: BundleKindBackend, Site: site})
+	if err != nil {
+		return err
+	}
+	defer w.close()
+
+	if len(values) > 0 {
+		vj, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+
+		err = w.add(bundleConfigName, bytes.NewReader(vj))
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, path := range artifacts {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		err = w.add(bundleArtifactsDir+name, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.write(file, key)
+}
+
+// ReadSiteBundle verifies a bundle exported by a leader using its hex encoded public key and calls cb for every message in it
+func ReadSiteBundle(file string, publicKey string, cb func(msg *BundleMessage) error) (*BundleManifest, error) {
+	bundle, err := stageBundle(file, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer bundle.close()
+
+	if bundle.manifest.Kind != BundleKindSite {
+		return nil, fmt.Errorf("not a site bundle")
+	}
+
+	err = bundle.walk(func(name string, r io.Reader) error {
+		if !strings.HasPrefix(name, bundleStreamsDir) {
+			return nil
+		}
+
+		dec := json.NewDecoder(r)
+		for {
+			var msg BundleMessage
+			err := dec.Decode(&msg)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = cb(&msg)
+			if err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bundle.manifest, nil
+}
+
+func bundleStateFile(opts *Options) string {
+	return filepath.Join(opts.ServerStorageDirectory, defaultBundleStateFile)
+}
+
+func bundleImportStateFile(opts *Options) string {
+	return filepath.Join(opts.ServerStorageDirectory, defaultBundleImportStateFile)
+}
+
+func readBundleImportState(opts *Options) (*bundleImportState, error) {
+	state := &bundleImportState{}
+
+	if !choria.FileExist(bundleImportStateFile(opts)) {
+		return state, nil
+	}
+
+	sj, err := os.ReadFile(bundleImportStateFile(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(sj, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func readBundleExportState(opts *Options) (*bundleExportState, error) {
+	state := &bundleExportState{Streams: map[string]uint64{}}
+
+	if !choria.FileExist(bundleStateFile(opts)) {
+		return state, nil
+	}
+
+	sj, err := os.ReadFile(bundleStateFile(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(sj, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Streams == nil {
+		state.Streams = map[string]uint64{}
+	}
+
+	return state, nil
+}
+
+// bundleStreams are the site streams exported to bundles, the same streams replication sends to the backend
+func bundleStreams(opts *Options) []string {
+	streams := slices.Clone(upstreamStreams)
+	for _, s := range opts.AdditionalStreams {
+		if s.Direction == ReplicateUpstream {
+			streams = append(streams, s.streamName())
+		}
+	}
+
+	return streams
+}
+
+// exportSiteBundle writes the messages in the upstream streams that were not exported before to file, the data policy
+// is applied like it is for replication. With full all messages still in the streams are exported
+func exportSiteBundle(ctx context.Context, opts *Options, js nats.JetStreamContext, file string, site string, identity string, key ed25519.PrivateKey, full bool, log *logrus.Entry) (*bundleResult, []*AuditEntry, error) {
+	state, err := readBundleExportState(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read export state: %w", err)
+	}
+
+	var policy *dataPolicyEngine
+	if choria.FileExist(opts.DataPolicyFile) {
+		var key []byte
+		key, err = dataPolicyKey(opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not load data policy key: %w", err)
+		}
+
+		policy, err = newDataPolicyEngine(opts.DataPolicyFile, key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not load data policy: %w", err)
+		}
+	}
+
+	w, err := newBundleWriter(&BundleManifest{Kind: BundleKindSite, Site: site, Identity: identity, PublicKey: hex.EncodeToString(key.Public().(ed25519.PublicKey))})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer w.close()
+
+	res := &bundleResult{Messages: map[string]int{}}
+	var audit []*AuditEntry
+	last := map[string]uint64{}
+
+	for _, stream := range bundleStreams(opts) {
+		info, err := js.StreamInfo(stream, nats.Context(ctx))
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		start := state.Streams[stream] + 1
+		if full || start < info.State.FirstSeq {
+			start = info.State.FirstSeq
+		}
+		last[stream] = info.State.LastSeq
+
+		if start > info.State.LastSeq {
+			continue
+		}
+
+		log.Infof("Exporting %s messages %d to %d", stream, start, info.State.LastSeq)
+
+		f, err := w.create(bundleStreamsDir + stream + ".jsonl")
+		if err != nil {
+			return nil, nil, err
+		}
+		enc := json.NewEncoder(f)
+
+		for seq := start; seq <= info.State.LastSeq; seq++ {
+			msg, err := js.GetMsg(stream, seq, nats.Context(ctx))
+			if errors.Is(err, nats.ErrMsgNotFound) {
+				continue
+			}
+			if err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+
+			if policy != nil && slices.Contains(upstreamStreams, stream) {
+				data, forward := policy.apply(stream, msg.Subject, msg.Data)
+				if !forward {
+					continue
+				}
+				msg.Data = data
+			}
+
+			err = enc.Encode(&BundleMessage{Stream: stream, Sequence: msg.Sequence, Subject: msg.Subject, Time: msg.Time, Header: msg.Header, Data: msg.Data})
+			if err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+
+			sum := sha256.Sum256(msg.Data)
+			audit = append(audit, &AuditEntry{Direction: auditSent, Replication: bundleReplication, Stream: stream, StreamSequence: msg.Sequence, Subject: msg.Subject, Size: len(msg.Data), Digest: hex.EncodeToString(sum[:])})
+			res.Messages[stream]++
+		}
+
+		err = f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = w.write(file, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// only once the bundle is saved so a failed export is repeated in full
+	for stream, seq := range last {
+		state.Streams[stream] = seq
+	}
+	state.Exported = time.Now().UTC()
+
+	sj, err := json.Marshal(state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = writeFileAtomic(bundleStateFile(opts), sj, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not save export state: %w", err)
+	}
+
+	return res, audit, nil
+}
+
+// importBackendBundle loads the CONFIG values and plugin artifacts in a bundle signed by the backend into the site broker
+func importBackendBundle(ctx context.Context, opts *Options, js nats.JetStreamContext, file string, site string, log *logrus.Entry) (*bundleResult, []*AuditEntry, error) {
+	if opts.MachineSigningKey == "" {
+		return nil, nil, fmt.Errorf("importing bundles requires a machine signing key")
+	}
+
+	state, err := readBundleImportState(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read import state: %w", err)
+	}
+
+	bundle, err := stageBundle(file, opts.MachineSigningKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer bundle.close()
+
+	manifest := bundle.manifest
+
+	switch {
+	case manifest.Kind != BundleKindBackend:
+		return nil, nil, fmt.Errorf("%s bundles can not be imported", manifest.Kind)
+	case manifest.Site == "":
+		return nil, nil, fmt.Errorf("bundle is not for a specific site")
+	case manifest.Site != site:
+		return nil, nil, fmt.Errorf("bundle is for site %s", manifest.Site)
+	case manifest.Created.IsZero():
+		return nil, nil, fmt.Errorf("bundle has no creation time")
+	case manifest.Created.Before(state.Created):
+		return nil, nil, fmt.Errorf("bundle created at %v is older than the bundle created at %v that was already imported", manifest.Created, state.Created)
+	}
+
+	digests := map[string]string{}
+	for _, f := range manifest.Files {
+		digests[f.Name] = f.Digest
+	}
+
+	res := &bundleResult{}
+	var audit []*AuditEntry
+
+	err = bundle.walk(func(name string, r io.Reader) error {
+		var entry *AuditEntry
+		var err error
+
+		switch {
+		case name == bundleConfigName:
+			res.Config, audit, err = importBundleConfig(opts, js, r, audit, log)
+			return err
+
+		case strings.HasPrefix(name, bundleArtifactsDir):
+			entry, err = importBundleArtifact(js, strings.TrimPrefix(name, bundleArtifactsDir), digests[name], r, log)
+			if err != nil {
+				return err
+			}
+			if entry != nil {
+				res.Artifacts++
+				audit = append(audit, entry)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state.Created = manifest.Created
+	state.Imported = time.Now().UTC()
+
+	sj, err := json.Marshal(state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = writeFileAtomic(bundleImportStateFile(opts), sj, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not save import state: %w", err)
+	}
+
+	return res, audit, nil
+}
+
+func importBundleConfig(opts *Options, js nats.JetStreamContext, r io.Reader, audit []*AuditEntry, log *logrus.Entry) (int, []*AuditEntry, error) {
+	var values map[string][]byte
+	err := json.NewDecoder(r).Decode(&values)
+	if err != nil {
+		return 0, audit, err
+	}
+
+	kv, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return 0, audit, fmt.Errorf("could not access CONFIG bucket: %w", err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	changed := 0
+	for _, k := range keys {
+		key := k
+		// the same keys replication would store
+		if opts.ConfigBucketPrefix != "" {
+			key = strings.TrimPrefix(key, opts.ConfigBucketPrefix+".")
+		}
+
+		current, err := kv.Get(key)
+		if err == nil && bytes.Equal(current.Value(), values[k]) {
+			continue
+		}
+
+		log.Infof("Importing CONFIG key %s", key)
+		rev, err := kv.Put(key, values[k])
+		if err != nil {
+			return changed, audit, err
+		}
+		changed++
+
+		sum := sha256.Sum256(values[k])
+		audit = append(audit, &AuditEntry{Direction: auditReceived, Replication: bundleReplication, Stream: "KV_CONFIG", StreamSequence: rev, Subject: "$KV.CONFIG." + key, Operation: "PUT", Size: len(values[k]), Digest: hex.EncodeToString(sum[:])})
+	}
+
+	return changed, audit, nil
+}
+
+// importBundleArtifact stores an artifact in the plugins object store unless it is already there, digest is the hex sha256 from the manifest
+func importBundleArtifact(js nats.JetStreamContext, name string, digest string, r io.Reader, log *logrus.Entry) (*AuditEntry, error) {
+	obs, err := js.ObjectStore(pluginsBucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not access %s bucket: %w", pluginsBucket, err)
+	}
+
+	sum, err := hex.DecodeString(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	nfo, err := obs.GetInfo(name)
+	if err == nil && nfo.Digest == "SHA-256="+base64.URLEncoding.EncodeToString(sum) {
+		return nil, nil
+	}
+
+	log.Infof("Importing plugin artifact %s", name)
+	nfo, err = obs.Put(&nats.ObjectMeta{Name: name}, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditEntry{Direction: auditReceived, Replication: bundleReplication, Stream: "OBJ_" + pluginsBucket, Subject: name, Size: int(nfo.Size), Digest: digest}, nil
+}
+
+// auditBundle records the data moved by a bundle in the audit log
+func auditBundle(opts *Options, entries []*AuditEntry) error {
+	if opts.NoAuditLog || len(entries) == 0 {
+		return nil
+	}
+
+	alog, err := openAuditLog(opts.AuditDirectory, opts.AuditLogMaxSize, opts.AuditLogMaxFiles, opts.ServerSeedFile)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		entry.Time = time.Now().UTC()
+		err = alog.append(entry)
+		if err != nil {
+			alog.close()
+			return err
+		}
+	}
+
+	err = alog.sync()
+	if err != nil {
+		alog.close()
+		return err
+	}
+
+	return alog.close()
+}
@@ -7,8 +7,10 @@ package machineroom
 import (
 	"context"
 	"os"
+	"time"
 
 	"github.com/choria-io/fisk"
+	"github.com/choria-io/machine-room/provisioning"
 	"github.com/sirupsen/logrus"
 )
 
@@ -28,9 +30,28 @@ type cliInstance struct {
 	loglevel string
 	debug    bool
 	cfgFile  string
-	isLeader bool
 	force    bool
 
+	resetCredentialsOnly bool
+	resetStateOnly       bool
+	resetMachinesOnly    bool
+	resetArchive         bool
+	restoreFile          string
+
+	jsonOutput bool
+
+	auditSubject   string
+	auditDirection string
+	auditStream    string
+	auditSince     time.Duration
+
+	tokenRequest    provisioning.TokenRequest
+	tokenIssuerSeed string
+	tokenFile       string
+
+	bundleFile string
+	bundleFull bool
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -38,7 +59,7 @@ type cliInstance struct {
 func newCli(o Options) (*cliInstance, error) {
 	app := &cliInstance{opts: &o}
 
-	err := app.validateOptions()
+	err := app.opts.validate()
 	if err != nil {
 		return nil, err
 	}
@@ -80,12 +101,76 @@ func (c *cliInstance) createCli() *fisk.Application {
 	reset := cli.Commandf("reset", "Restores the agent to factory defaults").Action(c.resetCommand)
 	reset.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
 	reset.Flag("force", "Force reset without prompting").UnNegatableBoolVar(&c.force)
+	reset.Flag("credentials-only", "Only removes credentials and configuration to provision again, keeping state").UnNegatableBoolVar(&c.resetCredentialsOnly)
+	reset.Flag("state-only", "Only removes state like streams and facts, keeping the identity").UnNegatableBoolVar(&c.resetStateOnly)
+	reset.Flag("machines-only", "Only removes autonomous agents").UnNegatableBoolVar(&c.resetMachinesOnly)
+	reset.Flag("archive", "Saves what is removed in an archive in the backup directory").UnNegatableBoolVar(&c.resetArchive)
+
+	restore := cli.Commandf("restore", "Restores files removed by reset from an archive").Action(c.restoreCommand)
+	restore.Arg("archive", "The archive created by reset").Required().ExistingFileVar(&c.restoreFile)
+	restore.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+	restore.Flag("force", "Force restore without prompting").UnNegatableBoolVar(&c.force)
+
+	status := cli.Commandf("status", "Reports the health of the agent, broker and replication").Action(c.statusCommand)
+	status.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+	status.Flag("json", "Produce JSON output").UnNegatableBoolVar(&c.jsonOutput)
+
+	doctor := cli.Commandf("doctor", "Checks the configuration, credentials and connectivity of the agent").Action(c.doctorCommand)
+	doctor.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+	doctor.Flag("json", "Produce JSON output").UnNegatableBoolVar(&c.jsonOutput)
+
+	audit := cli.Commandf("audit", "Verifies and searches the log of data sent to and received from the backend")
+	verify := audit.Commandf("verify", "Verifies the audit log was not modified").Action(c.auditVerifyCommand)
+	verify.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+	verify.Flag("json", "Produce JSON output").UnNegatableBoolVar(&c.jsonOutput)
+
+	search := audit.Commandf("search", "Searches the audit log").Action(c.auditSearchCommand)
+	search.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+	search.Flag("subject", "Subject to match, wildcards are supported").StringVar(&c.auditSubject)
+	search.Flag("direction", "Only show data queued for replication, sent in bundles or received").EnumVar(&c.auditDirection, auditQueued, auditSent, auditReceived)
+	search.Flag("stream", "Only show data in a site stream").StringVar(&c.auditStream)
+	search.Flag("since", "Only show entries recorded within this duration").DurationVar(&c.auditSince)
+	search.Flag("json", "Produce JSON output").UnNegatableBoolVar(&c.jsonOutput)
+
+	token := cli.Commandf("token", "Issues and inspects provisioning and server tokens")
+	issue := token.Commandf("issue", "Issues a provisioning token for a customer").Action(c.tokenIssueCommand)
+	issue.Arg("file", "File to save the token in, printed when not set").StringVar(&c.tokenFile)
+	issue.Flag("issuer", "Organization Issuer seed file used to sign the token").Required().ExistingFileVar(&c.tokenIssuerSeed)
+	issue.Flag("customer", "Customer the token is issued to").Required().StringVar(&c.tokenRequest.Extensions.Customer)
+	issue.Flag("role", "Role of nodes using the token").StringVar(&c.tokenRequest.Extensions.Role)
+	issue.Flag("site", "Restricts the token to a site of the customer").StringVar(&c.tokenRequest.Extensions.Site)
+	issue.Flag("token", "Shared secret configured in the provisioner").Required().StringVar(&c.tokenRequest.Token)
+	issue.Flag("urls", "Provisioning broker URLs").StringsVar(&c.tokenRequest.URLs)
+	issue.Flag("srv", "Domain to find provisioning brokers in using SRV records").StringVar(&c.tokenRequest.SRVDomain)
+	issue.Flag("insecure", "Connect to provisioning brokers without TLS").UnNegatableBoolVar(&c.tokenRequest.Insecure)
+	issue.Flag("validity", "How long the token can be used").Default("8760h").DurationVar(&c.tokenRequest.Validity)
+
+	inspect := token.Commandf("inspect", "Decodes tokens and reports problems like expiry or a mismatched key").Action(c.tokenInspectCommand)
+	inspect.Arg("file", "Token to inspect instead of the tokens in the configuration").ExistingFileVar(&c.tokenFile)
+	inspect.Flag("config", "Configuration file to use").StringVar(&c.cfgFile)
+	inspect.Flag("json", "Produce JSON output").UnNegatableBoolVar(&c.jsonOutput)
+
+	bundle := cli.Commandf("bundle", "Exchanges data with the backend using files on sites without connectivity")
+	export := bundle.Commandf("export", "Saves site data not yet sent to the backend in a signed bundle").Action(c.bundleExportCommand)
+	export.Arg("file", "File to save the bundle in").Required().StringVar(&c.bundleFile)
+	export.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+	export.Flag("full", "Exports all data in the streams, including data exported before").UnNegatableBoolVar(&c.bundleFull)
+	export.Flag("json", "Produce JSON output").UnNegatableBoolVar(&c.jsonOutput)
+
+	imp := bundle.Commandf("import", "Loads CONFIG values and plugin artifacts from a bundle produced by the backend").Action(c.bundleImportCommand)
+	imp.Arg("file", "The bundle to import").Required().ExistingFileVar(&c.bundleFile)
+	imp.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+	imp.Flag("json", "Produce JSON output").UnNegatableBoolVar(&c.jsonOutput)
 
 	// generates and saves facts, will be called from auto agents to
 	// update facts on a schedule hidden as it's basically a private api
 	facts := cli.Commandf("facts", "Save facts about this node to a file").Action(c.factsCommand).Hidden()
 	facts.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
 
+	// installs the version requested by the backend, called from the upgrade auto agent
+	upgrade := cli.Commandf("upgrade", "Upgrades the agent to the version requested by the backend").Action(c.upgradeCommand).Hidden()
+	upgrade.Flag("config", "Configuration file to use").Required().StringVar(&c.cfgFile)
+
 	cli.Commandf("buildinfo", "Shows build information").Action(c.buildInfoCommand).Hidden()
 
 	return cli
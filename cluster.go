@@ -0,0 +1,133 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// most replicas kept of each stream when leaders are clustered
+const maxClusterReplicas = 3
+
+// clusterPeers are the leaders forming the site broker cluster from machine_room.broker.peers, empty when not clustered
+func (b *broker) clusterPeers() []string {
+	var peers []string
+	for _, p := range strings.Split(b.cfg.Option(configKeyBrokerPeers, ""), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			peers = append(peers, p)
+		}
+	}
+
+	// a single leader is not a cluster
+	if len(peers) < 2 {
+		return nil
+	}
+
+	return peers
+}
+
+// clustered determines if the site broker is part of a cluster of leaders
+func (b *broker) clustered() bool {
+	return len(b.clusterPeers()) > 0
+}
+
+// replicas is the number of replicas streams and buckets on the site broker should have
+func (b *broker) replicas() int {
+	peers := len(b.clusterPeers())
+	switch {
+	case peers == 0:
+		return 1
+	case peers > maxClusterReplicas:
+		return maxClusterReplicas
+	default:
+		return peers
+	}
+}
+
+// configureCluster sets up the peer connections for clustered leaders, peer TLS uses the persistent CA which has
+// to be the same on all leaders and is only created and renewed by the first leader
+func (b *broker) configureCluster() error {
+	peers := b.clusterPeers()
+	if len(peers) == 0 {
+		return nil
+	}
+
+	if len(peers)%2 == 0 {
+		b.log.Warnf("Clustering %d leaders, an odd number of leaders is recommended", len(peers))
+	}
+
+	var urls []string
+	self := false
+	for _, p := range peers {
+		if p == b.cfg.Identity {
+			self = true
+		}
+		urls = append(urls, fmt.Sprintf("nats://%s:%d", p, defaultNetworkPeerPort))
+	}
+
+	if !self {
+		return fmt.Errorf("%s is not listed in %s", b.cfg.Identity, configKeyBrokerPeers)
+	}
+
+	b.cfg.Choria.NetworkPeerPort = defaultNetworkPeerPort
+	b.cfg.Choria.NetworkPeers = urls
+
+	b.log.Warnf("Clustering with peers %s using %d replicas", strings.Join(peers, ", "), b.replicas())
+
+	return nil
+}
+
+// scaleStreams raises the replicas of streams and buckets created before the leaders were clustered
+func (b *broker) scaleStreams(ctx context.Context, nc *nats.Conn) error {
+	if !b.clustered() {
+		return nil
+	}
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	// Choria creates CHORIA_EVENTS, CHORIA_MACHINE and the elections bucket once using the replicas in force at the time
+	streams := []string{"REGISTRATION", "SUBMIT", "CHORIA_EVENTS", "CHORIA_MACHINE", "KV_CHORIA_LEADER_ELECTION", jobsStream, jobResultsStream, outboundStream, "KV_CONFIG", "KV_" + machinesBucket, "KV_" + resolvedConfigBucket, "OBJ_" + pluginsBucket}
+	for _, s := range b.opts.AdditionalStreams {
+		if s.Bucket != "" {
+			streams = append(streams, "KV_"+s.Bucket)
+		} else {
+			streams = append(streams, s.Stream)
+		}
+	}
+
+	for _, name := range streams {
+		info, err := js.StreamInfo(name)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if info.Config.Replicas >= b.replicas() {
+			continue
+		}
+
+		cfg := info.Config
+		cfg.Replicas = b.replicas()
+
+		_, err = js.UpdateStream(&cfg)
+		if err != nil {
+			return fmt.Errorf("could not scale %s to %d replicas: %w", name, cfg.Replicas, err)
+		}
+
+		b.log.Warnf("Scaled %s to %d replicas", name, cfg.Replicas)
+	}
+
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/choria-io/fisk"
+)
+
+func (c *cliInstance) auditVerifyCommand(_ *fisk.ParseContext) error {
+	_, _, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	res, err := verifyAuditLog(c.opts.AuditDirectory, c.opts.ServerSeedFile)
+	if res == nil {
+		return err
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	if c.jsonOutput {
+		j, jerr := json.MarshalIndent(res, "", "  ")
+		if jerr != nil {
+			return jerr
+		}
+		fmt.Println(string(j))
+	} else if err == nil {
+		switch {
+		case res.Entries == 0:
+			fmt.Printf("Audit log %s has no entries\n", c.opts.AuditDirectory)
+		default:
+			fmt.Printf("Verified %d audit log entries %d to %d in %d files, anchored at entry %d\n", res.Entries, res.First, res.Last, len(res.Files), res.Anchored)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("audit log verification failed: %w", err)
+	}
+
+	return nil
+}
+
+func (c *cliInstance) auditSearchCommand(_ *fisk.ParseContext) error {
+	_, _, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if c.auditSince > 0 {
+		since = time.Now().Add(-c.auditSince)
+	}
+
+	_, err = walkAuditLog(c.opts.AuditDirectory, false, func(entry *AuditEntry) error {
+		switch {
+		case c.auditSubject != "" && !subjectMatches(c.auditSubject, entry.Subject):
+			return nil
+		case c.auditDirection != "" && c.auditDirection != entry.Direction:
+			return nil
+		case c.auditStream != "" && c.auditStream != entry.Stream:
+			return nil
+		case entry.Time.Before(since):
+			return nil
+		}
+
+		if c.jsonOutput {
+			j, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(j))
+
+			return nil
+		}
+
+		op := ""
+		if entry.Operation != "" {
+			op = " " + entry.Operation
+		}
+
+		fmt.Printf("%d %s %8s %s %s%s (%d bytes, sha256 %s)\n", entry.Sequence, entry.Time.Format(time.RFC3339), entry.Direction, entry.Stream, entry.Subject, op, entry.Size, entry.Digest)
+
+		return nil
+	})
+
+	return err
+}
@@ -0,0 +1,147 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/choria-io/fisk"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/choria-io/go-choria/config"
+	"github.com/nats-io/nats.go"
+)
+
+func (c *cliInstance) bundleExportCommand(_ *fisk.ParseContext) error {
+	_, log, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	cfg, nc, err := connectSiteBroker(c.ctx, c.opts, c.cfgFile, "bundle_export", log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	err = bundleLeaderOnly(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, key, err := choria.Ed25519KeyPairFromSeedFile(c.opts.ServerSeedFile)
+	if err != nil {
+		return fmt.Errorf("could not load server seed: %w", err)
+	}
+
+	js, err := nc.JetStream(nats.Context(c.ctx))
+	if err != nil {
+		return err
+	}
+
+	res, audit, err := exportSiteBundle(c.ctx, c.opts, js, c.bundleFile, cfg.Option(configKeySite, ""), cfg.Identity, key, c.bundleFull, log)
+	if err != nil {
+		return fmt.Errorf("export failed: %w", err)
+	}
+
+	err = c.auditBundle(cfg, audit)
+	if err != nil {
+		return err
+	}
+
+	return c.renderBundleResult(res, fmt.Sprintf("Exported site data to %s", c.bundleFile))
+}
+
+func (c *cliInstance) bundleImportCommand(_ *fisk.ParseContext) error {
+	_, log, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	cfg, nc, err := connectSiteBroker(c.ctx, c.opts, c.cfgFile, "bundle_import", log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	err = bundleLeaderOnly(cfg)
+	if err != nil {
+		return err
+	}
+
+	js, err := nc.JetStream(nats.Context(c.ctx))
+	if err != nil {
+		return err
+	}
+
+	res, audit, err := importBackendBundle(c.ctx, c.opts, js, c.bundleFile, cfg.Option(configKeySite, ""), log)
+	if err != nil {
+		return fmt.Errorf("import failed: %w", err)
+	}
+
+	err = c.auditBundle(cfg, audit)
+	if err != nil {
+		return err
+	}
+
+	return c.renderBundleResult(res, fmt.Sprintf("Imported %s", c.bundleFile))
+}
+
+func bundleLeaderOnly(cfg *config.Config) error {
+	if cfg.Option(configKeyRole, "follower") != "leader" {
+		return fmt.Errorf("bundles can only be used on leaders")
+	}
+
+	return nil
+}
+
+// auditBundle records bundle transfers in the audit log of offline leaders, the agent keeps the log of other leaders
+func (c *cliInstance) auditBundle(cfg *config.Config, entries []*AuditEntry) error {
+	if cfg.Option(configKeyOffline, "false") != "true" {
+		return nil
+	}
+
+	err := auditBundle(c.opts, entries)
+	if err != nil {
+		return fmt.Errorf("could not update audit log: %w", err)
+	}
+
+	return nil
+}
+
+func (c *cliInstance) renderBundleResult(res *bundleResult, msg string) error {
+	if c.jsonOutput {
+		j, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+
+		return nil
+	}
+
+	fmt.Println(msg)
+	fmt.Println()
+
+	var streams []string
+	for s := range res.Messages {
+		streams = append(streams, s)
+	}
+	sort.Strings(streams)
+
+	for _, s := range streams {
+		fmt.Printf("  %s: %d messages\n", s, res.Messages[s])
+	}
+	if res.Config > 0 || res.Artifacts > 0 {
+		fmt.Printf("  CONFIG: %d values changed\n", res.Config)
+		fmt.Printf("  %s: %d artifacts changed\n", pluginsBucket, res.Artifacts)
+	}
+	if len(streams) == 0 && res.Config == 0 && res.Artifacts == 0 {
+		fmt.Println("  No new data")
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/choria-io/fisk"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/choria-io/go-choria/config"
+)
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+)
+
+// doctorCheck is the outcome of a single preflight check
+type doctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+type doctorReport struct {
+	Checks []*doctorCheck `json:"checks"`
+	Failed int            `json:"failed"`
+}
+
+func (r *doctorReport) add(name string, status string, message string, hint string) {
+	r.Checks = append(r.Checks, &doctorCheck{Name: name, Status: status, Message: message, Hint: hint})
+	if status == doctorFail {
+		r.Failed++
+	}
+}
+
+func (c *cliInstance) doctorCommand(_ *fisk.ParseContext) error {
+	_, _, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	report := c.runDoctor()
+
+	if c.jsonOutput {
+		j, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+	} else {
+		report.render()
+	}
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d checks failed", report.Failed)
+	}
+
+	return nil
+}
+
+func (c *cliInstance) runDoctor() *doctorReport {
+	report := &doctorReport{Checks: []*doctorCheck{}}
+
+	cfg, err := config.NewConfig(c.cfgFile)
+	if err != nil {
+		report.add("Configuration", doctorFail, err.Error(), fmt.Sprintf("Restore %s from the provisioner or run reset to provision again", c.cfgFile))
+	} else {
+		report.add("Configuration", doctorPass, fmt.Sprintf("%s parsed", c.cfgFile), "")
+	}
+
+	c.doctorProvisioningToken(report)
+
+	provisioned := choria.FileExist(c.opts.ServerJWTFile) || choria.FileExist(c.opts.ServerSeedFile)
+	if provisioned {
+		c.doctorCredentials(report)
+	} else {
+		report.add("Credentials", doctorSkip, "not provisioned yet", "Nodes waiting for provisioning have no credentials, check the provisioner logs if this persists")
+	}
+
+	c.doctorWritable(report, "Storage directory", c.opts.ServerStorageDirectory)
+	c.doctorWritable(report, "Submission spool", c.opts.ServerSubmissionDirectory)
+
+	if err == nil && provisioned {
+		c.doctorSite(report, cfg)
+	}
+
+	return report
+}
+
+func (c *cliInstance) doctorProvisioningToken(report *doctorReport) {
+	if !choria.FileExist(c.opts.ProvisioningJWTFile) {
+		report.add("Provisioning token", doctorFail, fmt.Sprintf("%s does not exist", c.opts.ProvisioningJWTFile), "Install the provisioning.jwt received from the SaaS in the configuration directory")
+		return
+	}
+
+	ti := c.inspectToken(c.opts.ProvisioningJWTFile)
+	if len(ti.Problems) == 1 && ti.NoExpiry {
+		report.add("Provisioning token", doctorWarn, ti.Problems[0], "Request a provisioning token with an expiry from the SaaS to limit the impact of it leaking")
+		return
+	}
+	if len(ti.Problems) > 0 {
+		report.add("Provisioning token", doctorFail, strings.Join(ti.Problems, ", "), "Request a new provisioning token from the SaaS")
+		return
+	}
+
+	report.add("Provisioning token", doctorPass, fmt.Sprintf("valid until %s", ti.Expires.Format(time.RFC3339)), "")
+}
+
+func (c *cliInstance) doctorCredentials(report *doctorReport) {
+	files := []struct {
+		name   string
+		file   string
+		secret bool
+	}{
+		{"Server seed", c.opts.ServerSeedFile, true},
+		{"Server token", c.opts.ServerJWTFile, false},
+		{"NATS nkey", c.opts.NatsNkeySeedFile, true},
+	}
+
+	for _, f := range files {
+		nfo, err := os.Stat(f.file)
+		switch {
+		case os.IsNotExist(err):
+			report.add(f.name, doctorFail, fmt.Sprintf("%s does not exist", f.file), "Run reset to provision the node again")
+		case err != nil:
+			report.add(f.name, doctorFail, err.Error(), fmt.Sprintf("Ensure the agent user can read %s", f.file))
+		case f.secret && nfo.Mode().Perm()&0077 != 0:
+			report.add(f.name, doctorFail, fmt.Sprintf("%s has mode %v", f.file, nfo.Mode().Perm()), fmt.Sprintf("Run chmod 0600 %s", f.file))
+		case nfo.Mode().Perm()&0002 != 0:
+			report.add(f.name, doctorFail, fmt.Sprintf("%s is world writable", f.file), fmt.Sprintf("Run chmod 0600 %s", f.file))
+		default:
+			report.add(f.name, doctorPass, f.file, "")
+		}
+	}
+
+	if !choria.FileExist(c.opts.ServerJWTFile) || !choria.FileExist(c.opts.ServerSeedFile) {
+		return
+	}
+
+	ti := c.inspectToken(c.opts.ServerJWTFile)
+	if len(ti.Problems) == 1 && ti.RenewalDue {
+		report.add("Server token validity", doctorWarn, ti.Problems[0], "The agent renews the token while running, ensure it can reach the provisioner")
+		return
+	}
+	if len(ti.Problems) == 1 && ti.NoExpiry {
+		report.add("Server token validity", doctorWarn, ti.Problems[0], "Run reset to provision the node again with a token that expires")
+		return
+	}
+	if len(ti.Problems) > 0 {
+		report.add("Server token validity", doctorFail, strings.Join(ti.Problems, ", "), "Run reset to provision the node again")
+		return
+	}
+
+	report.add("Server token validity", doctorPass, fmt.Sprintf("matches the server seed and is valid until %s", ti.Expires.Format(time.RFC3339)), "")
+}
+
+// doctorWritable checks dir, or the closest parent it will be created in, is writable
+func (c *cliInstance) doctorWritable(report *doctorReport, name string, dir string) {
+	check := dir
+	for !choria.FileExist(check) && filepath.Dir(check) != check {
+		check = filepath.Dir(check)
+	}
+
+	tf, err := os.CreateTemp(check, ".doctor-*")
+	if err != nil {
+		report.add(name, doctorFail, fmt.Sprintf("%s is not writable: %v", check, err), fmt.Sprintf("Ensure the agent user can write to %s", check))
+		return
+	}
+	tf.Close()
+	os.Remove(tf.Name())
+
+	if check != dir {
+		report.add(name, doctorPass, fmt.Sprintf("%s will be created in %s", dir, check), "")
+		return
+	}
+
+	report.add(name, doctorPass, fmt.Sprintf("%s is writable", dir), "")
+}
+
+func (c *cliInstance) doctorSite(report *doctorReport, cfg *config.Config) {
+	role := cfg.Option(configKeyRole, "follower")
+
+	if cfg.Option(configKeySite, "") == "" {
+		report.add("Site", doctorFail, fmt.Sprintf("%s is not set", configKeySite), "Provision the node again, the provisioner sets the site")
+	} else {
+		report.add("Site", doctorPass, cfg.Option(configKeySite, ""), "")
+	}
+
+	if role == "leader" {
+		switch {
+		case cfg.Option(configKeyOffline, "false") == "true":
+			report.add("Replication source", doctorPass, "offline, data is exchanged using bundles", "")
+		case cfg.Option(configKeySourceHost, "") == "":
+			report.add("Replication source", doctorFail, fmt.Sprintf("%s is not set on a leader", configKeySourceHost), "Provision the leader again, the provisioner sets the SaaS connection for leaders")
+		default:
+			report.add("Replication source", doctorPass, "set", "")
+		}
+	}
+
+	hosts := cfg.Choria.MiddlewareHosts
+	if len(hosts) == 0 && role == "leader" {
+		hosts = []string{fmt.Sprintf("localhost:%d", defaultNetworkClientPort)}
+	}
+	if len(hosts) == 0 {
+		report.add("Site broker", doctorFail, "plugin.choria.middleware_hosts is not set", "Provision the node again, the provisioner sets the site brokers")
+		return
+	}
+
+	for _, h := range hosts {
+		addr := h
+		u, err := url.Parse(h)
+		if err == nil && u.Host != "" {
+			addr = u.Host
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, fmt.Sprintf("%d", defaultNetworkClientPort))
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err != nil {
+			report.add("Site broker", doctorFail, fmt.Sprintf("%s is not reachable: %v", addr, err), "Ensure the leader is running and port 9222 is allowed by firewalls between the node and the leader")
+			continue
+		}
+		conn.Close()
+
+		report.add("Site broker", doctorPass, fmt.Sprintf("%s is reachable", addr), "")
+	}
+}
+
+func (r *doctorReport) render() {
+	fmt.Println("Machine Room Doctor")
+	fmt.Println()
+
+	for _, check := range r.Checks {
+		fmt.Printf("  [%s] %s: %s\n", strings.ToUpper(check.Status), check.Name, check.Message)
+		if check.Hint != "" && check.Status != doctorPass {
+			fmt.Printf("         %s\n", check.Hint)
+		}
+	}
+
+	fmt.Println()
+	if r.Failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", r.Failed, len(r.Checks))
+	} else {
+		fmt.Printf("No problems found in %d checks\n", len(r.Checks))
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"fmt"
+
+	"github.com/AlecAivazis/survey/v2"
+	"github.com/choria-io/fisk"
+)
+
+func (c *cliInstance) restoreCommand(_ *fisk.ParseContext) error {
+	_, log, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	log.Warnf("Ensure that the process is stopped prior to restoring")
+
+	if !c.force {
+		var ok bool
+		err = survey.AskOne(&survey.Confirm{
+			Message: fmt.Sprintf("Really restore the %s agent from %s, existing files will be replaced", c.opts.Name, c.restoreFile),
+		}, &ok)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			fmt.Println("Canceling restore operation")
+			return nil
+		}
+	}
+
+	var allowed []string
+	for _, item := range resetItems(c.opts, c.cfgFile) {
+		allowed = append(allowed, item.path)
+	}
+
+	manifest, err := restoreResetArchive(c.restoreFile, allowed)
+	if err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+
+	for _, p := range manifest.Paths {
+		log.Warnf("Restored %s", p)
+	}
+
+	log.Warnf("Restored %s archived at %v", manifest.Scope, manifest.Created)
+
+	return nil
+}
@@ -5,93 +5,43 @@
 package machineroom
 
 import (
-	"context"
-	"fmt"
-	"sync"
+	"errors"
+	"os"
+	"syscall"
 
 	"github.com/choria-io/fisk"
-	"github.com/choria-io/go-choria/build"
-	"github.com/choria-io/go-choria/choria"
-	"github.com/choria-io/go-choria/config"
-	"github.com/nats-io/nats.go"
-	"github.com/sirupsen/logrus"
 )
 
-func (c *cliInstance) runCommand(pc *fisk.ParseContext) error {
+func (c *cliInstance) runCommand(_ *fisk.ParseContext) error {
 	_, _, err := c.CommonConfigure()
 	if err != nil {
 		return err
 	}
 
-	var cfg *config.Config
-
-	if choria.FileExist(c.cfgFile) {
-		cfg, err = config.NewConfig(c.cfgFile)
-		if err != nil {
-			return err
-		}
-
-		c.isLeader = cfg.Option(configKeyRole, "follower") == "leader"
-		c.opts.Identity = cfg.Identity
+	// while an upgrade is verified the new binary is started from here so failures to start are counted
+	if next := upgradeCandidate(c.opts, c.log); next != "" {
+		c.log.Warnf("Starting upgraded binary %s", next)
+		return syscall.Exec(next, append([]string{c.opts.CommandPath}, os.Args[1:]...), os.Environ())
 	}
 
-	c.log = c.log.WithFields(logrus.Fields{"leader": c.isLeader})
-
-	c.log.Warnf("Starting %s version %s with config file %s", c.opts.Name, c.opts.Version, c.cfgFile)
-
-	err = c.createServerNKey()
-	if err != nil {
-		c.log.Errorf("Could not create nkey: %v", err)
-	}
+	agent := newAgent(c.opts, c.cfgFile, c.log)
 
-	// makes sure we have some facts to send during provisioning
-	err = c.factsCommand(pc)
+	err = agent.Start(c.ctx)
 	if err != nil {
-		c.log.Errorf("Could not write initial facts: %v", err)
-	}
-
-	wg := sync.WaitGroup{}
-
-	var inproc nats.InProcessConnProvider
-	if c.isLeader {
-		b, err := newBroker(c.opts, c.cfgFile, &build.Info{}, c.log)
-		if err != nil {
-			return err
-		}
-
-		err = b.Start(c.ctx, &wg)
-		if err != nil {
-			return err
-		}
-
-		inproc = b.InProcessConnProvider()
-
-		err = b.StartReplication(c.ctx, &wg)
-		if err != nil {
-			return err
-		}
-	}
-
-	err = c.startServer(c.ctx, &wg, inproc)
-	if err != nil {
-		return fmt.Errorf("machine room server failed: %v", err)
+		return err
 	}
 
-	wg.Wait()
-
-	return nil
-}
+	<-agent.Done()
 
-func (c *cliInstance) startServer(ctx context.Context, wg *sync.WaitGroup, inproc nats.InProcessConnProvider) error {
-	srv, err := newServer(c.opts, c.cfgFile, inproc, c.log)
-	if err != nil {
-		return err
+	err = agent.Err()
+	if errors.Is(err, ErrRestartRequired) {
+		c.log.Warnf("Restarting %s", c.opts.CommandPath)
+		return syscall.Exec(c.opts.CommandPath, append([]string{c.opts.CommandPath}, os.Args[1:]...), os.Environ())
 	}
-
-	err = srv.Start(ctx, wg)
-	if err != nil {
-		return err
+	if errors.Is(err, ErrDecommissioned) {
+		c.log.Warnf("Node %s has been decommissioned", c.opts.Identity)
+		return nil
 	}
 
-	return nil
+	return err
 }
@@ -0,0 +1,443 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/choria-io/fisk"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/choria-io/go-choria/config"
+	"github.com/choria-io/tokens"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// streams replicated from the site to the backend, used to report replication lag
+var upstreamStreams = []string{"REGISTRATION", "SUBMIT", "CHORIA_EVENTS", "CHORIA_MACHINE", jobResultsStream}
+
+// reportedStream is a site stream and the name of the replication consuming it
+type reportedStream struct {
+	stream      string
+	replication string
+}
+
+// reportedStreams are all the standard and additional streams found on the site broker
+func reportedStreams(opts *Options) []reportedStream {
+	var res []reportedStream
+
+	for _, s := range upstreamStreams {
+		res = append(res, reportedStream{s, s})
+	}
+	res = append(res, reportedStream{"KV_CONFIG", ""}, reportedStream{"OBJ_" + pluginsBucket, ""}, reportedStream{jobsStream, ""})
+
+	for _, s := range opts.AdditionalStreams {
+		rs := reportedStream{stream: s.siteStreamName()}
+		if s.Direction == ReplicateUpstream {
+			rs.replication = s.Name
+		}
+		res = append(res, rs)
+	}
+
+	return res
+}
+
+type statusReport struct {
+	Identity         string             `json:"identity"`
+	Role             string             `json:"role"`
+	Site             string             `json:"site"`
+	Provisioned      bool               `json:"provisioned"`
+	ProvisioningMode bool               `json:"provisioning_mode"`
+	TokenExpires     time.Time          `json:"token_expires,omitzero"`
+	ConnectedServer  string             `json:"connected_server"`
+	LastMessage      time.Time          `json:"last_message,omitzero"`
+	Uptime           time.Duration      `json:"uptime"`
+	StatusUpdated    time.Time          `json:"status_updated,omitzero"`
+	Streams          []streamStatus     `json:"streams"`
+	Machines         []machineStatus    `json:"machines"`
+	PluginSelection  []machineSelection `json:"plugin_selection,omitempty"`
+	DataPolicy       *dataPolicyStatus  `json:"data_policy,omitempty"`
+	Errors           []string           `json:"errors,omitempty"`
+}
+
+type streamStatus struct {
+	Name              string    `json:"name"`
+	Messages          uint64    `json:"messages"`
+	Bytes             uint64    `json:"bytes"`
+	LastTime          time.Time `json:"last_time,omitzero"`
+	Replicated        bool      `json:"replicated"`
+	ReplicationLag    uint64    `json:"replication_lag"`
+	ReplicationUnacks int       `json:"replication_unacknowledged"`
+}
+
+type machineStatus struct {
+	Name    string    `json:"name"`
+	Version string    `json:"version"`
+	State   string    `json:"state"`
+	Updated time.Time `json:"updated"`
+}
+
+// the subset of the Choria Server status file we report on
+type serverStatusFile struct {
+	Identity        string    `json:"identity"`
+	Uptime          int64     `json:"uptime"`
+	ConnectedServer string    `json:"connected_server"`
+	LastMessage     int64     `json:"last_message"`
+	Provisioning    bool      `json:"provisioning_mode"`
+	TokenExpires    time.Time `json:"token_expires"`
+}
+
+// the subset of a machine transition event we report on
+type machineTransitionEvent struct {
+	Data struct {
+		Identity  string `json:"identity"`
+		Machine   string `json:"machine"`
+		Version   string `json:"version"`
+		ToState   string `json:"to_state"`
+		Timestamp int64  `json:"timestamp"`
+	} `json:"data"`
+}
+
+func (c *cliInstance) statusCommand(_ *fisk.ParseContext) error {
+	_, log, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	to, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+
+	report := c.gatherStatus(to, log)
+
+	if c.jsonOutput {
+		j, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+
+		return nil
+	}
+
+	report.render()
+
+	return nil
+}
+
+func (c *cliInstance) gatherStatus(ctx context.Context, log *logrus.Entry) *statusReport {
+	report := &statusReport{
+		Role:        "unknown",
+		Streams:     []streamStatus{},
+		Machines:    []machineStatus{},
+		Provisioned: choria.FileExist(c.opts.ServerJWTFile) && choria.FileExist(c.opts.ServerSeedFile),
+	}
+
+	fail := func(format string, a ...any) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, a...))
+	}
+
+	if choria.FileExist(c.cfgFile) {
+		cfg, err := config.NewConfig(c.cfgFile)
+		if err != nil {
+			fail("could not parse configuration: %v", err)
+		} else {
+			report.Identity = cfg.Identity
+			report.Role = cfg.Option(configKeyRole, "follower")
+			report.Site = cfg.Option(configKeySite, "")
+		}
+	}
+
+	if choria.FileExist(c.opts.ServerJWTFile) {
+		t, err := os.ReadFile(c.opts.ServerJWTFile)
+		if err == nil {
+			var claims *tokens.ServerClaims
+			claims, err = tokens.ParseServerTokenUnverified(string(t))
+			if err == nil && claims.ExpiresAt != nil {
+				report.TokenExpires = claims.ExpiresAt.Time
+			}
+		}
+		if err != nil {
+			fail("could not read server token: %v", err)
+		}
+	}
+
+	selection, err := readMachinesSelection(c.opts)
+	switch {
+	case err != nil:
+		fail("could not read plugin selection: %v", err)
+	case selection != nil && selection.Error != "":
+		fail("plugin selection failed: %s", selection.Error)
+	case selection != nil:
+		report.PluginSelection = selection.Plugins
+	}
+
+	policy, err := readDataPolicyStatus(c.opts)
+	switch {
+	case err != nil:
+		fail("could not read data policy status: %v", err)
+	case policy != nil && policy.Error != "":
+		report.DataPolicy = policy
+		fail("data policy could not be loaded: %s", policy.Error)
+	default:
+		report.DataPolicy = policy
+	}
+
+	if choria.FileExist(c.opts.ServerStatusFile) {
+		err := report.loadServerStatus(c.opts.ServerStatusFile)
+		if err != nil {
+			fail("could not read status file: %v", err)
+		}
+	} else {
+		fail("status file %s does not exist", c.opts.ServerStatusFile)
+	}
+
+	if !report.Provisioned {
+		return report
+	}
+
+	_, nc, err := connectSiteBroker(ctx, c.opts, c.cfgFile, "status", log)
+	if err != nil {
+		fail("%v", err)
+		return report
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		fail("could not access JetStream: %v", err)
+		return report
+	}
+
+	err = report.loadStreams(ctx, js, reportedStreams(c.opts))
+	if err != nil {
+		fail("could not load stream state: %v", err)
+	}
+
+	err = report.loadMachines(ctx, js)
+	if err != nil {
+		fail("could not load machine states: %v", err)
+	}
+
+	return report
+}
+
+func (r *statusReport) loadServerStatus(file string) error {
+	sj, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var status serverStatusFile
+	err = json.Unmarshal(sj, &status)
+	if err != nil {
+		return err
+	}
+
+	nfo, err := os.Stat(file)
+	if err == nil {
+		r.StatusUpdated = nfo.ModTime()
+	}
+
+	if r.Identity == "" {
+		r.Identity = status.Identity
+	}
+	if r.TokenExpires.IsZero() {
+		r.TokenExpires = status.TokenExpires
+	}
+	r.ProvisioningMode = status.Provisioning
+	r.ConnectedServer = status.ConnectedServer
+	r.Uptime = time.Duration(status.Uptime) * time.Second
+	if status.LastMessage > 0 {
+		r.LastMessage = time.Unix(status.LastMessage, 0)
+	}
+
+	return nil
+}
+
+func (r *statusReport) loadStreams(ctx context.Context, js nats.JetStreamContext, streams []reportedStream) error {
+	for _, s := range streams {
+		nfo, err := js.StreamInfo(s.stream, nats.Context(ctx))
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		st := streamStatus{
+			Name:     s.stream,
+			Messages: nfo.State.Msgs,
+			Bytes:    nfo.State.Bytes,
+			LastTime: nfo.State.LastTime,
+		}
+
+		if s.replication == "" {
+			r.Streams = append(r.Streams, st)
+			continue
+		}
+
+		cnfo, err := js.ConsumerInfo(s.stream, fmt.Sprintf("SR_%s", s.replication), nats.Context(ctx))
+		if errors.Is(err, nats.ErrConsumerNotFound) {
+			// with a data policy the replicator consumes the OUTBOUND stream and the policy consumes this one
+			cnfo, err = js.ConsumerInfo(s.stream, dataPolicyConsumer, nats.Context(ctx))
+		}
+		if err == nil {
+			st.Replicated = true
+			st.ReplicationLag = cnfo.NumPending
+			st.ReplicationUnacks = cnfo.NumAckPending
+		}
+
+		r.Streams = append(r.Streams, st)
+	}
+
+	return nil
+}
+
+func (r *statusReport) loadMachines(ctx context.Context, js nats.JetStreamContext) error {
+	nfo, err := js.StreamInfo("CHORIA_MACHINE", nats.Context(ctx))
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if nfo.State.Msgs == 0 {
+		return nil
+	}
+
+	sub, err := js.SubscribeSync("choria.machine.transition", nats.OrderedConsumer(), nats.DeliverAll(), nats.BindStream("CHORIA_MACHINE"))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	states := map[string]machineStatus{}
+
+	for {
+		msg, err := sub.NextMsg(time.Second)
+		if errors.Is(err, nats.ErrTimeout) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var event machineTransitionEvent
+		if json.Unmarshal(msg.Data, &event) == nil && event.Data.Identity == r.Identity && event.Data.Machine != "" {
+			states[event.Data.Machine] = machineStatus{
+				Name:    event.Data.Machine,
+				Version: event.Data.Version,
+				State:   event.Data.ToState,
+				Updated: time.Unix(event.Data.Timestamp, 0),
+			}
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil || meta.NumPending == 0 {
+			break
+		}
+	}
+
+	for _, s := range states {
+		r.Machines = append(r.Machines, s)
+	}
+	sort.Slice(r.Machines, func(i, j int) bool { return r.Machines[i].Name < r.Machines[j].Name })
+
+	return nil
+}
+
+func (r *statusReport) render() {
+	since := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%v (%v ago)", t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+	}
+
+	fmt.Println("Machine Room Agent Status")
+	fmt.Println()
+	fmt.Printf("           Identity: %s\n", r.Identity)
+	fmt.Printf("               Role: %s\n", r.Role)
+	fmt.Printf("               Site: %s\n", r.Site)
+	fmt.Printf("        Provisioned: %t\n", r.Provisioned)
+	fmt.Printf("  Provisioning Mode: %t\n", r.ProvisioningMode)
+	if r.TokenExpires.IsZero() {
+		fmt.Printf("      Token Expires: unknown\n")
+	} else {
+		fmt.Printf("      Token Expires: %v (%v)\n", r.TokenExpires.Format(time.RFC3339), time.Until(r.TokenExpires).Round(time.Second))
+	}
+	fmt.Printf("   Connected Broker: %s\n", r.ConnectedServer)
+	fmt.Printf("       Last Message: %s\n", since(r.LastMessage))
+	fmt.Printf("             Uptime: %v\n", r.Uptime)
+	fmt.Printf("     Status Updated: %s\n", since(r.StatusUpdated))
+
+	if len(r.Streams) > 0 {
+		fmt.Println()
+		fmt.Println("Streams:")
+		fmt.Println()
+		for _, s := range r.Streams {
+			repl := "local only"
+			if s.Replicated {
+				repl = fmt.Sprintf("lag %d unacknowledged %d", s.ReplicationLag, s.ReplicationUnacks)
+			}
+			fmt.Printf("  %20s: %d messages, %d bytes, last message %s, %s\n", s.Name, s.Messages, s.Bytes, since(s.LastTime), repl)
+		}
+	}
+
+	if len(r.Machines) > 0 {
+		fmt.Println()
+		fmt.Println("Autonomous Agents:")
+		fmt.Println()
+		for _, m := range r.Machines {
+			fmt.Printf("  %20s: %s version %s since %s\n", m.Name, m.State, m.Version, since(m.Updated))
+		}
+	}
+
+	if len(r.PluginSelection) > 0 {
+		fmt.Println()
+		fmt.Println("Plugin Selection:")
+		fmt.Println()
+		for _, s := range r.PluginSelection {
+			selected := "skipped"
+			if s.Selected {
+				selected = "selected"
+			}
+			fmt.Printf("  %20s: %s, %s\n", s.Name, selected, s.Reason)
+		}
+	}
+
+	if r.DataPolicy != nil {
+		fmt.Println()
+		fmt.Printf("Data Policy: %s updated %s\n", r.DataPolicy.File, since(r.DataPolicy.Updated))
+		fmt.Println()
+		for _, name := range upstreamStreams {
+			s, ok := r.DataPolicy.Streams[name]
+			if !ok {
+				continue
+			}
+			fmt.Printf("  %20s: %d forwarded, %d modified, %d dropped, %d errors\n", name, s.Forwarded, s.Modified, s.Dropped, s.Errors)
+		}
+		if len(r.DataPolicy.Rules) > 0 {
+			fmt.Println()
+			for _, rule := range r.DataPolicy.Rules {
+				fmt.Printf("  %20s: %s matched %d messages\n", rule.Name, rule.Action, rule.Matched)
+			}
+		}
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Println()
+		fmt.Println("Errors:")
+		fmt.Println()
+		fmt.Printf("  %s\n", strings.Join(r.Errors, "\n  "))
+	}
+}
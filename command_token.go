@@ -0,0 +1,278 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/choria-io/fisk"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/choria-io/machine-room/provisioning"
+	"github.com/choria-io/tokens"
+)
+
+// token purposes as found in the purpose claim
+const (
+	tokenPurposeProvisioning = "choria_provisioning"
+	tokenPurposeServer       = "choria_server"
+)
+
+// tokenInspection describes a provisioning or server token and problems found with it
+type tokenInspection struct {
+	File        string                   `json:"file"`
+	Purpose     string                   `json:"purpose"`
+	Issuer      string                   `json:"issuer,omitempty"`
+	Subject     string                   `json:"subject,omitempty"`
+	Expires     time.Time                `json:"expires,omitzero"`
+	Fingerprint string                   `json:"fingerprint"`
+	Extensions  *provisioning.Extensions `json:"extensions,omitempty"`
+	PublicKey   string                   `json:"public_key,omitempty"`
+	RenewalDue  bool                     `json:"renewal_due,omitempty"`
+	NoExpiry    bool                     `json:"no_expiry,omitempty"`
+	Problems    []string                 `json:"problems,omitempty"`
+}
+
+func (c *cliInstance) tokenIssueCommand(_ *fisk.ParseContext) error {
+	_, pri, err := choria.Ed25519KeyPairFromSeedFile(c.tokenIssuerSeed)
+	if err != nil {
+		return fmt.Errorf("could not load issuer seed: %w", err)
+	}
+
+	token, err := provisioning.IssueToken(&c.tokenRequest, pri)
+	if err != nil {
+		return err
+	}
+
+	if c.tokenFile == "" {
+		fmt.Println(token)
+		return nil
+	}
+
+	err = os.WriteFile(c.tokenFile, []byte(token), 0600)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved provisioning token for customer %s to %s\n", c.tokenRequest.Extensions.Customer, c.tokenFile)
+
+	return nil
+}
+
+func (c *cliInstance) tokenInspectCommand(_ *fisk.ParseContext) error {
+	var files []string
+
+	if c.cfgFile != "" {
+		_, _, err := c.CommonConfigure()
+		if err != nil {
+			return err
+		}
+
+		for _, f := range []string{c.opts.ProvisioningJWTFile, c.opts.ServerJWTFile} {
+			if choria.FileExist(f) {
+				files = append(files, f)
+			}
+		}
+	}
+
+	if c.tokenFile != "" {
+		files = []string{c.tokenFile}
+	}
+
+	if c.cfgFile == "" && c.tokenFile == "" {
+		return fmt.Errorf("a token file or configuration is required")
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no tokens found")
+	}
+
+	var res []*tokenInspection
+	problems := 0
+	for _, f := range files {
+		ti := c.inspectToken(f)
+		problems += len(ti.Problems)
+		res = append(res, ti)
+	}
+
+	if c.jsonOutput {
+		j, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+	} else {
+		for i, ti := range res {
+			if i > 0 {
+				fmt.Println()
+			}
+			ti.render()
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("found %d problems with tokens", problems)
+	}
+
+	return nil
+}
+
+func (c *cliInstance) inspectToken(file string) *tokenInspection {
+	ti := &tokenInspection{File: file}
+
+	fail := func(format string, a ...any) {
+		ti.Problems = append(ti.Problems, fmt.Sprintf(format, a...))
+	}
+
+	token, err := os.ReadFile(file)
+	if err != nil {
+		fail("could not read token: %v", err)
+		return ti
+	}
+	token = bytes.TrimSpace(token)
+
+	ti.Fingerprint = tokenFingerprint(token)
+	ti.Purpose, err = tokenPurpose(string(token))
+	if err != nil {
+		fail("could not decode token: %v", err)
+		return ti
+	}
+
+	var expires *time.Time
+
+	switch ti.Purpose {
+	case tokenPurposeProvisioning:
+		t, err := tokens.ParseProvisionTokenUnverified(string(token))
+		if err != nil {
+			fail("could not parse provisioning token: %v", err)
+			return ti
+		}
+
+		ti.Issuer = t.Issuer
+		ti.Subject = t.Subject
+		if t.ExpiresAt != nil {
+			expires = &t.ExpiresAt.Time
+		}
+
+		ext, err := provisioning.ParseExtensions(t.Extensions)
+		if err != nil {
+			fail("invalid machine room extensions: %v", err)
+		} else {
+			ti.Extensions = &ext
+			if ext.Customer == "" {
+				fail("token has no customer extension")
+			}
+		}
+
+	case tokenPurposeServer:
+		t, err := tokens.ParseServerTokenUnverified(string(token))
+		if err != nil {
+			fail("could not parse server token: %v", err)
+			return ti
+		}
+
+		ti.Issuer = t.Issuer
+		ti.Subject = t.Subject
+		ti.PublicKey = t.PublicKey
+		if t.ExpiresAt != nil {
+			expires = &t.ExpiresAt.Time
+		}
+
+		// the token has to be for the key this node holds, only checked for the configured token
+		if c.opts.ServerSeedFile != "" && file == c.opts.ServerJWTFile && choria.FileExist(c.opts.ServerSeedFile) {
+			pub, _, err := choria.Ed25519KeyPairFromSeedFile(c.opts.ServerSeedFile)
+			switch {
+			case err != nil:
+				fail("could not read seed %s: %v", c.opts.ServerSeedFile, err)
+			case hex.EncodeToString(pub) != t.PublicKey:
+				fail("token public key does not match the seed in %s", c.opts.ServerSeedFile)
+			}
+		}
+
+	default:
+		fail("unsupported token purpose %q", ti.Purpose)
+		return ti
+	}
+
+	switch {
+	case expires == nil:
+		ti.NoExpiry = true
+		fail("token does not expire")
+	case time.Now().After(*expires):
+		ti.Expires = *expires
+		fail("token expired %v ago", time.Since(*expires).Round(time.Second))
+	default:
+		ti.Expires = *expires
+		if ti.Purpose == tokenPurposeServer && c.opts.TokenRenewBefore > 0 && time.Until(*expires) < c.opts.TokenRenewBefore {
+			ti.RenewalDue = true
+			fail("token expires in %v and is due for renewal", time.Until(*expires).Round(time.Second))
+		}
+	}
+
+	return ti
+}
+
+// tokenPurpose reads the purpose claim without verifying the token
+func tokenPurpose(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("not a JWT")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Purpose string `json:"purpose"`
+	}
+	err = json.Unmarshal(body, &claims)
+	if err != nil {
+		return "", err
+	}
+
+	return claims.Purpose, nil
+}
+
+func (t *tokenInspection) render() {
+	fmt.Printf("         Token: %s\n", t.File)
+	fmt.Printf("       Purpose: %s\n", t.Purpose)
+	fmt.Printf("        Issuer: %s\n", t.Issuer)
+	if t.Subject != "" {
+		fmt.Printf("       Subject: %s\n", t.Subject)
+	}
+	if t.Expires.IsZero() {
+		fmt.Printf("       Expires: never\n")
+	} else {
+		fmt.Printf("       Expires: %v (%v)\n", t.Expires.Format(time.RFC3339), time.Until(t.Expires).Round(time.Second))
+	}
+	fmt.Printf("   Fingerprint: %s\n", t.Fingerprint)
+	if t.PublicKey != "" {
+		fmt.Printf("    Public Key: %s\n", t.PublicKey)
+	}
+	if t.Extensions != nil {
+		fmt.Printf("      Customer: %s\n", t.Extensions.Customer)
+		if t.Extensions.Role != "" {
+			fmt.Printf("          Role: %s\n", t.Extensions.Role)
+		}
+		if t.Extensions.Site != "" {
+			fmt.Printf("          Site: %s\n", t.Extensions.Site)
+		}
+	}
+
+	if len(t.Problems) > 0 {
+		fmt.Println()
+		fmt.Println("Problems:")
+		fmt.Println()
+		fmt.Printf("  %s\n", strings.Join(t.Problems, "\n  "))
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"github.com/choria-io/fisk"
+)
+
+func (c *cliInstance) upgradeCommand(_ *fisk.ParseContext) error {
+	_, log, err := c.CommonConfigure()
+	if err != nil {
+		return err
+	}
+
+	if c.opts.DisableUpgrades {
+		log.Warnf("Upgrades are disabled")
+		return nil
+	}
+
+	_, err = upgradeAgent(c.ctx, c.opts, c.cfgFile, log)
+
+	return err
+}
@@ -0,0 +1,401 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/go-choria/config"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// site local bucket holding the CONFIG values resolved for each node
+	resolvedConfigBucket = "NODE_CONFIG"
+
+	// key prefixes in the CONFIG bucket for values that override global ones
+	configLevelNode = "node"
+	configLevelRole = "role"
+	configLevelSite = "site"
+)
+
+// ConfigScope identifies a node for hierarchical CONFIG lookups, values under node.<identity> override
+// role.<role> which override site.<site> which override the global value
+type ConfigScope struct {
+	Identity string
+	Role     string
+	Site     string
+}
+
+func configScope(cfg *config.Config) ConfigScope {
+	return ConfigScope{
+		Identity: cfg.Identity,
+		Role:     cfg.Option(configKeyRole, "follower"),
+		Site:     cfg.Option(configKeySite, ""),
+	}
+}
+
+func (s ConfigScope) prefixes() []string {
+	var prefixes []string
+
+	if s.Identity != "" {
+		prefixes = append(prefixes, configLevelNode+"."+invalidKeyChars.ReplaceAllString(s.Identity, "_")+".")
+	}
+	if s.Role != "" {
+		prefixes = append(prefixes, configLevelRole+"."+invalidKeyChars.ReplaceAllString(s.Role, "_")+".")
+	}
+	if s.Site != "" {
+		prefixes = append(prefixes, configLevelSite+"."+invalidKeyChars.ReplaceAllString(s.Site, "_")+".")
+	}
+
+	return prefixes
+}
+
+// Keys are the keys searched when looking up key, most specific first
+func (s ConfigScope) Keys(key string) []string {
+	var keys []string
+	for _, p := range s.prefixes() {
+		keys = append(keys, p+key)
+	}
+
+	return append(keys, key)
+}
+
+// baseKey is the key a CONFIG key sets for this scope, false when it is an override for another node, role or site
+func (s ConfigScope) baseKey(key string) (string, bool) {
+	for _, p := range s.prefixes() {
+		if strings.HasPrefix(key, p) {
+			return strings.TrimPrefix(key, p), true
+		}
+	}
+
+	for _, level := range []string{configLevelNode, configLevelRole, configLevelSite} {
+		if strings.HasPrefix(key, level+".") {
+			return "", false
+		}
+	}
+
+	return key, true
+}
+
+// ResolvedConfigKey is the key in the site local NODE_CONFIG bucket holding the value of key resolved for identity, kv watchers can use this to see the value that applies to a node
+func ResolvedConfigKey(identity string, key string) string {
+	return configLevelNode + "." + invalidKeyChars.ReplaceAllString(identity, "_") + "." + key
+}
+
+// VerifyResolvedConfig verifies data stored in NODE_CONFIG for key resolved for identity and returns the value it holds,
+// publicKey is the node key reported in the machine_room.server.machines_public_key fact
+func VerifyResolvedConfig(identity string, key string, data []byte, publicKey string) ([]byte, error) {
+	return VerifyConfigValue(ResolvedConfigKey(identity, key), data, publicKey, false)
+}
+
+// LookupConfig finds the most specific value for key in a CONFIG bucket, returns nats.ErrKeyNotFound when no level has a value
+func LookupConfig(kv nats.KeyValue, scope ConfigScope, key string) (nats.KeyValueEntry, error) {
+	for _, k := range scope.Keys(key) {
+		entry, err := kv.Get(k)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return entry, nil
+	}
+
+	return nil, nats.ErrKeyNotFound
+}
+
+// LookupConfig finds the value of key in the site CONFIG bucket that applies to this node, see ConfigScope, signed values are verified using VerifyConfigValue
+func (a *Agent) LookupConfig(ctx context.Context, key string) ([]byte, error) {
+	_, nc, err := connectSiteBroker(ctx, a.opts, a.cfgFile, "config_lookup", a.log)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return nil, fmt.Errorf("could not access CONFIG bucket: %w", err)
+	}
+
+	return lookupVerifiedConfig(ctx, a.opts, a.cfgFile, kv, a.configScope(), key, a.log)
+}
+
+func (a *Agent) configScope() ConfigScope {
+	return ConfigScope{Identity: a.opts.Identity, Role: a.opts.Role, Site: a.opts.Site}
+}
+
+// resolveConfig keeps the verified values that apply to this node in the NODE_CONFIG bucket up to date
+func (a *Agent) resolveConfig(ctx context.Context) {
+	backoff.Default.For(ctx, func(try int) error {
+		err := a.resolveConfigLoop(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.log.Errorf("Resolving CONFIG values failed: %v", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (a *Agent) resolveConfigLoop(ctx context.Context) error {
+	_, nc, err := connectSiteBroker(ctx, a.opts, a.cfgFile, "config_resolver", a.log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	cfg, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return fmt.Errorf("could not access CONFIG bucket: %w", err)
+	}
+
+	resolved, err := js.KeyValue(resolvedConfigBucket)
+	if err != nil {
+		return fmt.Errorf("could not access %s bucket: %w", resolvedConfigBucket, err)
+	}
+
+	// any site client can write NODE_CONFIG so values are signed using the node key like the MACHINES selection
+	key, err := machinesSigningKey(a.opts)
+	if err != nil {
+		return fmt.Errorf("could not load node signing key: %w", err)
+	}
+	pubKey := hex.EncodeToString(key.Public().(ed25519.PublicKey))
+
+	scope := a.configScope()
+	prefix := ResolvedConfigKey(a.opts.Identity, "")
+
+	// what is currently stored for this node so stale values are removed after a restart, the watch stays open to
+	// restore values other clients change after that
+	nodeWatch, err := resolved.Watch(prefix+">", nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer nodeWatch.Stop()
+
+	current := map[string][]byte{}
+	var invalid []string
+	err = initialValues(ctx, nodeWatch, func(entry nats.KeyValueEntry) {
+		if entry.Operation() != nats.KeyValuePut {
+			return
+		}
+
+		base := strings.TrimPrefix(entry.Key(), prefix)
+		value, err := VerifyResolvedConfig(a.opts.Identity, base, entry.Value(), pubKey)
+		if err != nil {
+			invalid = append(invalid, base)
+			return
+		}
+
+		current[base] = value
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, base := range invalid {
+		a.log.Warnf("Removing resolved CONFIG key %s that was not signed by this node", base)
+		err = resolved.Delete(prefix + base)
+		if err != nil {
+			return err
+		}
+	}
+
+	// restore puts back the value this node resolved for base when another client changed or removed it
+	restore := func(entry nats.KeyValueEntry) error {
+		base := strings.TrimPrefix(entry.Key(), prefix)
+		last, stored := current[base]
+
+		if entry.Operation() != nats.KeyValuePut {
+			if !stored {
+				return nil
+			}
+
+			a.log.Warnf("Restoring resolved CONFIG key %s that was removed by another client", base)
+		} else {
+			value, err := VerifyResolvedConfig(a.opts.Identity, base, entry.Value(), pubKey)
+			switch {
+			case err == nil && stored && bytes.Equal(value, last):
+				return nil
+			case !stored:
+				a.log.Warnf("Removing resolved CONFIG key %s that was not written by this node", base)
+				return resolved.Delete(prefix + base)
+			default:
+				a.log.Warnf("Restoring resolved CONFIG key %s that was changed by another client", base)
+			}
+		}
+
+		signed, err := SignConfigValue(prefix+base, last, key)
+		if err != nil {
+			return err
+		}
+
+		_, err = resolved.Put(prefix+base, signed)
+		return err
+	}
+
+	watch, err := cfg.WatchAll(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer watch.Stop()
+
+	entries := map[string]nats.KeyValueEntry{}
+	initial := true
+
+	update := func(base string) error {
+		var value []byte
+		var entry nats.KeyValueEntry
+		found := false
+		for _, k := range scope.Keys(base) {
+			entry, found = entries[k]
+			if found {
+				break
+			}
+		}
+
+		if found {
+			var err error
+			value, err = verifyConfigEntry(ctx, a.opts, a.cfgFile, entry.Key(), entry.Value(), entry.Revision(), a.log)
+			if err != nil {
+				// the last verified value is kept
+				return nil
+			}
+		}
+
+		last, stored := current[base]
+
+		switch {
+		case !found && stored:
+			a.log.Debugf("Removing resolved CONFIG key %s", base)
+			delete(current, base)
+			return resolved.Delete(prefix + base)
+
+		case found && (!stored || !bytes.Equal(last, value)):
+			a.log.Debugf("Updating resolved CONFIG key %s", base)
+			signed, err := SignConfigValue(prefix+base, value, key)
+			if err != nil {
+				return err
+			}
+
+			current[base] = value
+			_, err = resolved.Put(prefix+base, signed)
+			return err
+		}
+
+		return nil
+	}
+
+	for {
+		select {
+		case entry, ok := <-watch.Updates():
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("watch closed")
+			}
+
+			if entry == nil {
+				initial = false
+
+				bases := map[string]struct{}{}
+				for k := range current {
+					bases[k] = struct{}{}
+				}
+				for k := range entries {
+					base, ok := scope.baseKey(k)
+					if ok {
+						bases[base] = struct{}{}
+					}
+				}
+
+				for base := range bases {
+					err = update(base)
+					if err != nil {
+						return err
+					}
+				}
+
+				continue
+			}
+
+			base, ok := scope.baseKey(entry.Key())
+			if !ok {
+				continue
+			}
+
+			if entry.Operation() == nats.KeyValuePut {
+				entries[entry.Key()] = entry
+			} else {
+				delete(entries, entry.Key())
+			}
+
+			if !initial {
+				err = update(base)
+				if err != nil {
+					return err
+				}
+			}
+
+		case entry, ok := <-nodeWatch.Updates():
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("watch closed")
+			}
+			if entry == nil {
+				continue
+			}
+
+			err = restore(entry)
+			if err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// initialValues calls cb for every value the watch holds and returns once all were seen, the watch stays open
+func initialValues(ctx context.Context, watch nats.KeyWatcher, cb func(nats.KeyValueEntry)) error {
+	for {
+		select {
+		case entry, ok := <-watch.Updates():
+			if !ok {
+				return errors.New("watch closed")
+			}
+			if entry == nil {
+				return nil
+			}
+
+			cb(entry)
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// event kind published when a CONFIG value is rejected
+const eventConfigRejected = "config_rejected"
+
+// SignedConfigValue is a CONFIG value signed by the backend using the key matching MachineSigningKey
+type SignedConfigValue struct {
+	// Value is the value consumers receive once the signature is verified
+	Value []byte `json:"value"`
+	// Signed is when the value was signed, values signed before the last value a node accepted for the key are rejected
+	Signed time.Time `json:"signed"`
+	// Signature is the hex encoded ed25519 signature made by SignConfigValue
+	Signature string `json:"signature"`
+}
+
+// configRejectedEvent is the data of config_rejected events
+type configRejectedEvent struct {
+	Identity string `json:"identity"`
+	Key      string `json:"key"`
+	Revision uint64 `json:"revision"`
+	Error    string `json:"error"`
+}
+
+// rejected values are only reported once per revision by each node, several agents can run in one process
+var rejectedConfig = struct {
+	sync.Mutex
+	seen map[[2]string]uint64
+}{seen: map[[2]string]uint64{}}
+
+// serializes updates to the accepted CONFIG versions file
+var acceptedConfigMu sync.Mutex
+
+// SignConfigValue creates a signed value to store in CONFIG, key is the key as seen by the site after ConfigBucketPrefix is removed
+func SignConfigValue(key string, value []byte, pk ed25519.PrivateKey) ([]byte, error) {
+	signed := time.Now().UTC()
+
+	return json.Marshal(&SignedConfigValue{
+		Value:     value,
+		Signed:    signed,
+		Signature: hex.EncodeToString(ed25519.Sign(pk, configSignedContent(key, signed, value))),
+	})
+}
+
+// signing the key and time with the value prevents a signed value being copied to another key or replacing a newer value
+func configSignedContent(key string, signed time.Time, value []byte) []byte {
+	return append([]byte(fmt.Sprintf("%s\n%d\n", key, signed.UnixNano())), value...)
+}
+
+// parseSignedConfigValue parses data as a SignedConfigValue, false when it is not one
+func parseSignedConfigValue(data []byte) (*SignedConfigValue, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var signed SignedConfigValue
+	err := dec.Decode(&signed)
+	if err != nil || signed.Signature == "" {
+		return nil, false
+	}
+
+	return &signed, true
+}
+
+// VerifyConfigValue verifies data stored in key against signingKey and returns the value it holds, unsigned data is
+// returned unchanged when allowUnsigned is set while signed data with an invalid signature is always rejected
+func VerifyConfigValue(key string, data []byte, signingKey string, allowUnsigned bool) ([]byte, error) {
+	signed, err := verifySignedConfigValue(key, data, signingKey, allowUnsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	return signed.Value, nil
+}
+
+// verifySignedConfigValue verifies data like VerifyConfigValue, allowed unsigned data is returned without a signing time
+func verifySignedConfigValue(key string, data []byte, signingKey string, allowUnsigned bool) (*SignedConfigValue, error) {
+	signed, ok := parseSignedConfigValue(data)
+	if !ok {
+		if !allowUnsigned {
+			return nil, fmt.Errorf("%w: %s", ErrUnsignedConfig, key)
+		}
+
+		return &SignedConfigValue{Value: data}, nil
+	}
+
+	pk, err := hex.DecodeString(signingKey)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing key")
+	}
+
+	sig, err := hex.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfigSignature, key, err)
+	}
+
+	if signed.Signed.IsZero() || !ed25519.Verify(pk, configSignedContent(key, signed.Signed, signed.Value), sig) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidConfigSignature, key)
+	}
+
+	return signed, nil
+}
+
+// lookupVerifiedConfig finds the value for key that applies to scope and verifies it, rejected values are reported using an event
+func lookupVerifiedConfig(ctx context.Context, opts *Options, configFile string, kv nats.KeyValue, scope ConfigScope, key string, log *logrus.Entry) ([]byte, error) {
+	entry, err := LookupConfig(kv, scope, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyConfigEntry(ctx, opts, configFile, entry.Key(), entry.Value(), entry.Revision(), log)
+}
+
+func verifyConfigEntry(ctx context.Context, opts *Options, configFile string, key string, data []byte, revision uint64, log *logrus.Entry) ([]byte, error) {
+	signed, err := verifySignedConfigValue(key, data, opts.MachineSigningKey, opts.AllowUnsignedConfig)
+	if err == nil && !signed.Signed.IsZero() {
+		err = acceptConfigVersion(opts, key, signed.Signed)
+	}
+	if err != nil {
+		rejectConfig(ctx, opts, configFile, key, revision, err, log)
+		return nil, err
+	}
+
+	return signed.Value, nil
+}
+
+func configVersionsFile(opts *Options) string {
+	return filepath.Join(opts.ConfigurationDirectory, defaultConfigVersionsFile)
+}
+
+// acceptConfigVersion records when the accepted value of key was signed, values signed before the last accepted one are
+// rejected so an old value can not be put back to roll a node back
+func acceptConfigVersion(opts *Options, key string, signed time.Time) error {
+	acceptedConfigMu.Lock()
+	defer acceptedConfigMu.Unlock()
+
+	versions := map[string]time.Time{}
+	if FileExist(configVersionsFile(opts)) {
+		vj, err := os.ReadFile(configVersionsFile(opts))
+		if err != nil {
+			return fmt.Errorf("could not read accepted CONFIG versions: %w", err)
+		}
+
+		err = json.Unmarshal(vj, &versions)
+		if err != nil {
+			return fmt.Errorf("could not parse accepted CONFIG versions: %w", err)
+		}
+	}
+
+	last := versions[key]
+	switch {
+	case signed.Before(last):
+		return fmt.Errorf("%w: %s signed at %v is older than the accepted value signed at %v", ErrStaleConfig, key, signed.UTC(), last.UTC())
+	case signed.Equal(last):
+		return nil
+	}
+
+	versions[key] = signed
+	vj, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(configVersionsFile(opts), vj, 0600)
+	if err != nil {
+		return fmt.Errorf("could not save accepted CONFIG versions: %w", err)
+	}
+
+	return nil
+}
+
+// rejectConfig logs and publishes an event for a rejected value once per revision
+func rejectConfig(ctx context.Context, opts *Options, configFile string, key string, revision uint64, rerr error, log *logrus.Entry) {
+	rejectedConfig.Lock()
+	last, seen := rejectedConfig.seen[[2]string{opts.Identity, key}]
+	rejectedConfig.seen[[2]string{opts.Identity, key}] = revision
+	rejectedConfig.Unlock()
+
+	if seen && last == revision {
+		return
+	}
+
+	log.Errorf("Rejecting CONFIG key %s revision %d: %v", key, revision, rerr)
+
+	evt := configRejectedEvent{Identity: opts.Identity, Key: key, Revision: revision, Error: rerr.Error()}
+
+	var err error
+	backoff.Default.For(ctx, func(try int) error {
+		if try > 5 {
+			return nil
+		}
+
+		err = publishEventOnce(ctx, opts, configFile, eventConfigRejected, evt, log)
+		return err
+	})
+	if err != nil {
+		log.Errorf("Could not publish config rejected event: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/choria-io/go-choria/choria"
+	"github.com/choria-io/go-choria/config"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// connectSiteBroker connects to the site broker using the provisioned credentials, intended for
+// commands that run alongside the agent and need access to the local JetStream
+func connectSiteBroker(ctx context.Context, opts *Options, configFile string, name string, log *logrus.Entry) (*config.Config, *nats.Conn, error) {
+	if !choria.FileExist(configFile) {
+		return nil, nil, fmt.Errorf("configuration file %s does not exist", configFile)
+	}
+
+	cfg, err := config.NewSystemConfig(configFile, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse configuration: %v", err)
+	}
+
+	cfg.CustomLogger = log.Logger
+	cfg.Choria.UseSRVRecords = false
+	cfg.Choria.SecurityProvider = "choria"
+	cfg.Choria.ChoriaSecurityTokenFile = opts.ServerJWTFile
+	cfg.Choria.ChoriaSecuritySeedFile = opts.ServerSeedFile
+
+	fw, err := choria.NewWithConfig(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := fw.NewConnector(ctx, fw.MiddlewareServers, name, log)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect to site broker: %v", err)
+	}
+
+	return cfg, conn.Nats(), nil
+}
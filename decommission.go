@@ -0,0 +1,202 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// CONFIG key, only honored as node.<identity>.decommission, that retires a node
+	decommissionKey = "decommission"
+
+	// event kind published before a node removes itself
+	eventDecommissioned = "decommissioned"
+)
+
+// decommissionRequest is the optional JSON value of the decommission marker
+type decommissionRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+type decommissionedEvent struct {
+	Identity string `json:"identity"`
+	Reason   string `json:"reason,omitempty"`
+	Revision uint64 `json:"revision"`
+}
+
+// decommissionConfigKey is the CONFIG key holding the marker for this node, the marker is never looked up
+// hierarchically so a role or site wide value can not retire every node
+func (a *Agent) decommissionConfigKey() string {
+	return ConfigScope{Identity: a.opts.Identity}.Keys(decommissionKey)[0]
+}
+
+// watchDecommission stops the agent with ErrDecommissioned once the backend sets the decommission marker for this node
+func (a *Agent) watchDecommission(ctx context.Context) {
+	backoff.Default.For(ctx, func(try int) error {
+		err := a.watchDecommissionMarker(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.log.Errorf("Watching for decommission requests failed: %v", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (a *Agent) watchDecommissionMarker(ctx context.Context) error {
+	_, nc, err := connectSiteBroker(ctx, a.opts, a.cfgFile, "decommission", a.log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	kv, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return fmt.Errorf("could not access CONFIG bucket: %w", err)
+	}
+
+	watch, err := kv.Watch(a.decommissionConfigKey(), nats.IgnoreDeletes(), nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer watch.Stop()
+
+	for {
+		select {
+		case entry, ok := <-watch.Updates():
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("watch closed")
+			}
+
+			if entry == nil {
+				continue
+			}
+
+			// the marker removes the node so it has to be signed even when unsigned values are allowed
+			signed, ok := parseSignedConfigValue(entry.Value())
+			if !ok {
+				rejectConfig(ctx, a.opts, a.cfgFile, entry.Key(), entry.Revision(), fmt.Errorf("%w: %s", ErrUnsignedConfig, entry.Key()), a.log)
+				continue
+			}
+
+			value, err := verifyConfigEntry(ctx, a.opts, a.cfgFile, entry.Key(), entry.Value(), entry.Revision(), a.log)
+			if err != nil {
+				continue
+			}
+
+			// a marker left behind from before the identity was provisioned again does not apply to this enrollment
+			provisioned, err := provisionedTime(a.opts)
+			if err != nil {
+				a.log.Errorf("Could not read provisioning time, ignoring decommission request: %v", err)
+				continue
+			}
+			if signed.Signed.Before(provisioned) {
+				a.log.Warnf("Ignoring decommission request in CONFIG revision %d signed at %v before the node was provisioned at %v", entry.Revision(), signed.Signed.UTC(), provisioned.UTC())
+				continue
+			}
+
+			// the leader holds the site data, it is retired by provisioning another leader and resetting it
+			if a.isLeader {
+				rejectConfig(ctx, a.opts, a.cfgFile, entry.Key(), entry.Revision(), errors.New("leaders can not be decommissioned remotely"), a.log)
+				continue
+			}
+
+			var req decommissionRequest
+			if len(value) > 0 && json.Unmarshal(value, &req) != nil {
+				req.Reason = string(value)
+			}
+
+			a.decommission(ctx, js, &decommissionedEvent{Identity: a.opts.Identity, Reason: req.Reason, Revision: entry.Revision()})
+
+			return nil
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// decommission announces the node is leaving, removes its registration data and stops the agent, the files are
+// removed once the server and machines stopped
+func (a *Agent) decommission(ctx context.Context, js nats.JetStreamContext, evt *decommissionedEvent) {
+	a.log.Warnf("Decommissioning node %s following CONFIG revision %d: %s", evt.Identity, evt.Revision, evt.Reason)
+
+	var err error
+	backoff.Default.For(ctx, func(try int) error {
+		if try > 5 {
+			return nil
+		}
+
+		err = publishEventOnce(ctx, a.opts, a.cfgFile, eventDecommissioned, evt, a.log)
+		return err
+	})
+	if err != nil {
+		a.log.Errorf("Could not publish decommissioned event: %v", err)
+	}
+
+	subject := fmt.Sprintf("machine_room.nodes.%s", a.opts.Identity)
+	purges := map[string]string{
+		"REGISTRATION": subject,
+		outboundStream: outboundSubject("REGISTRATION") + subject,
+	}
+
+	for stream, subj := range purges {
+		err = js.PurgeStream(stream, &nats.StreamPurgeRequest{Subject: subj})
+		switch {
+		case errors.Is(err, nats.ErrStreamNotFound):
+		case err != nil:
+			a.log.Errorf("Could not purge %s from %s: %v", subj, stream, err)
+		default:
+			a.log.Warnf("Purged %s from %s", subj, stream)
+		}
+	}
+
+	a.decommOnce.Do(func() {
+		a.mu.Lock()
+		if a.err == nil {
+			a.err = ErrDecommissioned
+		}
+		cancel := a.cancel
+		a.mu.Unlock()
+
+		if cancel != nil {
+			cancel()
+		}
+	})
+}
+
+// removeDecommissioned removes all files the agent created, including the provisioning token so the node does not enroll again
+func (a *Agent) removeDecommissioned() {
+	a.log.Warnf("Removing the data of decommissioned node %s", a.opts.Identity)
+
+	err := resetAgent(a.opts, a.cfgFile, resetAll, false, a.log)
+	if err != nil {
+		a.log.Errorf("Could not reset the agent: %v", err)
+	}
+
+	if a.opts.ProvisioningJWTFile != "" && FileExist(a.opts.ProvisioningJWTFile) {
+		a.log.Warnf("Removing provisioning token %s", a.opts.ProvisioningJWTFile)
+		err = os.Remove(a.opts.ProvisioningJWTFile)
+		if err != nil {
+			a.log.Errorf("Could not remove %s: %v", a.opts.ProvisioningJWTFile, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRestartRequired indicates that the agent stopped so that an upgraded or restored binary, or a renewed broker
+// certificate, can be loaded
+var ErrRestartRequired = errors.New("restart required")
+
+// ErrDecommissioned indicates that the agent stopped and removed its data after the backend decommissioned the node
+var ErrDecommissioned = errors.New("node decommissioned")
+
+// ErrUnsignedConfig indicates that a CONFIG value was not signed while unsigned values are not allowed
+var ErrUnsignedConfig = errors.New("unsigned CONFIG value")
+
+// ErrStaleConfig indicates that a CONFIG value was signed before the value previously accepted for the same key
+var ErrStaleConfig = errors.New("stale CONFIG value")
+
+// ErrInvalidConfigSignature indicates that a signed CONFIG value failed verification
+var ErrInvalidConfigSignature = errors.New("invalid CONFIG value signature")
+
+// BrokerError indicates that the site broker could not be started
+type BrokerError struct {
+	Err error
+}
+
+func (e *BrokerError) Error() string { return fmt.Sprintf("broker failed: %v", e.Err) }
+func (e *BrokerError) Unwrap() error { return e.Err }
+
+// ServerError indicates that the machine room server could not be started or failed while running
+type ServerError struct {
+	Err error
+}
+
+func (e *ServerError) Error() string { return fmt.Sprintf("machine room server failed: %v", e.Err) }
+func (e *ServerError) Unwrap() error { return e.Err }
+
+// ReplicationError indicates that data replication with the backend could not be started
+type ReplicationError struct {
+	Err error
+}
+
+func (e *ReplicationError) Error() string { return fmt.Sprintf("replication failed: %v", e.Err) }
+func (e *ReplicationError) Unwrap() error { return e.Err }
@@ -0,0 +1,71 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/sirupsen/logrus"
+)
+
+// machine room events are published into the lifecycle event space so they are
+// stored in CHORIA_EVENTS and replicated to the backend with other lifecycle events
+const eventSubjectPrefix = "choria.lifecycle.event.machine_room"
+
+// event is a cloudevents formatted machine room event
+type event struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            any       `json:"data"`
+}
+
+func newEvent(opts *Options, kind string, data any) *event {
+	return &event{
+		SpecVersion:     "1.0",
+		ID:              nuid.Next(),
+		Source:          fmt.Sprintf("io.choria.machine_room.%s", opts.Name),
+		Type:            fmt.Sprintf("io.choria.machine_room.v1.%s", kind),
+		Subject:         opts.Identity,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+}
+
+// publishEvent publishes a machine room event of a specific kind using nc
+func publishEvent(nc *nats.Conn, opts *Options, kind string, data any) error {
+	j, err := json.Marshal(newEvent(opts, kind, data))
+	if err != nil {
+		return err
+	}
+
+	err = nc.Publish(fmt.Sprintf("%s.%s", eventSubjectPrefix, kind), j)
+	if err != nil {
+		return err
+	}
+
+	return nc.Flush()
+}
+
+// publishEventOnce connects to the site broker, publishes an event and disconnects
+func publishEventOnce(ctx context.Context, opts *Options, configFile string, kind string, data any, log *logrus.Entry) error {
+	_, nc, err := connectSiteBroker(ctx, opts, configFile, fmt.Sprintf("event_%s", kind), log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	return publishEvent(nc, opts, kind, data)
+}
@@ -29,6 +29,9 @@ func main() {
 		// too noisy
 		NoCPUFacts: true,
 
+		// the example stores CONFIG values using the nats CLI without signing them
+		AllowUnsignedConfig: true,
+
 		// Users can plug in custom facts in addition to standard facts
 		AdditionalFacts: extraFacts,
 	})
@@ -46,6 +46,7 @@ choria jwt prov /configuration/customer/app3/provisioning.jwt /configuration/iss
 
 log "Setting up SaaS NATS"
 cp /setup/templates/saas-nats/* /configuration/saas-nats/
+cp /setup/agents/echo-0.0.1.tgz /configuration/saas-nats/
 
 log "Setting up RedPanda Connect"
 cp /setup/templates/nodes_processor/nodes.yaml /configuration/redpanda/
\ No newline at end of file
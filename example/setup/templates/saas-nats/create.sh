@@ -25,4 +25,8 @@ NATS_USER="cust_one_admin"
 NATS_PASSWORD="s3cret"
 
 nats kv add CONFIG
+nats kv add CHORIA_LEADER_ELECTION --ttl 10s
+nats obj add PLUGINS
+nats obj put PLUGINS /machine-room/echo-0.0.1.tgz --name echo-0.0.1.tgz --force
+nats stream add JOBS --subjects 'machine_room.jobs.>' --storage file --retention limits --max-age 1d --defaults
 nats kv put CONFIG machines "$(cat /machine-room/plugins.json)"
\ No newline at end of file
@@ -0,0 +1,354 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/choria-io/go-choria/choria"
+	"github.com/ghodss/yaml"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	externalFactsTypeFile    = "file"
+	externalFactsTypeCommand = "command"
+
+	// longest stderr included in errors from commands
+	externalFactsMaxStderr = 512
+
+	// how long to wait for output to be closed after a command timed out, processes it started might keep it open
+	externalFactsWaitDelay = time.Second
+)
+
+// externalFactsSettings is read from .settings.yaml in the external facts directory
+type externalFactsSettings struct {
+	// Defaults apply to all sources
+	Defaults externalFactsSourceSettings `json:"defaults"`
+	// Sources override the defaults for a source by file name
+	Sources map[string]externalFactsSourceSettings `json:"sources"`
+}
+
+type externalFactsSourceSettings struct {
+	// Timeout is how long commands may run, defaults to 10s
+	Timeout string `json:"timeout"`
+	// Interval is how long results are cached, by default sources are gathered every time facts are
+	Interval string `json:"interval"`
+}
+
+// externalFactsSource is the outcome of gathering a source, published with the facts
+type externalFactsSource struct {
+	Type     string    `json:"type"`
+	Gathered time.Time `json:"gathered,omitzero"`
+	Duration string    `json:"duration,omitempty"`
+	Cached   bool      `json:"cached,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// externalFactsCache is stored in the storage directory for sources with an interval
+type externalFactsCache struct {
+	Modified time.Time      `json:"modified"`
+	Gathered time.Time      `json:"gathered"`
+	Duration time.Duration  `json:"duration"`
+	Facts    map[string]any `json:"facts,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func externalFactsCacheDirectory(opts Options) string {
+	return filepath.Join(opts.ServerStorageDirectory, defaultExternalFactsDirectory)
+}
+
+func readExternalFactsSettings(opts Options) (*externalFactsSettings, error) {
+	settings := &externalFactsSettings{}
+
+	sf := filepath.Join(opts.ExternalFactsDirectory, defaultExternalFactsSettingsFile)
+	if !choria.FileExist(sf) {
+		return settings, nil
+	}
+
+	sb, err := os.ReadFile(sf)
+	if err != nil {
+		return settings, err
+	}
+
+	err = yaml.Unmarshal(sb, settings)
+	if err != nil {
+		return settings, fmt.Errorf("invalid %s: %w", defaultExternalFactsSettingsFile, err)
+	}
+
+	return settings, nil
+}
+
+// sourceSettings resolves the timeout and interval for a source
+func (s *externalFactsSettings) sourceSettings(name string) (timeout time.Duration, interval time.Duration, err error) {
+	parse := func(def string, override string, fallback time.Duration) (time.Duration, error) {
+		v := def
+		if override != "" {
+			v = override
+		}
+		if v == "" {
+			return fallback, nil
+		}
+
+		return time.ParseDuration(v)
+	}
+
+	src := s.Sources[name]
+
+	timeout, err = parse(s.Defaults.Timeout, src.Timeout, defaultExternalFactsTimeout)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid timeout: %w", err)
+	}
+
+	interval, err = parse(s.Defaults.Interval, src.Interval, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid interval: %w", err)
+	}
+
+	return timeout, interval, nil
+}
+
+// externalFacts gathers facts from the files and commands in the external facts directory, facts from each source
+// are stored under the file name without its extension along with a report of each source
+func externalFacts(ctx context.Context, opts Options, log *logrus.Entry) map[string]any {
+	facts := map[string]any{}
+	sources := map[string]*externalFactsSource{}
+	result := map[string]any{
+		"facts":   facts,
+		"sources": sources,
+	}
+
+	entries, err := os.ReadDir(opts.ExternalFactsDirectory)
+	if errors.Is(err, os.ErrNotExist) {
+		return result
+	}
+	if err != nil {
+		result["error"] = err.Error()
+		return result
+	}
+
+	settings, err := readExternalFactsSettings(opts)
+	if err != nil {
+		log.Errorf("Could not read external facts settings: %v", err)
+		result["error"] = err.Error()
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		src := &externalFactsSource{}
+		ext := filepath.Ext(name)
+
+		switch {
+		case info.Mode().Perm()&0111 != 0:
+			src.Type = externalFactsTypeCommand
+		case ext == ".json" || ext == ".yaml" || ext == ".yml":
+			src.Type = externalFactsTypeFile
+		default:
+			continue
+		}
+
+		sources[name] = src
+
+		key := strings.TrimSuffix(name, ext)
+		if _, ok := facts[key]; ok {
+			src.Error = fmt.Sprintf("facts for %s were already gathered from another source", key)
+			continue
+		}
+
+		timeout, interval, err := settings.sourceSettings(name)
+		if err != nil {
+			src.Error = err.Error()
+			continue
+		}
+
+		if src.Type == externalFactsTypeCommand {
+			err = checkExternalFactsCommand(info)
+			if err != nil {
+				log.Warnf("Not running external facts command %s: %v", name, err)
+				src.Error = err.Error()
+				continue
+			}
+		}
+
+		data, err := gatherExternalFactsSource(ctx, opts, filepath.Join(opts.ExternalFactsDirectory, name), info.ModTime(), src, timeout, interval, log)
+		if err != nil {
+			log.Warnf("Could not gather external facts from %s: %v", name, err)
+			src.Error = err.Error()
+			continue
+		}
+
+		facts[key], err = redactAdditionalFacts(opts, data)
+		if err != nil {
+			log.Warnf("Could not redact external facts from %s: %v", name, err)
+			src.Error = err.Error()
+			delete(facts, key)
+		}
+	}
+
+	return result
+}
+
+// gatherExternalFactsSource gathers a single source using the cache when it is still valid
+func gatherExternalFactsSource(ctx context.Context, opts Options, path string, modified time.Time, src *externalFactsSource, timeout time.Duration, interval time.Duration, log *logrus.Entry) (map[string]any, error) {
+	cacheFile := filepath.Join(externalFactsCacheDirectory(opts), filepath.Base(path)+".json")
+
+	if interval > 0 {
+		cache, err := readExternalFactsCache(cacheFile)
+		if err == nil && cache.Modified.Equal(modified) && time.Since(cache.Gathered) < interval {
+			src.Cached = true
+			src.Gathered = cache.Gathered
+			src.Duration = cache.Duration.String()
+			if cache.Error != "" {
+				return nil, errors.New(cache.Error)
+			}
+
+			return cache.Facts, nil
+		}
+	}
+
+	start := time.Now()
+
+	var data map[string]any
+	var err error
+
+	switch src.Type {
+	case externalFactsTypeCommand:
+		data, err = runExternalFactsCommand(ctx, path, timeout)
+	default:
+		data, err = readExternalFactsFile(path)
+	}
+
+	src.Gathered = start.UTC()
+	src.Duration = time.Since(start).String()
+
+	if interval > 0 {
+		cache := &externalFactsCache{Modified: modified, Gathered: src.Gathered, Duration: time.Since(start), Facts: data}
+		if err != nil {
+			cache.Error = err.Error()
+		}
+
+		cerr := writeExternalFactsCache(cacheFile, cache)
+		if cerr != nil {
+			log.Warnf("Could not cache external facts from %s: %v", path, cerr)
+		}
+	}
+
+	return data, err
+}
+
+func readExternalFactsFile(path string) (map[string]any, error) {
+	fb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseExternalFacts(fb)
+}
+
+// checkExternalFactsCommand ensures only the agent user can change commands it runs
+func checkExternalFactsCommand(info os.FileInfo) error {
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("writable by group or others")
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("owned by uid %d instead of %d", stat.Uid, os.Getuid())
+	}
+
+	return nil
+}
+
+func runExternalFactsCommand(ctx context.Context, path string, timeout time.Duration) (map[string]any, error) {
+	to, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(to, path)
+	cmd.Dir = filepath.Dir(path)
+	cmd.WaitDelay = externalFactsWaitDelay
+
+	out, err := cmd.Output()
+	if to.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timeout after %v", timeout)
+	}
+	if err != nil {
+		var eerr *exec.ExitError
+		if errors.As(err, &eerr) && len(eerr.Stderr) > 0 {
+			stderr := strings.TrimSpace(string(eerr.Stderr))
+			if len(stderr) > externalFactsMaxStderr {
+				stderr = stderr[:externalFactsMaxStderr]
+			}
+			return nil, fmt.Errorf("%v: %s", err, stderr)
+		}
+
+		return nil, err
+	}
+
+	return parseExternalFacts(out)
+}
+
+// parseExternalFacts parses JSON or YAML, the result has to be an object
+func parseExternalFacts(data []byte) (map[string]any, error) {
+	var facts map[string]any
+	err := yaml.Unmarshal(data, &facts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid facts: %w", err)
+	}
+	if facts == nil {
+		facts = map[string]any{}
+	}
+
+	return facts, nil
+}
+
+func readExternalFactsCache(path string) (*externalFactsCache, error) {
+	cb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cache externalFactsCache
+	err = json.Unmarshal(cb, &cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cache, nil
+}
+
+func writeExternalFactsCache(path string, cache *externalFactsCache) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	cb, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, cb, 0600)
+}
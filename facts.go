@@ -45,38 +45,96 @@ func additionalFacts(ctx context.Context, opts Options, data map[string]any, log
 		return
 	}
 
-	data["additional_facts"] = extra
+	redacted, err := redactAdditionalFacts(opts, extra)
+	if err != nil {
+		log.Errorf("Could not redact additional facts: %v", err)
+		return
+	}
+
+	data["additional_facts"] = redacted
+}
+
+// provisioningTokenSummary summarises the provisioning token, nil when there is no token
+func provisioningTokenSummary(opts Options) (*tokenSummary, error) {
+	if !choria.FileExist(opts.ProvisioningJWTFile) {
+		return nil, nil
+	}
+
+	token, err := os.ReadFile(opts.ProvisioningJWTFile)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := tokens.ParseProvisionTokenUnverified(string(token))
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &tokenSummary{
+		Issuer:      t.Issuer,
+		Subject:     t.Subject,
+		Fingerprint: tokenFingerprint(token),
+		Extensions:  t.Extensions,
+	}
+	if t.ExpiresAt != nil {
+		summary.Expires = t.ExpiresAt.Time
+		summary.Expired = time.Now().After(summary.Expires)
+	}
+
+	return summary, nil
+}
+
+// serverTokenSummary summarises the server token, nil when there is no token
+func serverTokenSummary(opts Options) (*tokenSummary, error) {
+	if !choria.FileExist(opts.ServerJWTFile) {
+		return nil, nil
+	}
+
+	token, err := os.ReadFile(opts.ServerJWTFile)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := tokens.ParseServerTokenUnverified(string(token))
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &tokenSummary{
+		Issuer:      t.Issuer,
+		Subject:     t.Subject,
+		Fingerprint: tokenFingerprint(token),
+	}
+	if t.ExpiresAt != nil {
+		summary.Expires = t.ExpiresAt.Time
+		summary.Expired = time.Now().After(summary.Expires)
+	}
+
+	return summary, nil
 }
 
 func machineRoomFactProvider(opts Options, log *logrus.Entry) model.FactProvider {
 	return func(ctx context.Context, _ model.FactsConfig, _ model.Logger) (map[string]any, error) {
-		var err error
-
 		fdata := map[string]any{}
 
+		provSummary, err := provisioningTokenSummary(opts)
+		if err != nil {
+			log.Warnf("Could not read provisioning token: %v", err)
+		}
+
 		ext := tokens.MapClaims{}
-		var provToken []byte
-		if choria.FileExist(opts.ProvisioningJWTFile) {
-			provToken, err = os.ReadFile(opts.ProvisioningJWTFile)
-			if err == nil {
-				t, err := tokens.ParseProvisionTokenUnverified(string(provToken))
-				if err == nil {
-					ext = t.Extensions
-				}
-			}
+		if provSummary != nil && provSummary.Extensions != nil {
+			ext = provSummary.Extensions
+		}
+
+		serverSummary, err := serverTokenSummary(opts)
+		if err != nil {
+			log.Warnf("Could not read server token: %v", err)
 		}
 
-		token := []byte{}
 		pubKey := []byte{}
 		pubNKey := ""
 
-		if choria.FileExist(opts.ServerJWTFile) {
-			token, err = os.ReadFile(opts.ServerJWTFile)
-			if err != nil {
-				log.Warnf("Could not read server token: %v", err)
-			}
-		}
-
 		if choria.FileExist(opts.ServerSeedFile) {
 			pubKey, _, err = choria.Ed25519KeyPairFromSeedFile(opts.ServerSeedFile)
 			if err != nil {
@@ -84,6 +142,11 @@ func machineRoomFactProvider(opts Options, log *logrus.Entry) model.FactProvider
 			}
 		}
 
+		machinesPubKey, err := machinesPublicKey(&opts)
+		if err != nil {
+			log.Warnf("Could not read node signing key: %v", err)
+		}
+
 		if choria.FileExist(opts.NatsNkeySeedFile) {
 			pubNKey, err = loadNkeyPublic(opts)
 			if err != nil {
@@ -96,21 +159,41 @@ func machineRoomFactProvider(opts Options, log *logrus.Entry) model.FactProvider
 			"timestamp":         time.Now(),
 			"timestamp_seconds": time.Now().Unix(),
 			"server": map[string]any{
-				"token":       string(token),
+				"token":       serverSummary,
 				"public_key":  hex.EncodeToString(pubKey),
 				"public_nkey": pubNKey,
+				// verifies values in the NODE_CONFIG bucket
+				"machines_public_key": machinesPubKey,
+			},
+			"options": opts.factsSafe(),
+			// node specific settings used by the autonomous agents shared by every agent in the process
+			"autonomous_agents": map[string]any{
+				"config_file":  opts.ConfigFile,
+				"machines_key": machinesKey(opts.Identity),
+				"upgrade_key":  ResolvedConfigKey(opts.Identity, upgradeSpecKey),
 			},
-			"options": opts,
 			"provisioning": map[string]any{
 				"extended_claims": ext,
-				"token":           string(provToken),
+				"token":           provSummary,
 			},
 		}
 
+		selection, err := readMachinesSelection(&opts)
+		if err != nil {
+			log.Warnf("Could not read plugin selection: %v", err)
+		}
+		if selection != nil {
+			f["plugins"] = selection
+		}
+
 		if opts.AdditionalFacts != nil {
 			additionalFacts(ctx, opts, f, log)
 		}
 
+		if !opts.NoExternalFacts {
+			f["external_facts"] = externalFacts(ctx, opts, log)
+		}
+
 		fdata["machine_room"] = f
 
 		return fdata, nil
@@ -11,8 +11,10 @@ require (
 	github.com/choria-io/tokens v0.0.4-0.20260330095821-b91f2ad57ea0
 	github.com/ghodss/yaml v1.0.0
 	github.com/nats-io/jwt/v2 v2.8.1
+	github.com/nats-io/nats-server/v2 v2.12.6
 	github.com/nats-io/nats.go v1.50.0
 	github.com/nats-io/nkeys v0.4.15
+	github.com/nats-io/nuid v1.0.1
 	github.com/sirupsen/logrus v1.9.4
 )
 
@@ -104,10 +106,8 @@ require (
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/nats-io/jsm.go v0.3.1-0.20260331092434-ff068e4ccf92 // indirect
-	github.com/nats-io/nats-server/v2 v2.12.6 // indirect
 	github.com/nats-io/natscli v0.3.2-0.20260331092833-b29c7cc69e61 // indirect
 	github.com/nats-io/nsc/v2 v2.12.0 // indirect
-	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/nsf/termbox-go v1.1.1 // indirect
 	github.com/oleiade/reflections v1.1.0 // indirect
 	github.com/onsi/ginkgo/v2 v2.28.1 // indirect
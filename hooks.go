@@ -0,0 +1,429 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/nats-io/nats.go"
+)
+
+// LifecycleHooks are optional callbacks invoked as the agent moves through its life cycle, they are
+// called synchronously from the goroutine that detected the change and should return quickly
+type LifecycleHooks struct {
+	// ProvisioningStarted is called when an unprovisioned node enters provisioning mode
+	ProvisioningStarted func(ctx context.Context, event ProvisioningEvent)
+	// ProvisioningCompleted is called once a node that was provisioning becomes ready
+	ProvisioningCompleted func(ctx context.Context, event ProvisioningEvent)
+	// Reprovision is called when a node that was previously provisioned enters provisioning mode, for example after its configuration was changed to request it
+	Reprovision func(ctx context.Context, event ProvisioningEvent)
+	// BrokerStarted is called on the leader once the site broker is running
+	BrokerStarted func(ctx context.Context, event BrokerStartedEvent)
+	// ReplicationConnected is called on the leader whenever the backend used for replication can be reached
+	ReplicationConnected func(ctx context.Context, event ReplicationEvent)
+	// ReplicationDisconnected is called on the leader whenever the connection to the backend used for replication is lost
+	ReplicationDisconnected func(ctx context.Context, event ReplicationEvent)
+	// ConfigChanged is called for every change to the site CONFIG bucket including deletes
+	ConfigChanged func(ctx context.Context, event ConfigChangedEvent)
+	// ShutdownStarted is called once when the agent starts shutting down, before any component is stopped
+	ShutdownStarted func(ctx context.Context, event ShutdownEvent)
+}
+
+// ProvisioningEvent is passed to the provisioning related hooks
+type ProvisioningEvent struct {
+	// Identity is the identity of the node
+	Identity string
+	// Reason describes why the node is provisioning
+	Reason string
+	// Started is when provisioning started
+	Started time.Time
+	// Completed is when provisioning completed, zero until it does
+	Completed time.Time
+}
+
+// BrokerStartedEvent is passed to the BrokerStarted hook
+type BrokerStartedEvent struct {
+	// Identity is the identity of the leader
+	Identity string
+	// Site is the site the broker serves
+	Site string
+	// ClientPort is the port clients connect to
+	ClientPort int
+	// Time is when the broker started
+	Time time.Time
+}
+
+// ReplicationEvent is passed to the replication connection hooks
+type ReplicationEvent struct {
+	// Site is the site being replicated
+	Site string
+	// Backend is the URL of the backend with any credentials removed
+	Backend string
+	// Error is the reason for a disconnection, when known
+	Error error
+	// Time is when the change was detected
+	Time time.Time
+}
+
+// ConfigChangedEvent is passed to the ConfigChanged hook
+type ConfigChangedEvent struct {
+	// Key is the key that changed
+	Key string
+	// Value is the new value, nil when the key was deleted
+	Value []byte
+	// Revision is the bucket revision of the change
+	Revision uint64
+	// Deleted indicates the key was deleted or purged
+	Deleted bool
+	// Time is when the change was stored
+	Time time.Time
+}
+
+// ShutdownEvent is passed to the ShutdownStarted hook
+type ShutdownEvent struct {
+	// Identity is the identity of the node
+	Identity string
+	// Err is the failure that caused the shutdown, nil for a normal stop
+	Err error
+	// Time is when the shutdown started
+	Time time.Time
+}
+
+// provisioningState is stored on disk while a node is provisioning, provisioning completes after a restart so this is how we know to report it
+type provisioningState struct {
+	Reason      string    `json:"reason"`
+	Reprovision bool      `json:"reprovision"`
+	Started     time.Time `json:"started"`
+}
+
+// provisionedState is kept on disk once provisioning completed, it records when the current enrollment started
+type provisionedState struct {
+	Provisioned time.Time `json:"provisioned"`
+}
+
+func provisioningStateFile(opts *Options) string {
+	return filepath.Join(opts.ConfigurationDirectory, defaultProvisioningStateFile)
+}
+
+func provisionedStateFile(opts *Options) string {
+	return filepath.Join(opts.ConfigurationDirectory, defaultProvisionedStateFile)
+}
+
+// provisionedTime is when the node started provisioning its current enrollment, zero when not known
+func provisionedTime(opts *Options) (time.Time, error) {
+	if !choria.FileExist(provisionedStateFile(opts)) {
+		return time.Time{}, nil
+	}
+
+	sj, err := os.ReadFile(provisionedStateFile(opts))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var state provisionedState
+	err = json.Unmarshal(sj, &state)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return state.Provisioned, nil
+}
+
+// provisioningStarted records the start of provisioning and calls the relevant hook, a restart while provisioning does not call it again
+func (a *Agent) provisioningStarted(ctx context.Context) {
+	if choria.FileExist(provisioningStateFile(a.opts)) {
+		return
+	}
+
+	state := provisioningState{
+		Reason:  "not provisioned",
+		Started: time.Now().UTC(),
+	}
+
+	if choria.FileExist(a.opts.ServerJWTFile) {
+		state.Reason = "configuration requested provisioning"
+		state.Reprovision = true
+	}
+
+	sj, err := json.Marshal(state)
+	if err != nil {
+		a.log.Errorf("Could not record provisioning state: %v", err)
+		return
+	}
+
+	err = writeFileAtomic(provisioningStateFile(a.opts), sj, 0600)
+	if err != nil {
+		a.log.Errorf("Could not record provisioning state: %v", err)
+	}
+
+	evt := ProvisioningEvent{Identity: a.opts.Identity, Reason: state.Reason, Started: state.Started}
+
+	if state.Reprovision {
+		if a.opts.Hooks.Reprovision != nil {
+			a.opts.Hooks.Reprovision(ctx, evt)
+		}
+		return
+	}
+
+	if a.opts.Hooks.ProvisioningStarted != nil {
+		a.opts.Hooks.ProvisioningStarted(ctx, evt)
+	}
+}
+
+// provisioningCompleted calls the relevant hook when the node became ready after provisioning
+func (a *Agent) provisioningCompleted(ctx context.Context) {
+	sf := provisioningStateFile(a.opts)
+	if !choria.FileExist(sf) {
+		return
+	}
+
+	evt := ProvisioningEvent{Identity: a.opts.Identity, Completed: time.Now().UTC()}
+
+	sj, err := os.ReadFile(sf)
+	if err == nil {
+		var state provisioningState
+		err = json.Unmarshal(sj, &state)
+		if err == nil {
+			evt.Reason = state.Reason
+			evt.Started = state.Started
+		}
+	}
+	if err != nil {
+		a.log.Errorf("Could not read provisioning state: %v", err)
+	}
+
+	provisioned := provisionedState{Provisioned: evt.Started}
+	if provisioned.Provisioned.IsZero() {
+		provisioned.Provisioned = evt.Completed
+	}
+
+	pj, err := json.Marshal(provisioned)
+	if err == nil {
+		err = writeFileAtomic(provisionedStateFile(a.opts), pj, 0600)
+	}
+	if err != nil {
+		a.log.Errorf("Could not record provisioning time: %v", err)
+	}
+
+	err = os.Remove(sf)
+	if err != nil {
+		a.log.Errorf("Could not remove provisioning state: %v", err)
+	}
+
+	a.log.Warnf("Provisioning completed")
+
+	if a.opts.Hooks.ProvisioningCompleted != nil {
+		a.opts.Hooks.ProvisioningCompleted(ctx, evt)
+	}
+}
+
+// shutdownStarted calls the ShutdownStarted hook once
+func (a *Agent) shutdownStarted(ctx context.Context, err error) {
+	a.shutdownOnce.Do(func() {
+		if a.opts.Hooks.ShutdownStarted != nil {
+			a.opts.Hooks.ShutdownStarted(ctx, ShutdownEvent{Identity: a.opts.Identity, Err: err, Time: time.Now().UTC()})
+		}
+	})
+}
+
+// watchConfig calls the ConfigChanged hook for every change in the site CONFIG bucket
+func (a *Agent) watchConfig(ctx context.Context) {
+	if a.opts.Hooks.ConfigChanged == nil {
+		return
+	}
+
+	backoff.Default.For(ctx, func(try int) error {
+		err := a.watchConfigChanges(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.log.Errorf("Watching the CONFIG bucket failed: %v", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (a *Agent) watchConfigChanges(ctx context.Context) error {
+	_, nc, err := connectSiteBroker(ctx, a.opts, a.cfgFile, "config_hooks", a.log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	kv, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return fmt.Errorf("could not access CONFIG bucket: %w", err)
+	}
+
+	// existing values are delivered first and compared to the revisions seen by previous watches so restarting the
+	// watch does not lose changes or report values that did not change
+	watch, err := kv.WatchAll(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer watch.Stop()
+
+	primed := a.configRevisions != nil
+	if !primed {
+		a.configRevisions = map[string]uint64{}
+	}
+	initial := true
+
+	for {
+		select {
+		case entry, ok := <-watch.Updates():
+			if !ok {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return errors.New("watch closed")
+			}
+
+			// nil marks the end of the initial values, the first watch only records them while later watches report
+			// what changed while they were not watching
+			if entry == nil {
+				initial = false
+				primed = true
+				continue
+			}
+
+			changed := primed && a.configRevisions[entry.Key()] != entry.Revision()
+			a.configRevisions[entry.Key()] = entry.Revision()
+			if initial && !changed {
+				continue
+			}
+
+			evt := ConfigChangedEvent{
+				Key:      entry.Key(),
+				Revision: entry.Revision(),
+				Time:     entry.Created(),
+				Deleted:  entry.Operation() != nats.KeyValuePut,
+			}
+			if !evt.Deleted {
+				evt.Value = entry.Value()
+			}
+
+			a.opts.Hooks.ConfigChanged(ctx, evt)
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// monitorReplication tracks a connection to the replication backend and calls the replication hooks as it connects and disconnects,
+// the replicator does not expose its connection state so this connects the same way it does, see backendNatsOptions
+func (b *broker) monitorReplication(ctx context.Context, backendUrl string, site string) {
+	if b.opts.Hooks.ReplicationConnected == nil && b.opts.Hooks.ReplicationDisconnected == nil {
+		return
+	}
+
+	servers, backend, copts, err := backendNatsOptions(backendUrl)
+	if err != nil {
+		b.log.Errorf("Could not monitor the replication backend: %v", err)
+		return
+	}
+
+	event := func(err error) ReplicationEvent {
+		return ReplicationEvent{Site: site, Backend: backend, Error: err, Time: time.Now().UTC()}
+	}
+
+	connected := func(_ *nats.Conn) {
+		if b.opts.Hooks.ReplicationConnected != nil {
+			b.opts.Hooks.ReplicationConnected(ctx, event(nil))
+		}
+	}
+
+	copts = append(copts,
+		nats.Name(fmt.Sprintf("machine_room_monitor_%s", site)),
+		nats.MaxReconnects(-1),
+		nats.RetryOnFailedConnect(true),
+		nats.ConnectHandler(connected),
+		nats.ReconnectHandler(connected),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if ctx.Err() != nil {
+				return
+			}
+			if b.opts.Hooks.ReplicationDisconnected != nil {
+				b.opts.Hooks.ReplicationDisconnected(ctx, event(err))
+			}
+		}),
+	)
+
+	nc, err := nats.Connect(servers, copts...)
+	if err != nil {
+		b.log.Errorf("Could not monitor the replication backend: %v", err)
+		return
+	}
+
+	<-ctx.Done()
+	nc.Close()
+}
+
+// backendNatsOptions are the servers and connection options the stream replicator uses for backendUrl, it reads
+// credentials and TLS settings from the query of each URL and connects to the URLs without them, redacted is the list
+// of servers without user names and passwords
+func backendNatsOptions(backendUrl string) (servers string, redacted string, opts []nats.Option, err error) {
+	var urls []string
+	var safe []string
+	hasCreds := false
+
+	for _, s := range strings.Split(backendUrl, ",") {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		if !hasCreds && u.RawQuery != "" {
+			query, err := url.ParseQuery(u.RawQuery)
+			if err != nil {
+				return "", "", nil, err
+			}
+
+			if query.Has("credentials") {
+				opts = append(opts, nats.UserCredentials(query.Get("credentials")))
+				hasCreds = true
+			}
+
+			if query.Has("jwt") && query.Has("nkey") {
+				opts = append(opts, nats.UserCredentials(query.Get("jwt"), query.Get("nkey")))
+				hasCreds = true
+			}
+
+			if insecure, _ := strconv.ParseBool(query.Get("insecure")); insecure {
+				opts = append(opts, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+			}
+
+			if timeout, err := time.ParseDuration(query.Get("connect_timeout")); err == nil {
+				opts = append(opts, nats.Timeout(timeout))
+			}
+		}
+
+		u.RawQuery = ""
+		urls = append(urls, u.String())
+
+		u.User = nil
+		safe = append(safe, u.String())
+	}
+
+	return strings.Join(urls, ","), strings.Join(safe, ","), opts, nil
+}
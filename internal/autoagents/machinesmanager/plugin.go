@@ -8,7 +8,8 @@ import (
 	_ "embed"
 
 	"github.com/choria-io/go-choria/aagent/machine"
-	"github.com/choria-io/go-choria/aagent/plugin"
+	mp "github.com/choria-io/go-choria/aagent/plugin"
+	"github.com/choria-io/go-choria/plugin"
 	"github.com/ghodss/yaml"
 )
 
@@ -17,12 +18,21 @@ var (
 	mdat []byte
 )
 
-func ChoriaPlugin() *plugin.MachinePlugin {
+// Register registers the plugins manager reading the plugins selected for the node from key in bucket, key is a
+// template resolved by each server so the registration can be shared by every agent in a process
+func Register(bucket string, key string) error {
 	m := &machine.Machine{}
 	err := yaml.Unmarshal(mdat, m)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	return plugin.NewMachinePlugin("plugins_manager", m)
+	for _, w := range m.WatcherDefs {
+		if w.Type == "kv" {
+			w.Properties["bucket"] = bucket
+			w.Properties["key"] = key
+		}
+	}
+
+	return plugin.Register("machine_plugins_manager", mp.NewMachinePlugin("plugins_manager", m))
 }
@@ -0,0 +1,84 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package upgrade
+
+import (
+	"fmt"
+
+	"github.com/choria-io/go-choria/aagent/machine"
+	mp "github.com/choria-io/go-choria/aagent/plugin"
+	"github.com/choria-io/go-choria/aagent/watchers"
+	"github.com/choria-io/go-choria/plugin"
+)
+
+// Register registers a machine that runs the upgrade command whenever the desired version in key of bucket changes,
+// the watched value is only a trigger as the command verifies the specification in CONFIG before upgrading
+func Register(cmdPath string, version string, cfgFile string, bucket string, key string) error {
+	if cmdPath == "" {
+		return fmt.Errorf("no command path set in options")
+	}
+
+	m := &machine.Machine{
+		MachineName:    "machine_room_upgrade",
+		MachineVersion: version,
+		InitialState:   "WATCH",
+		Transitions: []*machine.Transition{
+			{
+				Name:        "upgrade",
+				From:        []string{"WATCH"},
+				Destination: "UPGRADE",
+			},
+			{
+				Name:        "upgraded",
+				From:        []string{"UPGRADE"},
+				Destination: "WATCH",
+			},
+			{
+				Name:        "upgrade_failed",
+				From:        []string{"UPGRADE"},
+				Destination: "WATCH",
+			},
+			{
+				Name:        "MAINTENANCE",
+				From:        []string{"WATCH", "UPGRADE"},
+				Destination: "MAINTENANCE",
+			},
+			{
+				Name:        "RESUME",
+				From:        []string{"MAINTENANCE"},
+				Destination: "WATCH",
+			},
+		},
+		WatcherDefs: []*watchers.WatcherDef{
+			{
+				Name:              "desired_version",
+				Type:              "kv",
+				Interval:          "1m",
+				StateMatch:        []string{"WATCH"},
+				SuccessTransition: "upgrade",
+				Properties: map[string]any{
+					"bucket":        bucket,
+					"key":           key,
+					"mode":          "poll",
+					"bucket_prefix": false,
+				},
+			},
+			{
+				Name:              "upgrade",
+				Type:              "exec",
+				Interval:          "1h",
+				StateMatch:        []string{"UPGRADE"},
+				SuccessTransition: "upgraded",
+				FailTransition:    "upgrade_failed",
+				Properties: map[string]any{
+					"command": fmt.Sprintf("%s upgrade --config %s", cmdPath, cfgFile),
+					"timeout": "15m",
+				},
+			},
+		},
+	}
+
+	return plugin.Register("machine_room_upgrade", mp.NewMachinePlugin("machine_room_upgrade", m))
+}
@@ -0,0 +1,253 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package targeting selects nodes based on their identity and facts
+package targeting
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RolePath is the fact holding the role a node was provisioned with
+const RolePath = "machine_room.provisioning.extended_claims.role"
+
+// Selector selects nodes, all the criteria that are set has to match
+type Selector struct {
+	// Identities matches node identities, an entry like /regex/ is a regular expression, others are exact matches, any entry matching selects the node
+	Identities []string `json:"identities,omitempty"`
+	// Roles matches the role the node was provisioned with, any entry matching selects the node
+	Roles []string `json:"roles,omitempty"`
+	// Facts are filters like host.info.platform=ubuntu, all have to match, see ParseFactFilter for the format
+	Facts []string `json:"facts,omitempty"`
+}
+
+// Empty determines if the selector has no criteria and so matches every node
+func (s *Selector) Empty() bool {
+	return s == nil || len(s.Identities) == 0 && len(s.Roles) == 0 && len(s.Facts) == 0
+}
+
+// Validate checks that all the criteria are valid
+func (s *Selector) Validate() error {
+	if s == nil {
+		return nil
+	}
+
+	for _, i := range s.Identities {
+		_, err := identityMatcher(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range s.Facts {
+		_, err := ParseFactFilter(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Match determines if a node with identity and facts is selected, the reason explains the outcome
+func (s *Selector) Match(identity string, facts map[string]any) (bool, string, error) {
+	if s.Empty() {
+		return true, "no selection criteria", nil
+	}
+
+	if len(s.Identities) > 0 {
+		matched := false
+		for _, i := range s.Identities {
+			m, err := identityMatcher(i)
+			if err != nil {
+				return false, "", err
+			}
+			if m(identity) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false, fmt.Sprintf("identity %s did not match %s", identity, strings.Join(s.Identities, ", ")), nil
+		}
+	}
+
+	if len(s.Roles) > 0 {
+		role, _ := Lookup(facts, RolePath)
+		rs := fmt.Sprint(role)
+
+		matched := false
+		for _, r := range s.Roles {
+			if r == rs {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false, fmt.Sprintf("role %s did not match %s", rs, strings.Join(s.Roles, ", ")), nil
+		}
+	}
+
+	for _, f := range s.Facts {
+		filter, err := ParseFactFilter(f)
+		if err != nil {
+			return false, "", err
+		}
+
+		if !filter.Match(facts) {
+			return false, fmt.Sprintf("fact filter %s did not match", f), nil
+		}
+	}
+
+	return true, "all selection criteria matched", nil
+}
+
+func identityMatcher(m string) (func(string) bool, error) {
+	if len(m) > 2 && strings.HasPrefix(m, "/") && strings.HasSuffix(m, "/") {
+		re, err := regexp.Compile(m[1 : len(m)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity filter %s: %w", m, err)
+		}
+
+		return re.MatchString, nil
+	}
+
+	return func(i string) bool { return i == m }, nil
+}
+
+// FactFilter matches a single fact
+type FactFilter struct {
+	Path     string
+	Operator string
+	Value    string
+
+	re *regexp.Regexp
+}
+
+var factFilterOperators = []string{"!=", "=~", ">=", "<=", "==", "=", ">", "<"}
+
+// ParseFactFilter parses filters like path=value where the path is a dot separated lookup into the facts.
+//
+// Supported operators are =, ==, !=, =~ (regular expression), <, <=, > and >=, a filter that is only a
+// path matches when the fact exists and is not false, empty or zero.
+func ParseFactFilter(f string) (*FactFilter, error) {
+	f = strings.TrimSpace(f)
+	if f == "" {
+		return nil, fmt.Errorf("empty fact filter")
+	}
+
+	filter := &FactFilter{Path: f}
+
+	pos := -1
+	for _, op := range factFilterOperators {
+		idx := strings.Index(f, op)
+		if idx > 0 && (pos == -1 || idx < pos || idx == pos && len(op) > len(filter.Operator)) {
+			pos = idx
+			filter.Operator = op
+		}
+	}
+
+	if pos > 0 {
+		filter.Path = strings.TrimSpace(f[:pos])
+		filter.Value = strings.TrimSpace(f[pos+len(filter.Operator):])
+	}
+
+	if filter.Operator == "==" {
+		filter.Operator = "="
+	}
+
+	if filter.Operator == "=~" {
+		var err error
+		filter.re, err = regexp.Compile(filter.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fact filter %s: %w", f, err)
+		}
+	}
+
+	return filter, nil
+}
+
+// Match determines if the facts match the filter
+func (f *FactFilter) Match(facts map[string]any) bool {
+	val, ok := Lookup(facts, f.Path)
+	if !ok {
+		return f.Operator == "!="
+	}
+
+	switch f.Operator {
+	case "":
+		return truthy(val)
+	case "=":
+		return fmt.Sprint(val) == f.Value
+	case "!=":
+		return fmt.Sprint(val) != f.Value
+	case "=~":
+		return f.re.MatchString(fmt.Sprint(val))
+	}
+
+	have, err := strconv.ParseFloat(fmt.Sprint(val), 64)
+	if err != nil {
+		return false
+	}
+	want, err := strconv.ParseFloat(f.Value, 64)
+	if err != nil {
+		return false
+	}
+
+	switch f.Operator {
+	case "<":
+		return have < want
+	case "<=":
+		return have <= want
+	case ">":
+		return have > want
+	case ">=":
+		return have >= want
+	}
+
+	return false
+}
+
+// Lookup finds a value using a dot separated path like host.info.platform
+func Lookup(data map[string]any, path string) (any, bool) {
+	var cur any = data
+
+	for _, p := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[p]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+func truthy(v any) bool {
+	switch val := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return val
+	case string:
+		return val != ""
+	case float64:
+		return val != 0
+	case []any:
+		return len(val) > 0
+	case map[string]any:
+		return len(val) > 0
+	default:
+		return true
+	}
+}
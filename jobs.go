@@ -0,0 +1,511 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/machine-room/internal/targeting"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	jobsStream              = "JOBS"
+	jobsSubjectPrefix       = "machine_room.jobs."
+	jobResultsStream        = "JOB_RESULTS"
+	jobResultsSubjectPrefix = "machine_room.job_results."
+	defaultJobTimeout       = time.Minute
+	maxJobTimeout           = time.Hour
+	maxJobOutput            = 64 * 1024
+	defaultJobsMaxAge       = 24 * time.Hour
+	defaultJobsFetchTTL     = time.Minute
+	defaultJobValidity      = time.Hour
+	maxJobValidity          = defaultJobsMaxAge
+
+	// how long to wait for output to be closed after a job was killed, processes it started might keep it open
+	jobWaitDelay = time.Second
+)
+
+// statuses reported in JobResult
+const (
+	JobSuccess  = "success"
+	JobFailed   = "failed"
+	JobTimeout  = "timeout"
+	JobRejected = "rejected"
+)
+
+var (
+	validJobID        = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+	invalidTokenChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+	// serializes updates to the seen jobs file
+	seenJobsMu sync.Mutex
+)
+
+// Selector selects nodes based on their identity, role and facts
+type Selector = targeting.Selector
+
+// JobRequest is a command the backend requests nodes in a site to run
+type JobRequest struct {
+	// ID is a unique id for the job, may only contain letters, digits, _ and -
+	ID string `json:"id"`
+	// Site is the site the job is for, nodes in other sites reject it
+	Site string `json:"site"`
+	// Command is the command to run
+	Command string `json:"command"`
+	// Args are arguments passed to the command
+	Args []string `json:"args,omitempty"`
+	// Environment are additional environment variables in KEY=VALUE format
+	Environment []string `json:"environment,omitempty"`
+	// Directory is the working directory for the command
+	Directory string `json:"directory,omitempty"`
+	// Timeout is the maximum run time like 10m, defaults to 1 minute and cannot exceed 1 hour
+	Timeout string `json:"timeout,omitempty"`
+	// Target selects the nodes that will run the job, all nodes when empty
+	Target Selector `json:"target"`
+	// Created is the time the job was created
+	Created time.Time `json:"created"`
+	// NotAfter is the time after which nodes will not run the job, avoids running stale jobs after outages, defaults to
+	// an hour after Created and can not be more than 24 hours after it
+	NotAfter time.Time `json:"not_after"`
+}
+
+// SignedJobRequest is a JobRequest signed using the private key matching Options.MachineSigningKey
+type SignedJobRequest struct {
+	// Request is the JSON encoded JobRequest
+	Request []byte `json:"request"`
+	// Signature is the hex encoded ed25519 signature of Request
+	Signature string `json:"signature"`
+}
+
+// JobResult is the outcome of running a job on a node
+type JobResult struct {
+	ID       string        `json:"id"`
+	Identity string        `json:"identity"`
+	Status   string        `json:"status"`
+	ExitCode int           `json:"exit_code"`
+	Stdout   string        `json:"stdout,omitempty"`
+	Stderr   string        `json:"stderr,omitempty"`
+	Started  time.Time     `json:"started,omitzero"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// JobSubject is the subject to publish signed jobs to on the backend
+func JobSubject(id string) string {
+	return jobsSubjectPrefix + id
+}
+
+// SignJobRequest signs a job, the result can be published to JobSubject()
+func SignJobRequest(job *JobRequest, key ed25519.PrivateKey) ([]byte, error) {
+	err := job.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if job.Created.IsZero() {
+		job.Created = time.Now().UTC()
+	}
+	if job.NotAfter.IsZero() {
+		job.NotAfter = job.Created.Add(defaultJobValidity)
+	}
+
+	err = job.validateValidity()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&SignedJobRequest{
+		Request:   req,
+		Signature: hex.EncodeToString(ed25519.Sign(key, req)),
+	})
+}
+
+// Validate checks that the job is valid
+func (j *JobRequest) Validate() error {
+	if !validJobID.MatchString(j.ID) {
+		return fmt.Errorf("invalid job id %q", j.ID)
+	}
+
+	if j.Site == "" {
+		return fmt.Errorf("site is required")
+	}
+
+	if j.Command == "" {
+		return fmt.Errorf("command is required")
+	}
+
+	_, err := j.timeout()
+	if err != nil {
+		return err
+	}
+
+	return j.Target.Validate()
+}
+
+// validateValidity checks that the job can only be run for a limited time, jobs seen by a node are remembered for this long
+func (j *JobRequest) validateValidity() error {
+	switch {
+	case j.Created.IsZero():
+		return fmt.Errorf("created time is required")
+	case j.NotAfter.IsZero():
+		return fmt.Errorf("not after time is required")
+	case !j.NotAfter.After(j.Created):
+		return fmt.Errorf("not after time must be after the created time")
+	case j.NotAfter.Sub(j.Created) > maxJobValidity:
+		return fmt.Errorf("jobs can not be valid for more than %v", maxJobValidity)
+	}
+
+	return nil
+}
+
+func (j *JobRequest) timeout() (time.Duration, error) {
+	if j.Timeout == "" {
+		return defaultJobTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(j.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %w", err)
+	}
+	if timeout <= 0 || timeout > maxJobTimeout {
+		return 0, fmt.Errorf("timeout must be between 0 and %v", maxJobTimeout)
+	}
+
+	return timeout, nil
+}
+
+// verifyJobRequest verifies the signature and validity of a signed job
+func verifyJobRequest(data []byte, signingKey string) (*JobRequest, error) {
+	var signed SignedJobRequest
+	err := json.Unmarshal(data, &signed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signed job: %w", err)
+	}
+
+	pk, err := hex.DecodeString(signingKey)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing key")
+	}
+
+	sig, err := hex.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	if !ed25519.Verify(pk, signed.Request, sig) {
+		return nil, fmt.Errorf("signature verification failed")
+	}
+
+	var job JobRequest
+	err = json.Unmarshal(signed.Request, &job)
+	if err != nil {
+		return nil, fmt.Errorf("invalid job: %w", err)
+	}
+
+	err = job.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	err = job.validateValidity()
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func seenJobsFile(opts *Options) string {
+	return filepath.Join(opts.ServerStorageDirectory, defaultSeenJobsFile)
+}
+
+// markJobSeen records that the job was received until it expires, false when it was seen before
+func markJobSeen(opts *Options, job *JobRequest) (bool, error) {
+	seenJobsMu.Lock()
+	defer seenJobsMu.Unlock()
+
+	seen := map[string]time.Time{}
+	if FileExist(seenJobsFile(opts)) {
+		sj, err := os.ReadFile(seenJobsFile(opts))
+		if err != nil {
+			return false, err
+		}
+
+		err = json.Unmarshal(sj, &seen)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if _, ok := seen[job.ID]; ok {
+		return false, nil
+	}
+
+	// expired jobs are rejected before this so there is no need to remember them
+	for id, notAfter := range seen {
+		if time.Now().After(notAfter) {
+			delete(seen, id)
+		}
+	}
+	seen[job.ID] = job.NotAfter
+
+	sj, err := json.Marshal(seen)
+	if err != nil {
+		return false, err
+	}
+
+	err = writeFileAtomic(seenJobsFile(opts), sj, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// readFacts reads the facts saved by the facts command
+func readFacts(opts *Options) (map[string]any, error) {
+	fj, err := os.ReadFile(opts.FactsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	facts := map[string]any{}
+	err = json.Unmarshal(fj, &facts)
+	if err != nil {
+		return nil, err
+	}
+
+	return facts, nil
+}
+
+// jobConsumerName is the durable consumer each node uses to receive jobs
+func jobConsumerName(identity string) string {
+	return "JOBS_" + invalidTokenChars.ReplaceAllString(identity, "_")
+}
+
+// jobsReplicationName is the name of the replication copying jobs from the backend to a site, each site needs its own
+// consumer on the backend as sites sharing one would each receive only some of the jobs
+func jobsReplicationName(site string) string {
+	return jobsStream + "_" + invalidTokenChars.ReplaceAllString(site, "_")
+}
+
+// runJobs receives and executes jobs until ctx is canceled
+func (a *Agent) runJobs(ctx context.Context) {
+	if a.opts.DisableJobs {
+		return
+	}
+
+	backoff.Default.For(ctx, func(try int) error {
+		err := a.consumeJobs(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.log.Errorf("Job processing failed: %v", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (a *Agent) consumeJobs(ctx context.Context) error {
+	_, nc, err := connectSiteBroker(ctx, a.opts, a.cfgFile, "jobs", a.log)
+	if err != nil {
+		return err
+	}
+	// we do not unsubscribe as that would remove the durable and we would miss jobs while stopped, durables of nodes
+	// that are gone are removed once they were inactive for as long as jobs can be valid
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	sub, err := js.PullSubscribe(jobsSubjectPrefix+">", jobConsumerName(a.opts.Identity), nats.BindStream(jobsStream), nats.DeliverNew(), nats.AckExplicit(), nats.InactiveThreshold(maxJobValidity))
+	if err != nil {
+		return fmt.Errorf("could not subscribe to jobs: %w", err)
+	}
+
+	a.log.Infof("Waiting for jobs")
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		msgs, err := sub.Fetch(1, nats.MaxWait(defaultJobsFetchTTL))
+		if errors.Is(err, nats.ErrTimeout) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range msgs {
+			// jobs are run at most once, a node restarting mid job will not run it again
+			msg.Ack()
+
+			result := a.handleJob(ctx, msg.Data)
+			if result == nil {
+				continue
+			}
+
+			rj, err := json.Marshal(result)
+			if err != nil {
+				a.log.Errorf("Could not encode result for job %s: %v", result.ID, err)
+				continue
+			}
+
+			_, err = js.Publish(fmt.Sprintf("%s%s.%s", jobResultsSubjectPrefix, result.ID, a.opts.Identity), rj)
+			if err != nil {
+				a.log.Errorf("Could not publish result for job %s: %v", result.ID, err)
+			}
+		}
+	}
+}
+
+// handleJob runs a job when it targets this node, nil results are not published
+func (a *Agent) handleJob(ctx context.Context, data []byte) *JobResult {
+	job, err := verifyJobRequest(data, a.opts.MachineSigningKey)
+	if err != nil {
+		a.log.Errorf("Rejecting job: %v", err)
+
+		// we only report on rejected jobs we can identify, unsigned content is not echoed back
+		var signed SignedJobRequest
+		var unverified JobRequest
+		if json.Unmarshal(data, &signed) != nil || json.Unmarshal(signed.Request, &unverified) != nil || !validJobID.MatchString(unverified.ID) {
+			return nil
+		}
+
+		return &JobResult{ID: unverified.ID, Identity: a.opts.Identity, Status: JobRejected, ExitCode: -1, Error: err.Error()}
+	}
+
+	log := a.log.WithField("job", job.ID)
+
+	if job.Site != a.opts.Site {
+		return &JobResult{ID: job.ID, Identity: a.opts.Identity, Status: JobRejected, ExitCode: -1, Error: fmt.Sprintf("job is for site %s", job.Site)}
+	}
+
+	if time.Now().After(job.NotAfter) {
+		log.Warnf("Skipping job that expired at %v", job.NotAfter)
+		return nil
+	}
+
+	// a job put back into the stream is not run again while it is valid
+	fresh, err := markJobSeen(a.opts, job)
+	if err != nil {
+		log.Errorf("Could not record job: %v", err)
+		return &JobResult{ID: job.ID, Identity: a.opts.Identity, Status: JobRejected, ExitCode: -1, Error: fmt.Sprintf("could not record job: %v", err)}
+	}
+	if !fresh {
+		log.Warnf("Skipping job that was received before")
+		return nil
+	}
+
+	if !job.Target.Empty() {
+		facts, err := readFacts(a.opts)
+		if err != nil {
+			log.Warnf("Could not read facts for job targeting: %v", err)
+		}
+
+		matched, reason, err := job.Target.Match(a.opts.Identity, facts)
+		if err != nil {
+			return &JobResult{ID: job.ID, Identity: a.opts.Identity, Status: JobRejected, ExitCode: -1, Error: err.Error()}
+		}
+		if !matched {
+			log.Debugf("Skipping job: %s", reason)
+			return nil
+		}
+	}
+
+	return runJob(ctx, job, a.opts.Identity, log)
+}
+
+func runJob(ctx context.Context, job *JobRequest, identity string, log *logrus.Entry) *JobResult {
+	result := &JobResult{ID: job.ID, Identity: identity, Started: time.Now().UTC()}
+
+	timeout, _ := job.timeout()
+	to, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{max: maxJobOutput}
+	stderr := &limitedBuffer{max: maxJobOutput}
+
+	cmd := exec.CommandContext(to, job.Command, job.Args...)
+	cmd.Dir = job.Directory
+	cmd.Env = append(os.Environ(), job.Environment...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = jobWaitDelay
+
+	// jobs run in their own process group so processes they start are killed with them
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	log.Warnf("Running job command %s", job.Command)
+
+	err := cmd.Run()
+	result.Duration = time.Since(result.Started)
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	result.ExitCode = -1
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	switch {
+	case to.Err() == context.DeadlineExceeded:
+		result.Status = JobTimeout
+		result.Error = fmt.Sprintf("timeout after %v", timeout)
+	case err != nil:
+		result.Status = JobFailed
+		result.Error = err.Error()
+	default:
+		result.Status = JobSuccess
+	}
+
+	return result
+}
+
+// limitedBuffer keeps up to max bytes, discarding the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	remaining := b.max - b.Len()
+	if remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
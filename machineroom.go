@@ -48,6 +48,8 @@ type RuntimeOptions interface {
 	NoHostFacts() bool
 	// NoNetworkFacts indicates if built-in network facts will be gathered
 	NoNetworkFacts() bool
+	// NoExternalFacts indicates if facts from the external facts directory will be gathered
+	NoExternalFacts() bool
 	// ConfigurationDirectory is the path where configuration and other runtime files will be stored
 	ConfigurationDirectory() string
 	// MachinesDirectory is the directory where autonomous agents will be stored
@@ -56,6 +58,10 @@ type RuntimeOptions interface {
 	ProvisioningJWTFile() string
 	// FactsFile is a file holding instance data
 	FactsFile() string
+	// ExternalFactsDirectory is a directory holding files and executables that produce facts
+	ExternalFactsDirectory() string
+	// DataPolicyFile is a file holding the policy applied to data replicated to the backend
+	DataPolicyFile() string
 	// SeedFile is a ed25519 seed issued by the Choria Organization Issuer during provisioning
 	SeedFile() string
 	// JWTFile is the JWT file issued during provisioning
@@ -68,6 +74,10 @@ type RuntimeOptions interface {
 	SubmissionSpoolSize() int
 	// StorageDirectory is where JetStream and other state is kept
 	StorageDirectory() string
+	// ReplicationStateDirectory is where the stream replicator keeps its state
+	ReplicationStateDirectory() string
+	// AuditDirectory holds the audit log of data sent to and received from the backend
+	AuditDirectory() string
 	// NatsNeySeedFile is a NKey created during provisioning that could optionally be used to authenticate to the SaaS
 	NatsNeySeedFile() string
 	// NatsCredentialsFile is a NATS credential that, if provisioning signed a nats JWT, will hold a valid cred for accessing the SaaS backend
@@ -76,6 +86,10 @@ type RuntimeOptions interface {
 	StartTime() time.Time
 	// ConfigBucketPrefix will replicate only a subset of keys from the backend to the site
 	ConfigBucketPrefix() string
+	// Site is the site the agent belongs to
+	Site() string
+	// Role is the role of the agent in the site
+	Role() string
 }
 
 // FactsGenerator gathers facts
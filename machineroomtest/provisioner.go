@@ -0,0 +1,109 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroomtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/choria-io/tokens"
+)
+
+// provisioner stands in for Choria Provisioner and the helper in example/setup/templates/provisioner,
+// it writes the configuration and credentials a provisioned node would receive
+type provisioner struct {
+	issuerPub ed25519.PublicKey
+	issuerPri ed25519.PrivateKey
+	validity  time.Duration
+}
+
+func newProvisioner(validity time.Duration) (*provisioner, error) {
+	pub, pri, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &provisioner{issuerPub: pub, issuerPri: pri, validity: validity}, nil
+}
+
+// provision writes the configuration, seed and token for identity into dir returning the configuration file
+func (p *provisioner) provision(dir string, identity string, settings map[string]string) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	pub, pri, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := tokens.NewServerClaims(identity, []string{"choria"}, "choria", &tokens.ServerPermissions{
+		Submission:  true,
+		Streams:     true,
+		ServiceHost: true,
+	}, []string{">"}, pub, fmt.Sprintf("I-%s", hex.EncodeToString(p.issuerPub)), p.validity)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := tokens.SignToken(claims, p.issuerPri)
+	if err != nil {
+		return "", err
+	}
+
+	seedFile := filepath.Join(dir, "server.seed")
+	tokenFile := filepath.Join(dir, "server.jwt")
+
+	err = os.WriteFile(seedFile, []byte(hex.EncodeToString(pri.Seed())), 0400)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.WriteFile(tokenFile, []byte(token), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	cfg := map[string]string{
+		"identity":                             identity,
+		"loglevel":                             "warn",
+		"plugin.choria.server.provision":       "false",
+		"plugin.security.issuer.names":         "choria",
+		"plugin.security.issuer.choria.public": hex.EncodeToString(p.issuerPub),
+		"plugin.security.provider":             "choria",
+		"plugin.security.choria.token_file":    tokenFile,
+		"plugin.security.choria.seed_file":     seedFile,
+	}
+	for k, v := range settings {
+		cfg[k] = v
+	}
+
+	keys := make([]string, 0, len(cfg))
+	for k := range cfg {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s = %s\n", k, cfg[k])
+	}
+
+	cfgFile := filepath.Join(dir, "machine-room.conf")
+	err = os.WriteFile(cfgFile, []byte(b.String()), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return cfgFile, nil
+}
@@ -0,0 +1,187 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroomtest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// BackendUser is the user in the backend account that consumes data from all customers
+	BackendUser = "backend"
+	// Password is the password used by all the SaaS users
+	Password = "s3cret"
+)
+
+// saas is an embedded NATS server configured like the SaaS in the example, with a backend
+// account receiving data from a single customer account
+type saas struct {
+	dir      string
+	customer string
+	srv      *server.Server
+}
+
+// similar to example/setup/templates/saas-nats/server.conf
+const saasConfig = `
+listen: 127.0.0.1:-1
+server_name: saas
+
+jetstream: {
+  store_dir: %[1]q
+}
+
+system_account: system
+
+accounts {
+    backend: {
+        jetstream: enabled
+        users: [
+            {user: %[3]s, password: %[4]s}
+        ]
+
+        exports: [
+            {service: machine_room.events.>}
+            {service: machine_room.nodes.>}
+            {service: machine_room.submit.>}
+        ]
+    }
+
+    %[2]s: {
+        jetstream: enabled
+
+        users: [
+            {user: %[2]s, password: %[4]s}
+            {user: %[2]s_admin, password: %[4]s}
+        ]
+
+        imports: [
+            {to: machine_room.events.>, service: {account: backend, subject: machine_room.events.%[2]s.>}}
+            {to: machine_room.nodes.>, service: {account: backend, subject: machine_room.nodes.%[2]s.>}}
+            {to: machine_room.submit.>, service: {account: backend, subject: machine_room.submit.%[2]s.>}}
+        ]
+    }
+
+    system: {
+        users: [
+            {user: system, password: %[4]s}
+        ]
+    }
+}
+`
+
+func newSaaS(dir string, customer string) *saas {
+	return &saas{dir: dir, customer: customer}
+}
+
+func (s *saas) start() error {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	cfile := filepath.Join(s.dir, "server.conf")
+	err = os.WriteFile(cfile, []byte(fmt.Sprintf(saasConfig, filepath.Join(s.dir, "jetstream"), s.customer, BackendUser, Password)), 0600)
+	if err != nil {
+		return err
+	}
+
+	opts, err := server.ProcessConfigFile(cfile)
+	if err != nil {
+		return fmt.Errorf("invalid SaaS configuration: %w", err)
+	}
+	opts.NoSigs = true
+
+	s.srv, err = server.NewServer(opts)
+	if err != nil {
+		return err
+	}
+
+	go s.srv.Start()
+
+	if !s.srv.ReadyForConnections(10 * time.Second) {
+		return fmt.Errorf("SaaS NATS server did not start")
+	}
+
+	return s.createStreams()
+}
+
+func (s *saas) stop() {
+	if s.srv == nil {
+		return
+	}
+
+	s.srv.Shutdown()
+	s.srv.WaitForShutdown()
+}
+
+func (s *saas) url() string {
+	return s.srv.ClientURL()
+}
+
+// userURL is the server URL with credentials for user embedded like the example provisioner does
+func (s *saas) userURL(user string) string {
+	return fmt.Sprintf("nats://%s:%s@%s", user, Password, s.srv.Addr().String())
+}
+
+func (s *saas) connect(user string) (*nats.Conn, error) {
+	return nats.Connect(s.url(), nats.UserInfo(user, Password))
+}
+
+// createStreams creates the same streams and buckets as example/setup/templates/saas-nats/create.sh
+func (s *saas) createStreams() error {
+	nc, err := s.connect(BackendUser)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	streams := map[string][]string{
+		"MACHINE_ROOM_EVENTS": {"machine_room.events.*.lifecycle.>", "machine_room.events.*.machine.>", "machine_room.events.*.jobs.>"},
+		"MACHINE_ROOM_NODES":  {"machine_room.nodes.*.>"},
+		"MACHINE_ROOM_SUBMIT": {"machine_room.submit.>"},
+	}
+
+	for name, subjects := range streams {
+		_, err = js.AddStream(&nats.StreamConfig{Name: name, Subjects: subjects, MaxAge: 24 * time.Hour, Storage: nats.FileStorage})
+		if err != nil {
+			return fmt.Errorf("could not create stream %s: %w", name, err)
+		}
+	}
+
+	cnc, err := s.connect(s.customer + "_admin")
+	if err != nil {
+		return err
+	}
+	defer cnc.Close()
+
+	cjs, err := cnc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	_, err = cjs.CreateKeyValue(&nats.KeyValueConfig{Bucket: "CONFIG", History: 1, Storage: nats.FileStorage})
+	if err != nil && !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return fmt.Errorf("could not create CONFIG bucket: %w", err)
+	}
+
+	_, err = cjs.AddStream(&nats.StreamConfig{Name: "JOBS", Subjects: []string{"machine_room.jobs.>"}, MaxAge: 24 * time.Hour, Storage: nats.FileStorage})
+	if err != nil {
+		return fmt.Errorf("could not create stream JOBS: %w", err)
+	}
+
+	return nil
+}
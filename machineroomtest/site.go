@@ -0,0 +1,430 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package machineroomtest runs a complete machine room site in a single process for use in tests.
+//
+// A Site starts an embedded NATS server acting as the SaaS, provisions a leader and a number of
+// followers using a stand-in for Choria Provisioner and runs them all as embedded agents. Tests can
+// then publish CONFIG data and jobs to the SaaS and assert that registration data and events arrive.
+//
+// The leader runs the site broker on its standard port so only one Site can run on a host at a time.
+//
+// Choria keeps autonomous agents and some build settings globally, machine room registers its autonomous agents once
+// per process and they find the node specific settings in the facts of each node, so every node has to be started
+// using the same Options.
+package machineroomtest
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-choria/choria"
+	"github.com/choria-io/go-choria/config"
+	machineroom "github.com/choria-io/machine-room"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// SiteOptions configures a simulated site
+type SiteOptions struct {
+	// Directory is where all state will be stored, typically from t.TempDir(), required
+	Directory string
+	// Followers is the number of follower agents to start in addition to the leader
+	Followers int
+	// Customer is the name of the customer account in the SaaS, defaults to cust_one
+	Customer string
+	// Site is the name of the site, defaults to site_one
+	Site string
+	// Options are used for every agent, MachineSigningKey is set to the key in Site.SigningKey and CommandPath defaults
+	// to true as the test binary can not run commands like the facts refresh
+	Options machineroom.Options
+	// TokenValidity is how long the server tokens issued to agents are valid, defaults to one year
+	TokenValidity time.Duration
+	// ReadyTimeout is how long to wait for every agent to become ready, defaults to one minute
+	ReadyTimeout time.Duration
+	// Log receives agent logs, defaults to discarding them
+	Log *logrus.Entry
+}
+
+// Node is an agent running in the site
+type Node struct {
+	// Identity is the identity the node was provisioned with
+	Identity string
+	// Leader indicates if the node runs the site broker and replication
+	Leader bool
+	// ConfigFile is the configuration the node was provisioned with
+	ConfigFile string
+	// Agent is the running agent
+	Agent *machineroom.Agent
+}
+
+// Site is a simulated machine room deployment
+type Site struct {
+	// SigningKey is the private key matching the MachineSigningKey of every agent
+	SigningKey ed25519.PrivateKey
+	// Nodes are the running agents, the leader is always first
+	Nodes []*Node
+
+	opts  SiteOptions
+	saas  *saas
+	prov  *provisioner
+	ctx   context.Context
+	stop  context.CancelFunc
+	mu    sync.Mutex
+	start bool
+}
+
+// NewSite creates a site that will run once Start is called
+func NewSite(opts SiteOptions) (*Site, error) {
+	if opts.Directory == "" {
+		return nil, fmt.Errorf("directory is required")
+	}
+	if opts.Followers < 0 {
+		return nil, fmt.Errorf("followers cannot be negative")
+	}
+	if opts.Customer == "" {
+		opts.Customer = "cust_one"
+	}
+	if opts.Site == "" {
+		opts.Site = "site_one"
+	}
+	if opts.TokenValidity == 0 {
+		opts.TokenValidity = 365 * 24 * time.Hour
+	}
+	if opts.ReadyTimeout == 0 {
+		opts.ReadyTimeout = time.Minute
+	}
+	if opts.Options.CommandPath == "" {
+		path, err := exec.LookPath("true")
+		if err != nil {
+			return nil, fmt.Errorf("could not find a command path: %w", err)
+		}
+		opts.Options.CommandPath = path
+	}
+	if opts.Log == nil {
+		logger := logrus.New()
+		logger.SetLevel(logrus.PanicLevel)
+		opts.Log = logrus.NewEntry(logger)
+	}
+
+	var err error
+	site := &Site{opts: opts}
+
+	site.prov, err = newProvisioner(opts.TokenValidity)
+	if err != nil {
+		return nil, err
+	}
+
+	_, site.SigningKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	site.saas = newSaaS(filepath.Join(opts.Directory, "saas"), opts.Customer)
+
+	return site, nil
+}
+
+// Start starts the SaaS and all agents, it returns once every agent is ready
+func (s *Site) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.start {
+		return fmt.Errorf("site already started")
+	}
+	s.start = true
+
+	s.ctx, s.stop = context.WithCancel(ctx)
+
+	err := s.saas.start()
+	if err != nil {
+		return fmt.Errorf("could not start SaaS: %w", err)
+	}
+
+	// the leader has to be ready before followers can connect to its broker
+	leader, err := s.startNode(fmt.Sprintf("leader.%s.example.net", s.opts.Site), true)
+	if err != nil {
+		return err
+	}
+	s.Nodes = append(s.Nodes, leader)
+
+	var followers []*Node
+	for i := 1; i <= s.opts.Followers; i++ {
+		node, err := s.startNode(fmt.Sprintf("follower%d.%s.example.net", i, s.opts.Site), false)
+		if err != nil {
+			return err
+		}
+		followers = append(followers, node)
+		s.Nodes = append(s.Nodes, node)
+	}
+
+	for _, node := range followers {
+		err = s.waitReady(node)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Site) startNode(identity string, leader bool) (*Node, error) {
+	settings := map[string]string{
+		"plugin.choria.middleware_hosts": "nats://localhost:9222",
+		"machine_room.site":              s.opts.Site,
+		"machine_room.role":              "follower",
+	}
+	if leader {
+		settings["machine_room.role"] = "leader"
+		settings["machine_room.source.host"] = s.saas.userURL(s.opts.Customer)
+	}
+
+	cfgFile, err := s.prov.provision(filepath.Join(s.opts.Directory, identity), identity, settings)
+	if err != nil {
+		return nil, fmt.Errorf("could not provision %s: %w", identity, err)
+	}
+
+	// every node gets its own state so they can share the host
+	opts := s.opts.Options
+	opts.MachineSigningKey = hex.EncodeToString(s.SigningKey.Public().(ed25519.PublicKey))
+	opts.ServerStorageDirectory = filepath.Join(s.opts.Directory, identity, "storage")
+	opts.ServerStatusFile = ""
+	opts.ServerSubmissionDirectory = ""
+	opts.ReplicationStateDirectory = ""
+
+	agent, err := machineroom.NewAgent(opts, cfgFile, s.opts.Log.WithField("node", identity))
+	if err != nil {
+		return nil, fmt.Errorf("could not create agent %s: %w", identity, err)
+	}
+
+	node := &Node{Identity: identity, Leader: leader, ConfigFile: cfgFile, Agent: agent}
+
+	err = agent.Start(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not start agent %s: %w", identity, err)
+	}
+
+	if leader {
+		err = s.waitReady(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+func (s *Site) waitReady(node *Node) error {
+	timer := time.NewTimer(s.opts.ReadyTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-node.Agent.Ready():
+		return nil
+	case <-node.Agent.Done():
+		return fmt.Errorf("agent %s stopped: %v", node.Identity, node.Agent.Err())
+	case <-timer.C:
+		return fmt.Errorf("agent %s did not become ready within %v", node.Identity, s.opts.ReadyTimeout)
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+// Stop stops all agents and the SaaS
+func (s *Site) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop == nil {
+		return
+	}
+
+	// followers first so they do not reconnect to a leader that is stopping
+	for i := len(s.Nodes) - 1; i >= 0; i-- {
+		s.Nodes[i].Agent.Stop()
+	}
+
+	s.stop()
+	s.saas.stop()
+	s.stop = nil
+}
+
+// Leader is the node running the site broker
+func (s *Site) Leader() *Node {
+	if len(s.Nodes) == 0 {
+		return nil
+	}
+
+	return s.Nodes[0]
+}
+
+// SaaSURL is the URL of the embedded SaaS NATS server
+func (s *Site) SaaSURL() string {
+	return s.saas.url()
+}
+
+// BackendConn connects to the SaaS backend account where MACHINE_ROOM_NODES, MACHINE_ROOM_EVENTS and MACHINE_ROOM_SUBMIT are
+func (s *Site) BackendConn() (*nats.Conn, error) {
+	return s.saas.connect(BackendUser)
+}
+
+// CustomerConn connects to the customer account in the SaaS where the CONFIG bucket and JOBS stream are
+func (s *Site) CustomerConn() (*nats.Conn, error) {
+	return s.saas.connect(s.opts.Customer + "_admin")
+}
+
+// PutConfig stores a value in the customer CONFIG bucket that will be replicated to the site
+func (s *Site) PutConfig(key string, value []byte) error {
+	nc, err := s.CustomerConn()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	kv, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return err
+	}
+
+	_, err = kv.Put(key, value)
+
+	return err
+}
+
+// SiteConfig reads a value from the CONFIG bucket on the site broker, used to confirm replication
+func (s *Site) SiteConfig(ctx context.Context, key string) ([]byte, error) {
+	nc, err := s.SiteConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := kv.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry.Value(), nil
+}
+
+// WaitForSiteConfig waits until key in the site CONFIG bucket has value
+func (s *Site) WaitForSiteConfig(ctx context.Context, key string, value []byte) error {
+	return poll(ctx, func() (bool, error) {
+		v, err := s.SiteConfig(ctx, key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return string(v) == string(value), nil
+	})
+}
+
+// WaitForMessage waits for a message matching subject to be stored in a backend stream like MACHINE_ROOM_EVENTS
+func (s *Site) WaitForMessage(ctx context.Context, stream string, subject string) (*nats.Msg, error) {
+	nc, err := s.BackendConn()
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := js.SubscribeSync(subject, nats.BindStream(stream), nats.OrderedConsumer(), nats.DeliverAll())
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	return sub.NextMsgWithContext(ctx)
+}
+
+// WaitForRegistration waits for registration data from every node to arrive in MACHINE_ROOM_NODES
+func (s *Site) WaitForRegistration(ctx context.Context) error {
+	for _, node := range s.Nodes {
+		_, err := s.WaitForMessage(ctx, "MACHINE_ROOM_NODES", fmt.Sprintf("machine_room.nodes.%s.%s", s.opts.Customer, node.Identity))
+		if err != nil {
+			return fmt.Errorf("no registration data for %s: %w", node.Identity, err)
+		}
+	}
+
+	return nil
+}
+
+// SiteConn connects to the site broker using the leader credentials
+func (s *Site) SiteConn(ctx context.Context) (*nats.Conn, error) {
+	leader := s.Leader()
+	if leader == nil {
+		return nil, fmt.Errorf("site not started")
+	}
+
+	cfg, err := config.NewSystemConfig(leader.ConfigFile, true)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CustomLogger = s.opts.Log.Logger
+	cfg.Choria.UseSRVRecords = false
+
+	fw, err := choria.NewWithConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := fw.NewConnector(ctx, fw.MiddlewareServers, "machineroomtest", s.opts.Log)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.Nats(), nil
+}
+
+func poll(ctx context.Context, check func() (bool, error)) error {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		ok, err := check()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
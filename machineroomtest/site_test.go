@@ -0,0 +1,147 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroomtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	machineroom "github.com/choria-io/machine-room"
+)
+
+// the leader binds the standard site broker port so every check runs against one site
+func TestSite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a complete site")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	defer cancel()
+
+	site, err := NewSite(SiteOptions{Directory: t.TempDir(), Followers: 2})
+	if err != nil {
+		t.Fatalf("NewSite failed: %v", err)
+	}
+
+	err = site.Start(ctx)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer site.Stop()
+
+	t.Run("registration", func(t *testing.T) {
+		err := site.WaitForRegistration(ctx)
+		if err != nil {
+			t.Fatalf("registration failed: %v", err)
+		}
+	})
+
+	t.Run("config", func(t *testing.T) {
+		follower := site.Nodes[1]
+
+		putSigned(t, site, "greeting", "hello")
+		putSigned(t, site, machineroom.ConfigScope{Identity: follower.Identity}.Keys("greeting")[0], "hello follower")
+
+		for _, node := range site.Nodes {
+			expected := "hello"
+			if node == follower {
+				expected = "hello follower"
+			}
+
+			err := poll(ctx, func() (bool, error) {
+				value, err := node.Agent.LookupConfig(ctx, "greeting")
+				if err != nil {
+					return false, nil
+				}
+
+				return string(value) == expected, nil
+			})
+			if err != nil {
+				t.Fatalf("%s did not see greeting %q: %v", node.Identity, expected, err)
+			}
+		}
+	})
+
+	t.Run("unsigned config", func(t *testing.T) {
+		err := site.PutConfig("unsigned", []byte("value"))
+		if err != nil {
+			t.Fatalf("PutConfig failed: %v", err)
+		}
+
+		err = site.WaitForSiteConfig(ctx, "unsigned", []byte("value"))
+		if err != nil {
+			t.Fatalf("value was not replicated: %v", err)
+		}
+
+		_, err = site.Leader().Agent.LookupConfig(ctx, "unsigned")
+		if err == nil {
+			t.Fatalf("unsigned value was accepted")
+		}
+	})
+
+	t.Run("jobs", func(t *testing.T) {
+		nc, err := site.CustomerConn()
+		if err != nil {
+			t.Fatalf("CustomerConn failed: %v", err)
+		}
+		defer nc.Close()
+
+		js, err := nc.JetStream()
+		if err != nil {
+			t.Fatalf("JetStream failed: %v", err)
+		}
+
+		for _, job := range []*machineroom.JobRequest{
+			{ID: "site_job", Site: site.opts.Site, Command: "true"},
+			{ID: "other_site_job", Site: "other_site", Command: "true"},
+		} {
+			signed, err := machineroom.SignJobRequest(job, site.SigningKey)
+			if err != nil {
+				t.Fatalf("SignJobRequest failed: %v", err)
+			}
+
+			_, err = js.Publish(machineroom.JobSubject(job.ID), signed)
+			if err != nil {
+				t.Fatalf("Publish failed: %v", err)
+			}
+		}
+
+		for _, node := range site.Nodes {
+			for job, status := range map[string]string{"site_job": machineroom.JobSuccess, "other_site_job": machineroom.JobRejected} {
+				msg, err := site.WaitForMessage(ctx, "MACHINE_ROOM_EVENTS", fmt.Sprintf("machine_room.events.%s.jobs.%s.%s", site.opts.Customer, job, node.Identity))
+				if err != nil {
+					t.Fatalf("no result for %s from %s: %v", job, node.Identity, err)
+				}
+
+				var result machineroom.JobResult
+				err = json.Unmarshal(msg.Data, &result)
+				if err != nil {
+					t.Fatalf("invalid result: %v", err)
+				}
+
+				if result.Status != status {
+					t.Fatalf("expected %s to be %s on %s got %s: %s", job, status, node.Identity, result.Status, result.Error)
+				}
+			}
+		}
+	})
+}
+
+func putSigned(t *testing.T, site *Site, key string, value string) {
+	t.Helper()
+
+	signed, err := machineroom.SignConfigValue(key, []byte(value), site.SigningKey)
+	if err != nil {
+		t.Fatalf("SignConfigValue failed: %v", err)
+	}
+
+	err = site.PutConfig(key, signed)
+	if err != nil {
+		t.Fatalf("PutConfig failed: %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// site local bucket holding the plugins selected by each node
+	machinesBucket = "MACHINES"
+	// site local object store holding plugin artifacts
+	pluginsBucket = "PLUGINS"
+	// key in the CONFIG bucket holding the signed plugins specification
+	machinesSpecKey = "machines"
+
+	defaultMachinesSelectInterval = 30 * time.Second
+)
+
+var invalidKeyChars = regexp.MustCompile(`[^a-zA-Z0-9_=./-]`)
+
+// machinesSpecification is the signed plugins specification consumed by the plugins watcher
+type machinesSpecification struct {
+	Plugins   []byte `json:"plugins"`
+	Signature string `json:"signature"`
+}
+
+// machineSelection reports why a plugin was or was not selected for this node
+type machineSelection struct {
+	Name     string `json:"name"`
+	Selected bool   `json:"selected"`
+	Reason   string `json:"reason"`
+}
+
+// machinesSelectionReport is stored on disk and included in facts
+type machinesSelectionReport struct {
+	Updated time.Time          `json:"updated"`
+	Plugins []machineSelection `json:"plugins"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// machinesKey is the key in the MACHINES bucket holding the plugins selected for identity
+func machinesKey(identity string) string {
+	return "node." + invalidKeyChars.ReplaceAllString(identity, "_")
+}
+
+// selectMachines verifies a signed specification and selects the plugins matching the node.
+//
+// Each plugin can have a target holding a Selector, plugins without one are deployed to all nodes.
+func selectMachines(spec []byte, signingKey string, identity string, facts map[string]any) ([]map[string]any, []machineSelection, error) {
+	var signed machinesSpecification
+	err := json.Unmarshal(spec, &signed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid plugins specification: %w", err)
+	}
+
+	pk, err := hex.DecodeString(signingKey)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return nil, nil, fmt.Errorf("invalid signing key")
+	}
+
+	sig, err := hex.DecodeString(signed.Signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	if !ed25519.Verify(pk, signed.Plugins, sig) {
+		return nil, nil, fmt.Errorf("plugins specification signature verification failed")
+	}
+
+	var plugins []map[string]any
+	err = json.Unmarshal(signed.Plugins, &plugins)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid plugins list: %w", err)
+	}
+
+	selected := []map[string]any{}
+	report := []machineSelection{}
+
+	for _, p := range plugins {
+		name := fmt.Sprint(p["name"])
+
+		var target Selector
+		if t, ok := p["target"]; ok {
+			tj, err := json.Marshal(t)
+			if err == nil {
+				err = json.Unmarshal(tj, &target)
+			}
+			if err == nil {
+				err = target.Validate()
+			}
+			if err != nil {
+				report = append(report, machineSelection{Name: name, Reason: fmt.Sprintf("invalid target: %v", err)})
+				continue
+			}
+		}
+
+		matched, reason, err := target.Match(identity, facts)
+		if err != nil {
+			report = append(report, machineSelection{Name: name, Reason: fmt.Sprintf("invalid target: %v", err)})
+			continue
+		}
+
+		report = append(report, machineSelection{Name: name, Selected: matched, Reason: reason})
+		if matched {
+			delete(p, "target")
+			selected = append(selected, p)
+		}
+	}
+
+	return selected, report, nil
+}
+
+// signMachines signs the selected plugins so the plugins watcher will accept them
+func signMachines(plugins []map[string]any, key ed25519.PrivateKey) ([]byte, error) {
+	pj, err := json.Marshal(plugins)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&machinesSpecification{
+		Plugins:   pj,
+		Signature: hex.EncodeToString(ed25519.Sign(key, pj)),
+	})
+}
+
+// machinesPublicKey is the hex encoded public key of the node local signing key, empty when it was not created yet
+func machinesPublicKey(opts *Options) (string, error) {
+	if !choria.FileExist(opts.MachinesSigningSeedFile) {
+		return "", nil
+	}
+
+	key, err := machinesSigningKey(opts)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey)), nil
+}
+
+// machinesSigningKey loads the node local key used to sign selected plugins, creating it when needed
+func machinesSigningKey(opts *Options) (ed25519.PrivateKey, error) {
+	if !choria.FileExist(opts.MachinesSigningSeedFile) {
+		_, pri, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeFileAtomic(opts.MachinesSigningSeedFile, []byte(hex.EncodeToString(pri.Seed())), 0400)
+		if err != nil {
+			return nil, err
+		}
+
+		return pri, nil
+	}
+
+	seed, err := os.ReadFile(opts.MachinesSigningSeedFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := hex.DecodeString(string(bytes.TrimSpace(seed)))
+	if err != nil || len(s) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid seed in %s", opts.MachinesSigningSeedFile)
+	}
+
+	return ed25519.NewKeyFromSeed(s), nil
+}
+
+func machinesSelectionFile(opts *Options) string {
+	return filepath.Join(opts.ConfigurationDirectory, defaultMachinesSelectionFile)
+}
+
+// readMachinesSelection reads the last plugin selection, nil when none was made
+func readMachinesSelection(opts *Options) (*machinesSelectionReport, error) {
+	if !choria.FileExist(machinesSelectionFile(opts)) {
+		return nil, nil
+	}
+
+	rj, err := os.ReadFile(machinesSelectionFile(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	var report machinesSelectionReport
+	err = json.Unmarshal(rj, &report)
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// manageMachines selects the plugins to deploy to this node from the CONFIG specification until ctx is canceled
+func (a *Agent) manageMachines(ctx context.Context) {
+	backoff.Default.For(ctx, func(try int) error {
+		err := a.selectMachinesLoop(ctx)
+		if err != nil && ctx.Err() == nil {
+			a.log.Errorf("Plugin selection failed: %v", err)
+			return err
+		}
+
+		return nil
+	})
+}
+
+func (a *Agent) selectMachinesLoop(ctx context.Context) error {
+	key, err := machinesSigningKey(a.opts)
+	if err != nil {
+		return fmt.Errorf("could not load plugins signing key: %w", err)
+	}
+
+	_, nc, err := connectSiteBroker(ctx, a.opts, a.cfgFile, "machines", a.log)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	cfg, err := js.KeyValue("CONFIG")
+	if err != nil {
+		return fmt.Errorf("could not access CONFIG bucket: %w", err)
+	}
+
+	machines, err := js.KeyValue(machinesBucket)
+	if err != nil {
+		return fmt.Errorf("could not access %s bucket: %w", machinesBucket, err)
+	}
+
+	ticker := time.NewTicker(defaultMachinesSelectInterval)
+	defer ticker.Stop()
+
+	var last []byte
+
+	for {
+		last, err = a.selectMachines(ctx, cfg, machines, key, last)
+		if err != nil {
+			a.log.Errorf("Could not select plugins: %v", err)
+			a.saveMachinesSelection(&machinesSelectionReport{Error: err.Error()})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// selectMachines updates the plugins selected for this node, returns the specification that was stored
+func (a *Agent) selectMachines(ctx context.Context, cfg nats.KeyValue, machines nats.KeyValue, key ed25519.PrivateKey, last []byte) ([]byte, error) {
+	value, err := lookupVerifiedConfig(ctx, a.opts, a.cfgFile, cfg, a.configScope(), machinesSpecKey, a.log)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return last, nil
+	}
+	if err != nil {
+		return last, err
+	}
+
+	facts, err := readFacts(a.opts)
+	if err != nil {
+		a.log.Warnf("Could not read facts for plugin selection: %v", err)
+	}
+
+	selected, report, err := selectMachines(value, a.opts.MachineSigningKey, a.opts.Identity, facts)
+	if err != nil {
+		return last, err
+	}
+
+	a.saveMachinesSelection(&machinesSelectionReport{Plugins: report})
+
+	localPluginSources(selected, a.opts.PluginsPort)
+
+	spec, err := signMachines(selected, key)
+	if err != nil {
+		return last, err
+	}
+
+	if bytes.Equal(spec, last) {
+		return last, nil
+	}
+
+	for _, s := range report {
+		a.log.Infof("Plugin %s selected: %t: %s", s.Name, s.Selected, s.Reason)
+	}
+
+	_, err = machines.Put(machinesKey(a.opts.Identity), spec)
+	if err != nil {
+		return last, err
+	}
+
+	return spec, nil
+}
+
+func (a *Agent) saveMachinesSelection(report *machinesSelectionReport) {
+	report.Updated = time.Now().UTC()
+
+	rj, err := json.Marshal(report)
+	if err != nil {
+		a.log.Errorf("Could not encode plugin selection: %v", err)
+		return
+	}
+
+	err = writeFileAtomic(machinesSelectionFile(a.opts), rj, 0600)
+	if err != nil {
+		a.log.Errorf("Could not save plugin selection: %v", err)
+	}
+}
@@ -12,15 +12,24 @@ import (
 
 const (
 	// keys used in config file set by helper
-	configKeySourceHost    = "machine_room.source.host"
-	configKeySourceNatsJwt = "machine_room.source.nats_jwt"
-	configKeyRole          = "machine_room.role"
-	configKeySite          = "machine_room.site"
+	configKeySourceHost     = "machine_room.source.host"
+	configKeySourceNatsJwt  = "machine_room.source.nats_jwt"
+	configKeyRole           = "machine_room.role"
+	configKeySite           = "machine_room.site"
+	configKeyBrokerTLSNames = "machine_room.broker.tls_names"
+	configKeyBrokerPeers    = "machine_room.broker.peers"
+	configKeyOffline        = "machine_room.offline"
 
-	// filesystem paths
-	defaultServerStatusFile          = "/var/lib/choria/machine-room/status.json"
-	defaultStorageDirectory          = "/var/lib/choria/machine-room"
-	defaultReplicationStateDirectory = "/var/lib/choria/machine-room/replicator"
+	// filesystem paths, rootless installs use the XDG state directory instead
+	defaultStorageRoot = "/var/lib/choria"
+
+	// names of files and directories stored in the storage dir
+	defaultServerStatusFileName      = "status.json"
+	defaultSubmissionSpoolName       = "submission"
+	defaultReplicationStateDirectory = "replicator"
+	defaultBundleStateFile           = "bundle-export.json"
+	defaultBundleImportStateFile     = "bundle-import.json"
+	defaultSeenJobsFile              = "jobs.json"
 
 	// names of files stored in config dir
 	defaultServerSeedFileName    = "server.seed"
@@ -31,17 +40,49 @@ const (
 	defaultNatsNkeyFile          = "nats.nkey"
 	defaultNatsCredentialFile    = "nats.creds"
 	defaultCaFile                = "ca.pem"
+	defaultCaKeyFile             = "ca.key"
+	defaultCaCrossFile           = "ca-cross.pem"
 	defaultCertFile              = "cert.pem"
 	defaultKeyFile               = "key.pem"
+	defaultTokenRenewalFile      = "renewal.json"
+	defaultTokenRenewalDirectory = "renewal"
+	defaultMachinesSeedFile      = "machines.seed"
+	defaultMachinesSelectionFile = "machines.json"
+	defaultUpgradeStateFile      = "upgrade.json"
+	defaultProvisioningStateFile = "provisioning.json"
+	defaultProvisionedStateFile  = "provisioned.json"
+	defaultConfigVersionsFile    = "config-versions.json"
+	defaultDataPolicyFile        = "data-policy.yaml"
+	defaultDataPolicyKeyFile     = "data-policy.key"
+	defaultDataPolicyStatusFile  = "policy.json"
+	defaultAuditDirectory        = "audit"
+
+	// external facts directory in the config dir and the settings file in it, cached results are stored in the storage dir using the same directory name
+	defaultExternalFactsDirectory    = "facts.d"
+	defaultExternalFactsSettingsFile = ".settings.yaml"
 
 	// submission options
-	defaultSubmissionSpool     = "/var/lib/choria/machine-room/submission"
 	defaultSubmissionSpoolSize = 5000
 
+	// audit log rotation
+	defaultAuditLogMaxSize  = 50 * 1024 * 1024
+	defaultAuditLogMaxFiles = 10
+
 	// default times and ports
-	defaultFactsRefresh      = 10 * time.Minute
-	defaultShutdownGrace     = 5 * time.Second
-	defaultNetworkClientPort = 9222
+	defaultFactsRefresh         = 10 * time.Minute
+	defaultExternalFactsTimeout = 10 * time.Second
+	defaultShutdownGrace        = 5 * time.Second
+	defaultNetworkClientPort    = 9222
+	defaultNetworkPeerPort      = 5222
+	defaultPluginsPort          = 9280
+
+	// server token renewal
+	defaultTokenRenewBefore        = 7 * 24 * time.Hour
+	defaultTokenRenewCheckInterval = time.Hour
+	defaultTokenRenewalTimeout     = 10 * time.Minute
+
+	// agent upgrades
+	defaultUpgradeHealthWindow = 5 * time.Minute
 )
 
 type roOptions struct {
@@ -60,20 +101,27 @@ func (o roOptions) NoCPUFacts() bool                    { return o.opts.NoCPUFac
 func (o roOptions) NoDiskFacts() bool                   { return o.opts.NoDiskFacts }
 func (o roOptions) NoHostFacts() bool                   { return o.opts.NoHostFacts }
 func (o roOptions) NoNetworkFacts() bool                { return o.opts.NoNetworkFacts }
+func (o roOptions) NoExternalFacts() bool               { return o.opts.NoExternalFacts }
 func (o roOptions) ConfigurationDirectory() string      { return o.opts.ConfigurationDirectory }
 func (o roOptions) MachinesDirectory() string           { return o.opts.MachinesDirectory }
 func (o roOptions) ProvisioningJWTFile() string         { return o.opts.ProvisioningJWTFile }
 func (o roOptions) FactsFile() string                   { return o.opts.FactsFile }
+func (o roOptions) ExternalFactsDirectory() string      { return o.opts.ExternalFactsDirectory }
+func (o roOptions) DataPolicyFile() string              { return o.opts.DataPolicyFile }
 func (o roOptions) SeedFile() string                    { return o.opts.ServerSeedFile }
 func (o roOptions) JWTFile() string                     { return o.opts.ServerJWTFile }
 func (o roOptions) StatusFile() string                  { return o.opts.ServerStatusFile }
 func (o roOptions) SubmissionDirectory() string         { return o.opts.ServerSubmissionDirectory }
 func (o roOptions) SubmissionSpoolSize() int            { return o.opts.ServerSubmissionSpoolSize }
 func (o roOptions) StorageDirectory() string            { return o.opts.ServerStorageDirectory }
+func (o roOptions) ReplicationStateDirectory() string   { return o.opts.ReplicationStateDirectory }
+func (o roOptions) AuditDirectory() string              { return o.opts.AuditDirectory }
 func (o roOptions) NatsNeySeedFile() string             { return o.opts.NatsNkeySeedFile }
 func (o roOptions) NatsCredentialsFile() string         { return o.opts.NatsCredentialsFile }
 func (o roOptions) StartTime() time.Time                { return o.opts.StartTime }
 func (o roOptions) ConfigBucketPrefix() string          { return o.opts.ConfigBucketPrefix }
+func (o roOptions) Site() string                        { return o.opts.Site }
+func (o roOptions) Role() string                        { return o.opts.Role }
 func (o roOptions) Args() []string                      { return o.opts.Args }
 
 func (o *Options) roCopy() *roOptions {
@@ -97,14 +145,47 @@ type Options struct {
 
 	// FactsRefreshInterval sets an interval to refresh facts on, 10 minutes by default and cannot be less than 1 minute
 	FactsRefreshInterval time.Duration `json:"facts_refresh_interval"`
+	// TokenRenewBefore is how long before the server token expires it will be renewed by re-enrolling with the provisioner, 7 days by default
+	TokenRenewBefore time.Duration `json:"token_renew_before"`
+	// TokenRenewalTimeout is how long re-enrolling with the provisioner may take before the renewal fails and is retried, 10 minutes by default
+	TokenRenewalTimeout time.Duration `json:"token_renewal_timeout"`
+	// DisableTokenRenewal disables automatic renewal of the server token
+	DisableTokenRenewal bool `json:"disable_token_renewal,omitempty"`
+	// DisableUpgrades disables upgrading the agent to the version requested in the CONFIG bucket
+	DisableUpgrades bool `json:"disable_upgrades,omitempty"`
+	// UpgradeHealthWindow is how long a newly upgraded agent has to become ready before it is rolled back, 5 minutes by default
+	UpgradeHealthWindow time.Duration `json:"upgrade_health_window"`
+	// DisableJobs disables running jobs sent from the backend
+	DisableJobs bool `json:"disable_jobs,omitempty"`
 	// ConfigBucketPrefix will replicate only a subset of keys from the backend to the site
 	ConfigBucketPrefix string `json:"config_bucket_prefix"`
+	// PluginsPort is the loopback port plugin artifacts in the PLUGINS object store are served on, defaults to 9280,
+	// agents on one host share the server of the first agent so agents in different sites need different ports
+	PluginsPort int `json:"plugins_port,omitempty"`
+	// AllowUnsignedConfig accepts CONFIG values that are not signed using SignConfigValue, signed values are always verified
+	AllowUnsignedConfig bool `json:"allow_unsigned_config,omitempty"`
+	// NoAuditLog disables the audit log of data leaders send to and receive from the backend
+	NoAuditLog bool `json:"no_audit_log,omitempty"`
+	// AuditLogMaxSize is the size in bytes the audit log is rotated at, defaults to 50MiB
+	AuditLogMaxSize int64 `json:"audit_log_max_size,omitempty"`
+	// AuditLogMaxFiles is how many rotated audit logs are kept, defaults to 10
+	AuditLogMaxFiles int `json:"audit_log_max_files,omitempty"`
+	// BrokerTLSKeyType is the key type used for the local broker CA and certificate, one of rsa, ecdsa or ed25519, defaults to ecdsa
+	BrokerTLSKeyType string `json:"broker_tls_key_type,omitempty"`
+	// BrokerTLSNames are additional DNS names or IP addresses added to the broker certificate, in addition to machine_room.broker.tls_names from the configuration
+	BrokerTLSNames []string `json:"broker_tls_names,omitempty"`
+	// AdditionalStreams are streams and KV buckets replicated in addition to the standard ones
+	AdditionalStreams []ReplicatedStream `json:"additional_streams,omitempty"`
 	// Plugins are additional plugins like autonomous agents to add to the build
 	Plugins map[string]plugin.Pluggable `json:"-"`
 	// AdditionalFacts will be called during fact generation and the result will be shallow merged with the standard facts
 	AdditionalFacts FactsGenerator `json:"-"`
+	// FactsRedactors are applied to the output of AdditionalFacts, after the default rules that redact keys like password and token
+	FactsRedactors []FactsRedactor `json:"-"`
 	// ReadyFunc is an optional function that will be called once provisioning completes and system is fully initialized
 	ReadyFunc ReadyFunc `json:"-"`
+	// Hooks are optional callbacks invoked at points in the agent life cycle like provisioning, replication and shutdown
+	Hooks LifecycleHooks `json:"-"`
 	// Args are parsed instead of os.Args if Args is not nil
 	Args []string `json:"-"`
 
@@ -123,37 +204,63 @@ type Options struct {
 	NoHostFacts bool `json:"no_host_facts,omitempty"`
 	// NoNetworkFacts disables built-in network interface facts gathering
 	NoNetworkFacts bool `json:"no_network_facts,omitempty"`
+	// NoExternalFacts disables gathering facts from the ExternalFactsDirectory
+	NoExternalFacts bool `json:"no_external_facts,omitempty"`
 
-	// Read only below...
+	// Rootless stores state in the user XDG state directory rather than /var/lib/choria, for installs not running as root
+	Rootless bool `json:"rootless,omitempty"`
 
-	// ConfigurationDirectory is the directory the configuration file is stored in (RO)
+	// Paths below are set to defaults when empty, values set by the caller are kept
+
+	// ConfigurationDirectory is the directory holding credentials and other runtime files, defaults to the directory the configuration file is in
 	ConfigurationDirectory string `json:"configuration_directory"`
-	// MachinesDirectory is where autonomous agents are stored (RO)
+	// MachinesDirectory is where autonomous agents are stored, defaults to machines in the configuration directory
 	MachinesDirectory string `json:"machines_directory"`
-	// ProvisioningJWTFile is the path to provisioning jwt file, defaults to provisioning.jwt in the options dir (RO)
+	// ProvisioningJWTFile is the path to provisioning jwt file, defaults to provisioning.jwt in the configuration directory
 	ProvisioningJWTFile string `json:"provisioning_jwt_file"`
-	// FactsFile is the path to the facts file which default to instance.json in the options dir (RO)
+	// FactsFile is the path to the facts file which default to instance.json in the configuration directory
 	FactsFile string `json:"facts_file"`
-	// ServerSeedFile is the path to the server seed file that will exist after provisioning (RO)
+	// ExternalFactsDirectory holds JSON and YAML files or executables producing facts, defaults to facts.d in the configuration directory
+	ExternalFactsDirectory string `json:"external_facts_directory"`
+	// DataPolicyFile restricts the data leaders replicate to the backend when it exists, defaults to data-policy.yaml in the configuration directory
+	DataPolicyFile string `json:"data_policy_file"`
+	// ServerSeedFile is the path to the server seed file that will exist after provisioning, defaults to server.seed in the configuration directory
 	ServerSeedFile string `json:"server_seed_file"`
-	// ServerJWTFile is the path to the server jwt file that will exist after provisioning (RO)
+	// ServerJWTFile is the path to the server jwt file that will exist after provisioning, defaults to server.jwt in the configuration directory
 	ServerJWTFile string `json:"server_jwt_file"`
-	// ServerStatusFile is where the server will regularly write its status (RO)
+	// ServerStorageDirectory the directory where state is stored, defaults to /var/lib/choria/<name> or $XDG_STATE_HOME/<name> when Rootless
+	ServerStorageDirectory string `json:"server_storage_directory"`
+	// ServerStatusFile is where the server will regularly write its status, defaults to status.json in the storage directory
 	ServerStatusFile string `json:"server_status_file"`
-	// ServerSubmissionDirectory is the directory holding the submission spool (RO)
+	// ServerSubmissionDirectory is the directory holding the submission spool, defaults to submission in the storage directory
 	ServerSubmissionDirectory string `json:"server_submission_directory"`
-	// ServerSubmissionSpoolSize is the maximum size of the submission spool (RO)
+	// ServerSubmissionSpoolSize is the maximum size of the submission spool, defaults to 5000
 	ServerSubmissionSpoolSize int `json:"server_submission_spool_size"`
-	// CommandPath is the path to the command being run, defaults to argv[0] (RO)
+	// ReplicationStateDirectory is where the stream replicator keeps its state, defaults to replicator in the storage directory
+	ReplicationStateDirectory string `json:"replication_state_directory"`
+	// BackupDirectory is where reset saves archives when asked to, defaults to <name>-backups next to the storage directory
+	BackupDirectory string `json:"backup_directory"`
+	// AuditDirectory holds the audit log of data sent to and received from the backend, defaults to audit in the storage directory
+	AuditDirectory string `json:"audit_directory"`
+	// CommandPath is the path to the command being run, defaults to argv[0]
 	CommandPath string `json:"command_path"`
-	// ServerStorageDirectory the directory where state is stored (RO)
-	ServerStorageDirectory string `json:"server_storage_directory"`
-	// NatsNkeySeedFile is a path to a nkey seed created at start
+	// NatsNkeySeedFile is a path to a nkey seed created at start, defaults to nats.nkey in the configuration directory
 	NatsNkeySeedFile string `json:"nats_nkey_seed_file"`
-	// NatsCredentialsFile is a path to the nats credentials file holding data received during provisioning
+	// MachinesSigningSeedFile is the node local key used to sign the plugins selected for this node, defaults to machines.seed in the configuration directory
+	MachinesSigningSeedFile string `json:"machines_signing_seed_file"`
+	// NatsCredentialsFile is a path to the nats credentials file holding data received during provisioning, defaults to nats.creds in the configuration directory
 	NatsCredentialsFile string `json:"nats_credentials_file"`
+
+	// Read only below...
+
 	// StartTime the time the process started (RO)
 	StartTime time.Time `json:"start_time"`
+	// ConfigFile is the configuration file of the agent (RO)
+	ConfigFile string `json:"config_file"`
 	// Identity is the identity of the machine room agent
 	Identity string `json:"identity"`
+	// Site is the site the agent belongs to (RO)
+	Site string `json:"site"`
+	// Role is the role of the agent in the site, leader or follower (RO)
+	Role string `json:"role"`
 }
@@ -28,7 +28,6 @@ import (
 	"github.com/choria-io/go-choria/providers/data/golang/choriadata"
 	scout "github.com/choria-io/go-choria/scout/agent/scout"
 	"github.com/choria-io/go-choria/scout/data/scoutdata"
-	machinesmanager "github.com/choria-io/machine-room/internal/autoagents/machinesmanager"
 )
 
 var (
@@ -37,18 +36,17 @@ var (
 		"choria_provision":      provisioner.ChoriaPlugin(),
 		"scout":                 scout.ChoriaPlugin(),
 
-		"watcher_archive":         archivewatcher.ChoriaPlugin(),
-		"watcher_ccm_manifest":    ccmmanifestwatcher.ChoriaPlugin(),
-		"watcher_exec":            execwatcher.ChoriaPlugin(),
-		"watcher_expression":      expressionwatcher.ChoriaPlugin(),
-		"watcher_file":            filewatcher.ChoriaPlugin(),
-		"watcher_kv":              kvwatcher.ChoriaPlugin(),
-		"watcher_metric":          metricwatcher.ChoriaPlugin(),
-		"watcher_nagios":          nagioswatcher.ChoriaPlugin(),
-		"watcher_plugins":         pluginswatcher.ChoriaPlugin(),
-		"watcher_schedule":        schedulewatcher.ChoriaPlugin(),
-		"watcher_timer":           timerwatcher.ChoriaPlugin(),
-		"machine_plugins_manager": machinesmanager.ChoriaPlugin(),
+		"watcher_archive":      archivewatcher.ChoriaPlugin(),
+		"watcher_ccm_manifest": ccmmanifestwatcher.ChoriaPlugin(),
+		"watcher_exec":         execwatcher.ChoriaPlugin(),
+		"watcher_expression":   expressionwatcher.ChoriaPlugin(),
+		"watcher_file":         filewatcher.ChoriaPlugin(),
+		"watcher_kv":           kvwatcher.ChoriaPlugin(),
+		"watcher_metric":       metricwatcher.ChoriaPlugin(),
+		"watcher_nagios":       nagioswatcher.ChoriaPlugin(),
+		"watcher_plugins":      pluginswatcher.ChoriaPlugin(),
+		"watcher_schedule":     schedulewatcher.ChoriaPlugin(),
+		"watcher_timer":        timerwatcher.ChoriaPlugin(),
 
 		"data_choria":  choriadata.ChoriaPlugin(),
 		"data_machine": machinedata.ChoriaPlugin(),
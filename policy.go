@@ -0,0 +1,662 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/go-choria/choria"
+	srcfg "github.com/choria-io/stream-replicator/config"
+	"github.com/ghodss/yaml"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// site stream holding messages that passed the data policy, replicated to the backend instead of the original streams
+	outboundStream        = "OUTBOUND"
+	outboundSubjectPrefix = "machine_room.outbound."
+
+	// durable consumer on the original streams used to apply the data policy
+	dataPolicyConsumer = "machine_room_policy"
+
+	dataPolicyActionDrop  = "drop"
+	dataPolicyActionStrip = "strip"
+	dataPolicyActionHash  = "hash"
+
+	dataPolicyReloadInterval = 30 * time.Second
+	dataPolicyStatusInterval = 10 * time.Second
+
+	// size of the site local secret hashed values are keyed with
+	dataPolicyKeySize = 32
+)
+
+// dataPolicy is the customer owned policy restricting what data leaves the site
+type dataPolicy struct {
+	Rules []*dataPolicyRule `json:"rules"`
+}
+
+// dataPolicyRule applies an action to messages matching the streams and subjects, all messages match when both are empty
+type dataPolicyRule struct {
+	// Name identifies the rule in the status output
+	Name string `json:"name"`
+	// Streams are the site stream names this rule applies to
+	Streams []string `json:"streams"`
+	// Subjects are subjects, with wildcards, this rule applies to
+	Subjects []string `json:"subjects"`
+	// Action is one of drop, strip or hash
+	Action string `json:"action"`
+	// Fields are dot separated paths in the JSON payload for strip and hash, * matches any key
+	Fields []string `json:"fields"`
+}
+
+// dataPolicyStatus is written to the storage directory by the leader and shown by the status command
+type dataPolicyStatus struct {
+	Updated time.Time                        `json:"updated"`
+	File    string                           `json:"file"`
+	Rules   []*dataPolicyRuleStatus          `json:"rules"`
+	Streams map[string]*dataPolicyStreamStat `json:"streams"`
+	Error   string                           `json:"error,omitempty"`
+}
+
+type dataPolicyRuleStatus struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	Matched uint64 `json:"matched"`
+}
+
+type dataPolicyStreamStat struct {
+	Forwarded uint64 `json:"forwarded"`
+	Modified  uint64 `json:"modified"`
+	Dropped   uint64 `json:"dropped"`
+	Errors    uint64 `json:"errors"`
+}
+
+func loadDataPolicy(file string) (*dataPolicy, error) {
+	pb, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &dataPolicy{}
+	err = yaml.Unmarshal(pb, policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data policy: %w", err)
+	}
+
+	for i, r := range policy.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		switch r.Action {
+		case dataPolicyActionDrop:
+		case dataPolicyActionStrip, dataPolicyActionHash:
+			if len(r.Fields) == 0 {
+				return nil, fmt.Errorf("%s: %s requires fields", r.Name, r.Action)
+			}
+		default:
+			return nil, fmt.Errorf("%s: invalid action %q", r.Name, r.Action)
+		}
+
+		for _, s := range r.Streams {
+			if !slices.Contains(upstreamStreams, s) {
+				return nil, fmt.Errorf("%s: data policies do not apply to stream %s", r.Name, s)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+func readDataPolicyStatus(opts *Options) (*dataPolicyStatus, error) {
+	sf := dataPolicyStatusFile(opts)
+	if !choria.FileExist(sf) {
+		return nil, nil
+	}
+
+	sj, err := os.ReadFile(sf)
+	if err != nil {
+		return nil, err
+	}
+
+	var status dataPolicyStatus
+	err = json.Unmarshal(sj, &status)
+	if err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+func dataPolicyStatusFile(opts *Options) string {
+	return opts.ServerStorageDirectory + "/" + defaultDataPolicyStatusFile
+}
+
+// dataPolicyKey loads the site local secret used to hash values, creating it when needed, without it hashes of guessable
+// values like hostnames can be reversed by the backend
+func dataPolicyKey(opts *Options) ([]byte, error) {
+	kf := filepath.Join(opts.ConfigurationDirectory, defaultDataPolicyKeyFile)
+
+	if !choria.FileExist(kf) {
+		key := make([]byte, dataPolicyKeySize)
+		_, err := rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeFileAtomic(kf, []byte(hex.EncodeToString(key)), 0400)
+		if err != nil {
+			return nil, err
+		}
+
+		return key, nil
+	}
+
+	kb, err := os.ReadFile(kf)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(string(bytes.TrimSpace(kb)))
+	if err != nil || len(key) != dataPolicyKeySize {
+		return nil, fmt.Errorf("invalid data policy key in %s", kf)
+	}
+
+	return key, nil
+}
+
+func (r *dataPolicyRule) matches(stream string, subject string) bool {
+	if len(r.Streams) > 0 && !slices.Contains(r.Streams, stream) {
+		return false
+	}
+
+	if len(r.Subjects) == 0 {
+		return true
+	}
+
+	for _, s := range r.Subjects {
+		if subjectMatches(s, subject) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subjectMatches matches subject against a pattern using NATS wildcards
+func subjectMatches(pattern string, subject string) bool {
+	pt := strings.Split(pattern, ".")
+	st := strings.Split(subject, ".")
+
+	for i, p := range pt {
+		switch {
+		case p == ">":
+			return len(st) > i
+		case i >= len(st):
+			return false
+		case p != "*" && p != st[i]:
+			return false
+		}
+	}
+
+	return len(pt) == len(st)
+}
+
+// dataPolicyEngine applies the policy and counts every decision
+type dataPolicyEngine struct {
+	file     string
+	key      []byte
+	policy   *dataPolicy
+	modified time.Time
+	status   *dataPolicyStatus
+	mu       sync.Mutex
+}
+
+func newDataPolicyEngine(file string, key []byte) (*dataPolicyEngine, error) {
+	e := &dataPolicyEngine{
+		file:   file,
+		key:    key,
+		status: &dataPolicyStatus{File: file, Streams: map[string]*dataPolicyStreamStat{}},
+	}
+
+	err := e.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range upstreamStreams {
+		e.status.Streams[s] = &dataPolicyStreamStat{}
+	}
+
+	return e, nil
+}
+
+// reload loads the policy when the file changed, an invalid policy keeps the previous one in place
+func (e *dataPolicyEngine) reload() error {
+	nfo, err := os.Stat(e.file)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if nfo.ModTime().Equal(e.modified) {
+		return nil
+	}
+
+	policy, err := loadDataPolicy(e.file)
+	if err != nil {
+		e.status.Error = err.Error()
+		return err
+	}
+
+	e.policy = policy
+	e.modified = nfo.ModTime()
+	e.status.Error = ""
+
+	// counters are kept for rules that did not change name
+	var rules []*dataPolicyRuleStatus
+	for _, r := range policy.Rules {
+		rs := &dataPolicyRuleStatus{Name: r.Name, Action: r.Action}
+		for _, old := range e.status.Rules {
+			if old.Name == r.Name && old.Action == r.Action {
+				rs.Matched = old.Matched
+			}
+		}
+		rules = append(rules, rs)
+	}
+	e.status.Rules = rules
+
+	return nil
+}
+
+// apply evaluates all rules in order, returns the data to forward or false when the message is dropped
+func (e *dataPolicyEngine) apply(stream string, subject string, data []byte) ([]byte, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	stat, ok := e.status.Streams[stream]
+	if !ok {
+		stat = &dataPolicyStreamStat{}
+		e.status.Streams[stream] = stat
+	}
+
+	var doc *policyDocument
+	modified := false
+
+	for i, r := range e.policy.Rules {
+		if !r.matches(stream, subject) {
+			continue
+		}
+
+		e.status.Rules[i].Matched++
+
+		if r.Action == dataPolicyActionDrop {
+			stat.Dropped++
+			return nil, false
+		}
+
+		if doc == nil {
+			var err error
+			doc, err = decodePolicyDocument(data)
+			if err != nil {
+				// data that cannot be inspected is never forwarded when a rule would modify it
+				stat.Errors++
+				stat.Dropped++
+				return nil, false
+			}
+		}
+
+		for _, f := range r.Fields {
+			if applyPolicyField(doc.doc, strings.Split(f, "."), r.Action, e.key) {
+				modified = true
+			}
+		}
+	}
+
+	if !modified {
+		stat.Forwarded++
+		return data, true
+	}
+
+	out, err := doc.encode()
+	if err != nil {
+		stat.Errors++
+		stat.Dropped++
+		return nil, false
+	}
+
+	stat.Modified++
+	stat.Forwarded++
+
+	return out, true
+}
+
+func (e *dataPolicyEngine) saveStatus(file string) error {
+	e.mu.Lock()
+	e.status.Updated = time.Now().UTC()
+	sj, err := json.Marshal(e.status)
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, sj, 0600)
+}
+
+// applyPolicyField strips or hashes the value at path using key, returns true when a value was changed
+func applyPolicyField(data map[string]any, path []string, action string, key []byte) bool {
+	changed := false
+
+	for k, v := range data {
+		if path[0] != "*" && path[0] != k {
+			continue
+		}
+
+		if len(path) > 1 {
+			child, ok := v.(map[string]any)
+			if ok && applyPolicyField(child, path[1:], action, key) {
+				changed = true
+			}
+			continue
+		}
+
+		switch action {
+		case dataPolicyActionStrip:
+			delete(data, k)
+		case dataPolicyActionHash:
+			data[k] = hashPolicyValue(v, key)
+		}
+		changed = true
+	}
+
+	return changed
+}
+
+// hashPolicyValue is a keyed hash of v, the same value hashes the same on a site so it can still be correlated
+func hashPolicyValue(v any, key []byte) string {
+	var b []byte
+	switch val := v.(type) {
+	case string:
+		b = []byte(val)
+	default:
+		b, _ = json.Marshal(val)
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// policyDocument is the JSON document rules apply to, registration data is compressed inside the message and rules apply to the unpacked inventory
+type policyDocument struct {
+	outer      map[string]any
+	inner      map[string]any
+	compressed bool
+	doc        map[string]any
+}
+
+func decodePolicyDocument(data []byte) (*policyDocument, error) {
+	var outer map[string]any
+	err := json.Unmarshal(data, &outer)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &policyDocument{outer: outer, doc: outer}
+
+	s, ok := outer["data"].(string)
+	if !ok {
+		return d, nil
+	}
+
+	var inner map[string]any
+	if json.Unmarshal([]byte(s), &inner) != nil {
+		return d, nil
+	}
+
+	var content map[string]any
+
+	switch c := inner["zcontent"].(type) {
+	case string:
+		gz, err := base64.StdEncoding.DecodeString(c)
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(gz))
+		if err != nil {
+			return nil, err
+		}
+		cj, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(cj, &content)
+		if err != nil {
+			return nil, err
+		}
+		d.compressed = true
+
+	default:
+		content, ok = inner["content"].(map[string]any)
+		if !ok {
+			return d, nil
+		}
+	}
+
+	d.inner = inner
+	d.doc = content
+
+	return d, nil
+}
+
+func (d *policyDocument) encode() ([]byte, error) {
+	if d.inner == nil {
+		return json.Marshal(d.outer)
+	}
+
+	if d.compressed {
+		cj, err := json.Marshal(d.doc)
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err = w.Write(cj)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		d.inner["zcontent"] = base64.StdEncoding.EncodeToString(buf.Bytes())
+	} else {
+		d.inner["content"] = d.doc
+	}
+
+	ij, err := json.Marshal(d.inner)
+	if err != nil {
+		return nil, err
+	}
+	d.outer["data"] = string(ij)
+
+	return json.Marshal(d.outer)
+}
+
+func outboundSubject(stream string) string {
+	return outboundSubjectPrefix + strings.ToLower(stream) + "."
+}
+
+// applyDataPolicy starts applying the data policy to the upstream replications in streams, including additional upstream
+// streams, they are changed to replicate from the OUTBOUND stream
+func (b *broker) applyDataPolicy(ctx context.Context, wg *sync.WaitGroup, streams []*srcfg.Stream) error {
+	if !choria.FileExist(b.opts.DataPolicyFile) {
+		return nil
+	}
+
+	key, err := dataPolicyKey(b.opts)
+	if err != nil {
+		return fmt.Errorf("could not load data policy key: %w", err)
+	}
+
+	engine, err := newDataPolicyEngine(b.opts.DataPolicyFile, key)
+	if err != nil {
+		return err
+	}
+
+	b.log.Warnf("Applying data policy %s to outbound data", b.opts.DataPolicyFile)
+
+	upstream := slices.Clone(upstreamStreams)
+	for _, s := range b.opts.AdditionalStreams {
+		if s.Direction == ReplicateUpstream {
+			upstream = append(upstream, s.Name)
+		}
+	}
+
+	for _, s := range streams {
+		if !slices.Contains(upstream, s.Name) {
+			continue
+		}
+
+		// the worker removes what the replicator would have and only consumes what it would have, the replicator then
+		// removes the outbound prefix and adds its own
+		remove := s.TargetRemoveString
+		filter := s.FilterSubject
+		source := s.Stream
+
+		s.Stream = outboundStream
+		s.FilterSubject = outboundSubject(source) + ">"
+		s.TargetRemoveString = outboundSubject(source)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			backoff.Default.For(ctx, func(try int) error {
+				err := b.runDataPolicy(ctx, engine, source, filter, remove)
+				if err != nil && ctx.Err() == nil {
+					b.log.Errorf("Data policy for %s failed: %v", source, err)
+					return err
+				}
+
+				return nil
+			})
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		reload := time.NewTicker(dataPolicyReloadInterval)
+		defer reload.Stop()
+		status := time.NewTicker(dataPolicyStatusInterval)
+		defer status.Stop()
+
+		for {
+			select {
+			case <-reload.C:
+				err := engine.reload()
+				if err != nil {
+					b.log.Errorf("Could not reload data policy, keeping the previous policy: %v", err)
+				}
+
+			case <-status.C:
+				err := engine.saveStatus(dataPolicyStatusFile(b.opts))
+				if err != nil {
+					b.log.Errorf("Could not save data policy status: %v", err)
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// runDataPolicy consumes the messages in stream matching filter, applies the policy and publishes what is allowed into the OUTBOUND stream
+func (b *broker) runDataPolicy(ctx context.Context, engine *dataPolicyEngine, stream string, filter string, remove string) error {
+	return b.consumeSiteStream(ctx, fmt.Sprintf("data_policy_%s", strings.ToLower(stream)), stream, dataPolicyConsumer, filter, func(js nats.JetStreamContext, msgs []*nats.Msg) error {
+		for _, msg := range msgs {
+			data, forward := engine.apply(stream, msg.Subject, msg.Data)
+			if !forward {
+				msg.Ack()
+				continue
+			}
+
+			subj := msg.Subject
+			if remove != "" {
+				subj = strings.ReplaceAll(subj, remove, "")
+			}
+
+			out := nats.NewMsg(outboundSubject(stream) + subj)
+			out.Header = msg.Header
+			out.Data = data
+
+			_, err := js.PublishMsg(out)
+			if err != nil {
+				msg.Nak()
+				return err
+			}
+
+			msg.Ack()
+		}
+
+		return nil
+	})
+}
+
+func (b *broker) createOutboundStream(ctx context.Context, nc *nats.Conn) error {
+	if !choria.FileExist(b.opts.DataPolicyFile) {
+		return nil
+	}
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+
+	_, err = js.StreamInfo(outboundStream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:     outboundStream,
+			Subjects: []string{outboundSubjectPrefix + ">"},
+			MaxAge:   24 * time.Hour,
+			Storage:  nats.FileStorage,
+			Replicas: b.replicas(),
+		})
+		if err != nil {
+			return err
+		}
+		b.log.Infof("Created %s stream", outboundStream)
+	}
+
+	return err
+}
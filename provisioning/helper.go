@@ -0,0 +1,315 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package provisioning implements the Choria Provisioner helper protocol for Machine Room sites.
+//
+// Choria Provisioner runs a helper for every node being provisioned, passing a JSON request on STDIN and reading the
+// reply from STDOUT. The Helper in this package finds the customer a node belongs to in a Registry, decides its
+// role and produces the configuration Machine Room needs.
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// machine room configuration settings produced by the helper
+const (
+	ConfigKeySite        = "machine_room.site"
+	ConfigKeyRole        = "machine_room.role"
+	ConfigKeySourceHost  = "machine_room.source.host"
+	ConfigKeyBrokerPeers = "machine_room.broker.peers"
+	ConfigKeyOffline     = "machine_room.offline"
+
+	// DefaultServerValidity is how long server tokens issued during provisioning are valid for
+	DefaultServerValidity = 365 * 24 * time.Hour
+)
+
+// Request is the request Choria Provisioner sends to the helper
+type Request struct {
+	// Identity is the identity of the node being provisioned
+	Identity string `json:"identity"`
+	// CSR is set when the node uses x509 certificates
+	CSR *CSR `json:"csr,omitempty"`
+	// Inventory is the JSON encoded inventory of the node, see DecodeInventory
+	Inventory string `json:"inventory"`
+	// JWT holds the claims of the provisioning token the node used
+	JWT *ProvisioningClaims `json:"jwt,omitempty"`
+	// ED25519PubKey is the key of the node and where its credentials will be stored
+	ED25519PubKey *ED25519PubKey `json:"ed25519_pubkey,omitempty"`
+}
+
+// CSR is a certificate signing request created by the node
+type CSR struct {
+	CSR       string `json:"csr"`
+	PublicKey string `json:"public_key"`
+	SSLDir    string `json:"ssldir"`
+}
+
+// ED25519PubKey is the ed25519 public key of the node being provisioned
+type ED25519PubKey struct {
+	PublicKey string `json:"public_key"`
+	Directory string `json:"directory"`
+	Signature string `json:"signature"`
+}
+
+// ProvisioningClaims are the claims from the provisioning token a node used
+type ProvisioningClaims struct {
+	Token      string     `json:"token,omitempty"`
+	URLs       string     `json:"urls,omitempty"`
+	SRVDomain  string     `json:"srv_domain,omitempty"`
+	Default    bool       `json:"default,omitempty"`
+	Secure     bool       `json:"secure,omitempty"`
+	Extensions Extensions `json:"extensions"`
+	ExpiresAt  int64      `json:"exp,omitempty"`
+}
+
+// Extensions are the Machine Room specific claims in provisioning tokens
+type Extensions struct {
+	// Customer is the customer in the registry the node belongs to
+	Customer string `json:"customer"`
+	// Role is the role the token was issued for, used to decide the Machine Room role of the node
+	Role string `json:"role,omitempty"`
+	// Site restricts the token to a site of the customer
+	Site string `json:"site,omitempty"`
+}
+
+// Reply is the reply sent back to Choria Provisioner
+type Reply struct {
+	// Defer asks the provisioner to try again later
+	Defer bool `json:"defer"`
+	// Msg is a message describing the outcome
+	Msg string `json:"msg"`
+	// Certificate is the signed x509 certificate when the node uses x509
+	Certificate string `json:"certificate"`
+	// CA is the x509 CA when the node uses x509
+	CA string `json:"ca"`
+	// Configuration is the configuration written to the node
+	Configuration map[string]string `json:"configuration"`
+	// ServerClaims are used to issue the server token of the node
+	ServerClaims *ServerClaims `json:"server_claims"`
+}
+
+// ServerClaims are the claims of the server token issued to the node
+type ServerClaims struct {
+	// Validity is how long the token is valid for in seconds
+	Validity int64 `json:"exp"`
+	// PublishSubjects are subjects the node may publish to
+	PublishSubjects []string `json:"pub_subjects"`
+	// Permissions are the permissions of the node
+	Permissions *ServerPermissions `json:"permissions"`
+}
+
+// ServerPermissions are the permissions Machine Room nodes need
+type ServerPermissions struct {
+	Streams     bool `json:"streams"`
+	Submission  bool `json:"submission"`
+	ServiceHost bool `json:"service_host"`
+}
+
+// ParseRequest parses a request as received from Choria Provisioner, recorded requests can be parsed to test a helper
+func ParseRequest(data []byte) (*Request, error) {
+	var req Request
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	return &req, nil
+}
+
+// DecodeInventory decodes the node inventory into target
+func (r *Request) DecodeInventory(target any) error {
+	return json.Unmarshal([]byte(r.Inventory), target)
+}
+
+func (r *Request) validate() error {
+	switch {
+	case r.Identity == "":
+		return errors.New("no identity received in request")
+	case r.ED25519PubKey == nil:
+		return errors.New("no ed25519 public key received")
+	case r.ED25519PubKey.Directory == "":
+		return errors.New("no ed25519 directory received")
+	case r.JWT == nil:
+		return errors.New("no provisioning token claims received")
+	case r.JWT.Extensions.Customer == "":
+		return errors.New("provisioning token has no customer")
+	}
+
+	return nil
+}
+
+// Helper produces configuration for nodes being provisioned
+type Helper struct {
+	// Registry finds the customer a node belongs to
+	Registry Registry
+	// Roles decides the role of nodes, DefaultRoleAssigner when not set
+	Roles RoleAssigner
+	// IssuerPublicKey is the hex encoded public key of the Organization Issuer
+	IssuerPublicKey string
+	// ServerValidity is how long server tokens are valid, DefaultServerValidity when not set
+	ServerValidity time.Duration
+	// LogLevel is the log level nodes use, warn when not set
+	LogLevel string
+	// Configure is called after the configuration was created allowing it to be changed
+	Configure func(ctx context.Context, req *Request, customer *Customer, reply *Reply) error
+	// RecordDirectory saves every request and reply when set, recorded requests can be replayed using ParseRequest
+	RecordDirectory string
+}
+
+// Run reads a request from in and writes the reply to out, this is the entry point for helper executables
+func (h *Helper) Run(ctx context.Context, in io.Reader, out io.Writer) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	var reply *Reply
+
+	req, err := ParseRequest(data)
+	if err != nil {
+		reply = deferReply(err)
+	} else {
+		h.record(req.Identity, "request", data)
+		reply = h.Process(ctx, req)
+	}
+
+	rj, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	if req != nil {
+		h.record(req.Identity, "reply", rj)
+	}
+
+	_, err = fmt.Fprintln(out, string(rj))
+
+	return err
+}
+
+// Process creates the reply for req, failures result in the provisioner trying again later
+func (h *Helper) Process(ctx context.Context, req *Request) *Reply {
+	err := req.validate()
+	if err != nil {
+		return deferReply(err)
+	}
+
+	if h.Registry == nil {
+		return deferReply(errors.New("no customer registry configured"))
+	}
+
+	customer, err := h.Registry.Customer(ctx, req.JWT.Extensions.Customer)
+	if err != nil {
+		return deferReply(err)
+	}
+
+	if req.JWT.Extensions.Site != "" && req.JWT.Extensions.Site != customer.Site {
+		return deferReply(fmt.Errorf("token is for site %s but customer %s is in site %s", req.JWT.Extensions.Site, req.JWT.Extensions.Customer, customer.Site))
+	}
+
+	roles := h.Roles
+	if roles == nil {
+		roles = DefaultRoleAssigner{}
+	}
+
+	role, err := roles.AssignRole(ctx, req, customer)
+	if err != nil {
+		return deferReply(err)
+	}
+
+	reply := &Reply{
+		Msg:           "Done",
+		Configuration: h.configuration(req, customer, role),
+		ServerClaims:  h.serverClaims(),
+	}
+
+	if h.Configure != nil {
+		err = h.Configure(ctx, req, customer, reply)
+		if err != nil {
+			return deferReply(err)
+		}
+	}
+
+	return reply
+}
+
+func (h *Helper) configuration(req *Request, customer *Customer, role string) map[string]string {
+	loglevel := h.LogLevel
+	if loglevel == "" {
+		loglevel = "warn"
+	}
+
+	cfg := map[string]string{
+		"identity":                             req.Identity,
+		"loglevel":                             loglevel,
+		"plugin.choria.server.provision":       "false",
+		"plugin.choria.middleware_hosts":       customer.Brokers,
+		"plugin.security.issuer.names":         "choria",
+		"plugin.security.issuer.choria.public": h.IssuerPublicKey,
+		"plugin.security.provider":             "choria",
+		"plugin.security.choria.token_file":    filepath.Join(req.ED25519PubKey.Directory, "server.jwt"),
+		"plugin.security.choria.seed_file":     filepath.Join(req.ED25519PubKey.Directory, "server.seed"),
+		ConfigKeySite:                          customer.Site,
+		ConfigKeyRole:                          role,
+	}
+
+	if role == RoleLeader {
+		if customer.Offline {
+			cfg[ConfigKeyOffline] = "true"
+		} else {
+			cfg[ConfigKeySourceHost] = customer.Source.Host
+		}
+
+		// a site with more than one leader clusters them
+		if len(customer.Leaders) > 1 {
+			cfg[ConfigKeyBrokerPeers] = strings.Join(customer.Leaders, ",")
+		}
+	}
+
+	return cfg
+}
+
+func (h *Helper) serverClaims() *ServerClaims {
+	validity := h.ServerValidity
+	if validity == 0 {
+		validity = DefaultServerValidity
+	}
+
+	return &ServerClaims{
+		Validity:        int64(validity.Seconds()),
+		PublishSubjects: []string{">"},
+		Permissions: &ServerPermissions{
+			Streams:     true,
+			Submission:  true,
+			ServiceHost: true,
+		},
+	}
+}
+
+func (h *Helper) record(identity string, kind string, data []byte) {
+	if h.RecordDirectory == "" || identity == "" {
+		return
+	}
+
+	// recording is a debugging aid and never fails provisioning
+	os.WriteFile(filepath.Join(h.RecordDirectory, fmt.Sprintf("%s-%s.json", filepath.Base(identity), kind)), data, 0600)
+}
+
+func deferReply(err error) *Reply {
+	return &Reply{
+		Defer:         true,
+		Msg:           fmt.Sprintf("Provisioning failed: %v", err),
+		Configuration: map[string]string{},
+		ServerClaims:  &ServerClaims{},
+	}
+}
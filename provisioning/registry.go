@@ -0,0 +1,91 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ErrCustomerNotFound is returned by registries for unknown customers
+var ErrCustomerNotFound = errors.New("customer not found")
+
+// Customer is what the SaaS knows about a customer site
+type Customer struct {
+	// Brokers are the site brokers nodes connect to, in plugin.choria.middleware_hosts format
+	Brokers string `json:"brokers"`
+	// Site is the name of the customer site
+	Site string `json:"site"`
+	// Source is where the site leaders replicate data to and from
+	Source struct {
+		Host string `json:"host"`
+	} `json:"source"`
+	// Offline sites have no connection to the backend, their leaders exchange data using bundles instead of replicating it
+	Offline bool `json:"offline,omitempty"`
+	// Leaders are the identities of the site leaders, more than one forms a cluster of leaders
+	Leaders []string `json:"leaders,omitempty"`
+	// LeaderRoles are provisioning token roles that make a node a leader
+	LeaderRoles []string `json:"leader_roles,omitempty"`
+}
+
+// Registry finds customers by name
+type Registry interface {
+	Customer(ctx context.Context, name string) (*Customer, error)
+}
+
+// FileRegistry reads customers from a JSON file holding a map of customer names to Customer, the file is read on every lookup
+type FileRegistry struct {
+	File string
+}
+
+// Customer implements Registry
+func (r *FileRegistry) Customer(_ context.Context, name string) (*Customer, error) {
+	data, err := os.ReadFile(r.File)
+	if err != nil {
+		return nil, err
+	}
+
+	customers := map[string]*Customer{}
+	err = json.Unmarshal(data, &customers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid customer registry %s: %w", r.File, err)
+	}
+
+	customer, ok := customers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrCustomerNotFound, name)
+	}
+
+	return customer, nil
+}
+
+// KVRegistry reads customers from a NATS Key-Value bucket with a JSON encoded Customer stored under the customer name
+type KVRegistry struct {
+	KV nats.KeyValue
+}
+
+// Customer implements Registry
+func (r *KVRegistry) Customer(_ context.Context, name string) (*Customer, error) {
+	entry, err := r.KV.Get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrCustomerNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var customer Customer
+	err = json.Unmarshal(entry.Value(), &customer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry entry for %s: %w", name, err)
+	}
+
+	return &customer, nil
+}
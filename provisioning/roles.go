@@ -0,0 +1,45 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioning
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Machine Room roles
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// RoleAssigner decides the Machine Room role of a node being provisioned
+type RoleAssigner interface {
+	AssignRole(ctx context.Context, req *Request, customer *Customer) (string, error)
+}
+
+// DefaultRoleAssigner makes nodes listed in Customer.Leaders, or using a token with a role listed in
+// Customer.LeaderRoles, leaders and all other nodes followers
+type DefaultRoleAssigner struct{}
+
+// AssignRole implements RoleAssigner
+func (DefaultRoleAssigner) AssignRole(_ context.Context, req *Request, customer *Customer) (string, error) {
+	leader := slices.Contains(customer.Leaders, req.Identity)
+	if !leader && req.JWT != nil && req.JWT.Extensions.Role != "" {
+		leader = slices.Contains(customer.LeaderRoles, req.JWT.Extensions.Role)
+	}
+
+	if !leader {
+		return RoleFollower, nil
+	}
+
+	// offline sites exchange data using bundles so their leaders do not replicate from a source
+	if customer.Source.Host == "" && !customer.Offline {
+		return "", fmt.Errorf("customer site %s has no source host for leaders", customer.Site)
+	}
+
+	return RoleLeader, nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package provisioning
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/choria-io/tokens"
+)
+
+// TokenRequest describes a provisioning token to issue to a customer
+type TokenRequest struct {
+	// Token is the shared secret configured in the provisioner
+	Token string
+	// URLs are the provisioning brokers
+	URLs []string
+	// SRVDomain is used to find the provisioning brokers when URLs are not set
+	SRVDomain string
+	// Insecure disables TLS when connecting to the provisioning brokers
+	Insecure bool
+	// Validity is how long the token can be used to provision nodes
+	Validity time.Duration
+	// Extensions are the Machine Room claims the helper uses
+	Extensions Extensions
+}
+
+func (r *TokenRequest) validate() error {
+	switch {
+	case r.Token == "":
+		return errors.New("a provisioner token is required")
+	case len(r.URLs) == 0 && r.SRVDomain == "":
+		return errors.New("provisioning broker urls or a srv domain is required")
+	case r.Validity <= 0:
+		return errors.New("a validity is required")
+	case r.Extensions.Customer == "":
+		return errors.New("a customer is required")
+	}
+
+	return nil
+}
+
+// IssueToken creates a provisioning token signed by the Organization Issuer
+func IssueToken(req *TokenRequest, issuer ed25519.PrivateKey) (string, error) {
+	err := req.validate()
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := tokens.NewProvisioningClaims(true, !req.Insecure, req.Token, "", "", req.URLs, req.SRVDomain, "", "", "", req.Validity)
+	if err != nil {
+		return "", err
+	}
+
+	ext, err := req.Extensions.mapClaims()
+	if err != nil {
+		return "", err
+	}
+
+	claims.Extensions = ext
+	claims.ProvDefault = true
+	claims.ProtoV2 = true
+	claims.AllowUpdate = true
+
+	return tokens.SignToken(claims, issuer)
+}
+
+// ParseExtensions extracts the Machine Room claims from the extensions of a provisioning token
+func ParseExtensions(ext map[string]any) (Extensions, error) {
+	var res Extensions
+
+	j, err := json.Marshal(ext)
+	if err != nil {
+		return res, err
+	}
+
+	err = json.Unmarshal(j, &res)
+
+	return res, err
+}
+
+func (e Extensions) mapClaims() (map[string]any, error) {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	res := map[string]any{}
+	err = json.Unmarshal(j, &res)
+
+	return res, err
+}
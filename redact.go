@@ -0,0 +1,164 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const redactedValue = "[REDACTED]"
+
+// keys matching this in AdditionalFacts output are always redacted
+var defaultRedactedKeys = regexp.MustCompile(`(?i)(password|passwd|secret|token|seed|private_?key|credential|api_?key)`)
+
+// FactsRedactor modifies the output of AdditionalFacts before it leaves the node, typically to remove secrets
+type FactsRedactor func(facts map[string]any) map[string]any
+
+// RedactKeys is a FactsRedactor that replaces the values at the given dot separated paths, like db.password
+func RedactKeys(paths ...string) FactsRedactor {
+	return func(facts map[string]any) map[string]any {
+		for _, path := range paths {
+			redactPath(facts, strings.Split(path, "."))
+		}
+
+		return facts
+	}
+}
+
+// RedactMatchingKeys is a FactsRedactor that replaces the values of all keys, at any depth, matching re
+func RedactMatchingKeys(re *regexp.Regexp) FactsRedactor {
+	return func(facts map[string]any) map[string]any {
+		redactMatching(facts, re)
+		return facts
+	}
+}
+
+func redactPath(data map[string]any, path []string) {
+	v, ok := data[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		data[path[0]] = redactedValue
+		return
+	}
+
+	child, ok := v.(map[string]any)
+	if ok {
+		redactPath(child, path[1:])
+	}
+}
+
+func redactMatching(data any, re *regexp.Regexp) {
+	switch d := data.(type) {
+	case map[string]any:
+		for k, v := range d {
+			if re.MatchString(k) {
+				d[k] = redactedValue
+				continue
+			}
+			redactMatching(v, re)
+		}
+
+	case []any:
+		for _, v := range d {
+			redactMatching(v, re)
+		}
+	}
+}
+
+// redactAdditionalFacts applies the default rules followed by any configured in options, the facts are first turned into
+// plain maps and slices by a JSON round trip so typed values are redacted too and the caller's data is not modified
+func redactAdditionalFacts(opts Options, facts map[string]any) (map[string]any, error) {
+	fj, err := json.Marshal(facts)
+	if err != nil {
+		return nil, err
+	}
+
+	facts = map[string]any{}
+	err = json.Unmarshal(fj, &facts)
+	if err != nil {
+		return nil, err
+	}
+
+	facts = RedactMatchingKeys(defaultRedactedKeys)(facts)
+
+	for _, r := range opts.FactsRedactors {
+		if facts == nil {
+			break
+		}
+		facts = r(facts)
+	}
+
+	return facts, nil
+}
+
+// tokenSummary is what facts hold about a JWT, the token itself is never included
+type tokenSummary struct {
+	Issuer      string         `json:"issuer,omitempty"`
+	Subject     string         `json:"subject,omitempty"`
+	Expires     time.Time      `json:"expires,omitzero"`
+	Expired     bool           `json:"expired"`
+	Fingerprint string         `json:"fingerprint"`
+	Extensions  map[string]any `json:"extensions,omitempty"`
+}
+
+// tokenFingerprint allows correlating a token without exposing it
+func tokenFingerprint(token []byte) string {
+	sum := sha256.Sum256(token)
+	return hex.EncodeToString(sum[:])
+}
+
+// factsOptions is the subset of Options that is safe to publish in facts
+type factsOptions struct {
+	Name                 string        `json:"name"`
+	Version              string        `json:"version"`
+	Contact              string        `json:"contact"`
+	MachineSigningKey    string        `json:"machine_signing_key"`
+	FactsRefreshInterval time.Duration `json:"facts_refresh_interval"`
+	ConfigBucketPrefix   string        `json:"config_bucket_prefix,omitempty"`
+	AllowUnsignedConfig  bool          `json:"allow_unsigned_config,omitempty"`
+	NoStandardFacts      bool          `json:"no_standard_facts,omitempty"`
+	NoMemoryFacts        bool          `json:"no_memory_facts,omitempty"`
+	NoSwapFacts          bool          `json:"no_swap_facts,omitempty"`
+	NoCPUFacts           bool          `json:"no_cpu_facts,omitempty"`
+	NoDiskFacts          bool          `json:"no_disk_facts,omitempty"`
+	NoHostFacts          bool          `json:"no_host_facts,omitempty"`
+	NoNetworkFacts       bool          `json:"no_network_facts,omitempty"`
+	NoExternalFacts      bool          `json:"no_external_facts,omitempty"`
+	Rootless             bool          `json:"rootless,omitempty"`
+	StartTime            time.Time     `json:"start_time"`
+	Identity             string        `json:"identity"`
+}
+
+// factsSafe is a copy of the options that can be shared outside the node
+func (o *Options) factsSafe() factsOptions {
+	return factsOptions{
+		Name:                 o.Name,
+		Version:              o.Version,
+		Contact:              o.Contact,
+		MachineSigningKey:    o.MachineSigningKey,
+		FactsRefreshInterval: o.FactsRefreshInterval,
+		ConfigBucketPrefix:   o.ConfigBucketPrefix,
+		AllowUnsignedConfig:  o.AllowUnsignedConfig,
+		NoStandardFacts:      o.NoStandardFacts,
+		NoMemoryFacts:        o.NoMemoryFacts,
+		NoSwapFacts:          o.NoSwapFacts,
+		NoCPUFacts:           o.NoCPUFacts,
+		NoDiskFacts:          o.NoDiskFacts,
+		NoHostFacts:          o.NoHostFacts,
+		NoNetworkFacts:       o.NoNetworkFacts,
+		NoExternalFacts:      o.NoExternalFacts,
+		Rootless:             o.Rootless,
+		StartTime:            o.StartTime,
+		Identity:             o.Identity,
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/go-choria/choria"
+)
+
+const (
+	// event kind published when renewing the server token
+	eventTokenRenewal = "token_renewal"
+
+	tokenRenewalStarted   = "started"
+	tokenRenewalCompleted = "completed"
+	tokenRenewalFailed    = "failed"
+)
+
+// tokenRenewal is stored on disk while a renewal is in progress
+type tokenRenewal struct {
+	Started     time.Time `json:"started"`
+	Expires     time.Time `json:"expires"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// tokenRenewalEvent is the data of token_renewal events
+type tokenRenewalEvent struct {
+	State           string    `json:"state"`
+	Identity        string    `json:"identity"`
+	PreviousExpires time.Time `json:"previous_expires,omitzero"`
+	Expires         time.Time `json:"expires,omitzero"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func renewalFile(opts *Options) string {
+	return filepath.Join(opts.ConfigurationDirectory, defaultTokenRenewalFile)
+}
+
+// renewalDirectory holds the configuration and credentials issued by the provisioner until they replace the current ones
+func renewalDirectory(opts *Options) string {
+	return filepath.Join(opts.ConfigurationDirectory, defaultTokenRenewalDirectory)
+}
+
+// renewalOptions are the options used to re-enrol, the new configuration, token and credentials are written to the
+// renewal directory while the seed, nkey, provisioning token and facts are shared with the running agent
+func renewalOptions(opts Options) Options {
+	dir := renewalDirectory(&opts)
+
+	opts.ConfigurationDirectory = dir
+	opts.ConfigFile = filepath.Join(dir, filepath.Base(opts.ConfigFile))
+	opts.ServerJWTFile = filepath.Join(dir, defaultServerJwtFileName)
+	opts.NatsCredentialsFile = filepath.Join(dir, defaultNatsCredentialFile)
+
+	return opts
+}
+
+// renewalFiles are the files issued while re-enrolling and the files used by the agent they replace, the token is last
+// so an interrupted install does not look like a completed renewal
+func renewalFiles(opts *Options) [][2]string {
+	renewal := renewalOptions(*opts)
+
+	return [][2]string{
+		{renewal.ConfigFile, opts.ConfigFile},
+		{renewal.ServerJWTFile, opts.ServerJWTFile},
+	}
+}
+
+// renewalIssued determines if the provisioner issued all the files needed to replace the current credentials
+func renewalIssued(opts *Options) bool {
+	for _, f := range renewalFiles(opts) {
+		if !choria.FileExist(f[0]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func readTokenRenewal(opts *Options) (*tokenRenewal, error) {
+	rj, err := os.ReadFile(renewalFile(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	var renewal tokenRenewal
+	err = json.Unmarshal(rj, &renewal)
+	if err != nil {
+		return nil, err
+	}
+
+	return &renewal, nil
+}
+
+// tokenRenewalPending determines if a renewal was started but the provisioner has not yet issued a new token
+func tokenRenewalPending(opts *Options) bool {
+	if !choria.FileExist(renewalFile(opts)) {
+		return false
+	}
+
+	renewal, err := readTokenRenewal(opts)
+	if err != nil {
+		return false
+	}
+
+	current, err := serverTokenSummary(*opts)
+	if err != nil || current == nil {
+		return false
+	}
+
+	return current.Fingerprint == renewal.Fingerprint
+}
+
+// watchTokenExpiry regularly checks the server token and starts a renewal once it is close to expiry
+func (a *Agent) watchTokenExpiry(ctx context.Context) {
+	if a.opts.DisableTokenRenewal {
+		return
+	}
+
+	a.log.Infof("Renewing the server token %v before it expires", a.opts.TokenRenewBefore)
+
+	ticker := time.NewTicker(defaultTokenRenewCheckInterval)
+	defer ticker.Stop()
+
+	// the same failure is only published once, an expired provisioning token would otherwise be reported every check
+	var failure string
+
+	for {
+		renewed, err := a.checkTokenExpiry(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			a.log.Errorf("Server token renewal failed: %v", err)
+			if err.Error() != failure {
+				failure = err.Error()
+				a.publishTokenRenewal(ctx, tokenRenewalEvent{State: tokenRenewalFailed, Error: failure})
+			}
+		case err == nil:
+			failure = ""
+		}
+		if renewed {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *Agent) checkTokenExpiry(ctx context.Context) (bool, error) {
+	current, err := serverTokenSummary(*a.opts)
+	if err != nil {
+		return false, fmt.Errorf("could not read server token: %w", err)
+	}
+	if current == nil || current.Expires.IsZero() {
+		return false, nil
+	}
+
+	remaining := time.Until(current.Expires)
+	if remaining > a.opts.TokenRenewBefore {
+		a.log.Debugf("Server token expires in %v, not renewing", remaining.Round(time.Second))
+		return false, nil
+	}
+
+	prov, err := provisioningTokenSummary(*a.opts)
+	switch {
+	case err != nil:
+		return false, fmt.Errorf("could not read provisioning token: %w", err)
+	case prov == nil:
+		return false, fmt.Errorf("no provisioning token found in %s", a.opts.ProvisioningJWTFile)
+	case prov.Expired:
+		return false, fmt.Errorf("provisioning token expired on %v", prov.Expires)
+	}
+
+	if !tokenRenewalPending(a.opts) {
+		a.log.Warnf("Server token expires on %v, renewing", current.Expires)
+
+		a.publishTokenRenewal(ctx, tokenRenewalEvent{State: tokenRenewalStarted, PreviousExpires: current.Expires})
+
+		rj, err := json.Marshal(&tokenRenewal{
+			Started:     time.Now().UTC(),
+			Expires:     current.Expires,
+			Fingerprint: current.Fingerprint,
+		})
+		if err != nil {
+			return false, err
+		}
+
+		err = writeFileAtomic(renewalFile(a.opts), rj, 0600)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = a.reenrol(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	a.restartServer()
+
+	return true, nil
+}
+
+// reenrol provisions using the renewal options until the provisioner issued new credentials and then replaces the
+// current ones, the server keeps running on the current token meanwhile
+func (a *Agent) reenrol(ctx context.Context) error {
+	if !renewalIssued(a.opts) {
+		err := os.MkdirAll(renewalDirectory(a.opts), 0700)
+		if err != nil {
+			return err
+		}
+
+		a.log.Warnf("Re-enrolling with the provisioner using %s", a.opts.ProvisioningJWTFile)
+
+		err = a.provisionRenewal(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range renewalFiles(a.opts) {
+		err := os.Rename(f[0], f[1])
+		if err != nil {
+			return fmt.Errorf("could not install renewed credentials: %w", err)
+		}
+	}
+
+	return os.RemoveAll(renewalDirectory(a.opts))
+}
+
+// provisionRenewal runs a provisioning server writing to the renewal directory until the provisioner issued new
+// credentials or TokenRenewalTimeout passed
+func (a *Agent) provisionRenewal(ctx context.Context) error {
+	opts := renewalOptions(*a.opts)
+
+	srv, err := newServer(&opts, opts.ConfigFile, nil, a.log.WithField("renewal", true))
+	if err != nil {
+		return err
+	}
+	if !srv.IsProvisioning() {
+		return fmt.Errorf("configuration in %s is not in provisioning mode", renewalDirectory(a.opts))
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, a.opts.TokenRenewalTimeout)
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	failed := make(chan error, 1)
+	srv.onFailure = func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}
+
+	err = srv.Start(timeout, wg)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for !renewalIssued(a.opts) {
+		select {
+		case err := <-failed:
+			return fmt.Errorf("re-enrolling failed: %w", err)
+		case <-timeout.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("the provisioner did not issue new credentials within %v", a.opts.TokenRenewalTimeout)
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// completeTokenRenewal reports the outcome of a renewal once the server starts with a new token
+func (a *Agent) completeTokenRenewal(ctx context.Context) {
+	if !choria.FileExist(renewalFile(a.opts)) || tokenRenewalPending(a.opts) {
+		return
+	}
+
+	renewal, err := readTokenRenewal(a.opts)
+	if err != nil {
+		a.log.Errorf("Could not read token renewal state: %v", err)
+	}
+
+	current, err := serverTokenSummary(*a.opts)
+	if err != nil {
+		a.log.Errorf("Could not read renewed server token: %v", err)
+	}
+
+	evt := tokenRenewalEvent{State: tokenRenewalCompleted}
+	if renewal != nil {
+		evt.PreviousExpires = renewal.Expires
+	}
+	if current != nil {
+		evt.Expires = current.Expires
+	}
+
+	a.log.Warnf("Server token renewed, new token expires on %v", evt.Expires)
+
+	a.publishTokenRenewal(ctx, evt)
+
+	err = os.Remove(renewalFile(a.opts))
+	if err != nil {
+		a.log.Errorf("Could not remove token renewal state: %v", err)
+	}
+}
+
+func (a *Agent) publishTokenRenewal(ctx context.Context, evt tokenRenewalEvent) {
+	evt.Identity = a.opts.Identity
+
+	var err error
+	backoff.Default.For(ctx, func(try int) error {
+		if try > 5 {
+			return nil
+		}
+
+		err = publishEventOnce(ctx, a.opts, a.cfgFile, eventTokenRenewal, evt, a.log)
+		return err
+	})
+	if err != nil {
+		a.log.Errorf("Could not publish token renewal event: %v", err)
+	}
+}
@@ -18,6 +18,10 @@ func (b *broker) StartReplication(ctx context.Context, wg *sync.WaitGroup) error
 	b.log.Infof("Starting data replication")
 
 	backendUrl := b.cfg.Option(configKeySourceHost, "")
+	if backendUrl == "" && b.cfg.Option(configKeyOffline, "false") == "true" {
+		b.log.Warnf("Not replicating data in offline mode, data is exchanged with the backend using bundles")
+		return nil
+	}
 	if backendUrl == "" {
 		fmt.Printf("\n%#v\n", b.cfg)
 		return fmt.Errorf("replication source is not defined")
@@ -30,7 +34,7 @@ func (b *broker) StartReplication(ctx context.Context, wg *sync.WaitGroup) error
 
 	rcfg := &srcfg.Config{
 		ReplicatorName: site,
-		StateDirectory: defaultReplicationStateDirectory,
+		StateDirectory: b.opts.ReplicationStateDirectory,
 	}
 
 	cc := &srcfg.ChoriaConnection{
@@ -88,6 +92,42 @@ func (b *broker) StartReplication(ctx context.Context, wg *sync.WaitGroup) error
 		},
 	}
 
+	// jobs from the backend, results go to the events stream with other node events
+	rcfg.Streams = append(rcfg.Streams, &srcfg.Stream{
+		Name:             jobsReplicationName(site),
+		Stream:           jobsStream,
+		TargetStream:     jobsStream,
+		TargetURL:        "nats://localhost:9222",
+		TargetProcess:    b.broker,
+		TargetChoriaConn: cc,
+		NoTargetCreate:   true,
+		SourceURL:        backendUrl,
+	}, &srcfg.Stream{
+		Name:               jobResultsStream,
+		Stream:             jobResultsStream,
+		TargetStream:       "MACHINE_ROOM_EVENTS",
+		TargetURL:          backendUrl,
+		NoTargetCreate:     true,
+		SourceURL:          "nats://localhost:9222",
+		SourceProcess:      b.broker,
+		SourceChoriaConn:   cc,
+		TargetRemoveString: jobResultsSubjectPrefix,
+		TargetPrefix:       "machine_room.events.jobs.",
+	})
+
+	// plugin artifacts published by the backend, nodes fetch them from the site broker, see servePluginArtifacts.
+	// the replication is durable as copying chunks again would corrupt the objects
+	rcfg.Streams = append(rcfg.Streams, &srcfg.Stream{
+		Name:             pluginsReplicationName(site),
+		Stream:           "OBJ_" + pluginsBucket,
+		TargetStream:     "OBJ_" + pluginsBucket,
+		TargetURL:        "nats://localhost:9222",
+		TargetProcess:    b.broker,
+		TargetChoriaConn: cc,
+		NoTargetCreate:   true,
+		SourceURL:        backendUrl,
+	})
+
 	cfgRepl := &srcfg.Stream{
 		Name:             "KV_CONFIG",
 		Stream:           "KV_CONFIG",
@@ -105,11 +145,39 @@ func (b *broker) StartReplication(ctx context.Context, wg *sync.WaitGroup) error
 	}
 	rcfg.Streams = append(rcfg.Streams, cfgRepl)
 
-	err := rcfg.Validate()
+	for _, s := range b.opts.AdditionalStreams {
+		rcfg.Streams = append(rcfg.Streams, s.replicationConfig(backendUrl, b.broker, cc))
+	}
+
+	// clustered leaders elect one replicator per stream, downstream elections use the backend so the customer account needs a CHORIA_LEADER_ELECTION bucket
+	if b.clustered() {
+		for _, s := range rcfg.Streams {
+			s.LeaderElectionName = b.cfg.Identity
+		}
+	}
+
+	// the customer owned data policy decides what of our node data leaves the site
+	err := b.applyDataPolicy(ctx, wg, rcfg.Streams)
+	if err != nil {
+		return fmt.Errorf("could not apply data policy: %w", err)
+	}
+
+	err = rcfg.Validate()
 	if err != nil {
 		return err
 	}
 
+	err = b.startAudit(ctx, wg, rcfg.Streams)
+	if err != nil {
+		return fmt.Errorf("could not start audit log: %w", err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b.monitorReplication(ctx, backendUrl, site)
+	}()
+
 	for _, s := range rcfg.Streams {
 		b.log.Debugf("Configuring replication for stream stream %s", s.Name)
 		stream, err := replicator.NewStream(s, rcfg, b.log.WithField("stream", s.Name))
@@ -8,11 +8,88 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/choria-io/fisk"
+	"github.com/sirupsen/logrus"
 )
 
+// parts of the agent reset can be limited to
+const (
+	resetAll         = "all"
+	resetCredentials = "credentials"
+	resetState       = "state"
+	resetMachines    = "machines"
+)
+
+// resetItem is a file or directory removed by reset
+type resetItem struct {
+	description string
+	path        string
+	scope       string
+}
+
+// resetItems are all files and directories reset can remove
+func resetItems(opts *Options, cfgFile string) []resetItem {
+	items := []resetItem{
+		{"state storage directory", opts.ServerStorageDirectory, resetState},
+		{"instance facts file", opts.FactsFile, resetState},
+		{"autonomous agent store", opts.MachinesDirectory, resetMachines},
+		{"JWT file", opts.ServerJWTFile, resetCredentials},
+		{"Seed file", opts.ServerSeedFile, resetCredentials},
+	}
+
+	if opts.ConfigurationDirectory != "" {
+		files := []struct {
+			name  string
+			scope string
+		}{
+			{defaultCaFile, resetCredentials},
+			{defaultCaKeyFile, resetCredentials},
+			{defaultCaCrossFile, resetCredentials},
+			{defaultCertFile, resetCredentials},
+			{defaultKeyFile, resetCredentials},
+			{defaultNatsNkeyFile, resetCredentials},
+			{defaultNatsCredentialFile, resetCredentials},
+			{defaultTokenRenewalFile, resetCredentials},
+			{defaultTokenRenewalDirectory, resetCredentials},
+			{defaultMachinesSeedFile, resetCredentials},
+			{defaultDataPolicyKeyFile, resetCredentials},
+			{defaultMachinesSelectionFile, resetMachines},
+			{defaultUpgradeStateFile, resetState},
+			{defaultProvisioningStateFile, resetCredentials},
+			{defaultProvisionedStateFile, resetCredentials},
+			{defaultConfigVersionsFile, resetState},
+		}
+
+		for _, f := range files {
+			items = append(items, resetItem{"credential/x509 file", filepath.Join(opts.ConfigurationDirectory, f.name), f.scope})
+		}
+	}
+
+	// without the configuration the server starts in provisioning mode
+	return append(items, resetItem{"configuration file", cfgFile, resetCredentials})
+}
+
+func (c *cliInstance) resetScope() (string, error) {
+	scope := resetAll
+	selected := 0
+
+	for s, set := range map[string]bool{resetCredentials: c.resetCredentialsOnly, resetState: c.resetStateOnly, resetMachines: c.resetMachinesOnly} {
+		if set {
+			scope = s
+			selected++
+		}
+	}
+
+	if selected > 1 {
+		return "", fmt.Errorf("only one of --credentials-only, --state-only or --machines-only can be used")
+	}
+
+	return scope, nil
+}
+
 func (c *cliInstance) resetCommand(_ *fisk.ParseContext) error {
 	_, log, err := c.CommonConfigure()
 	if err != nil {
@@ -21,13 +98,21 @@ func (c *cliInstance) resetCommand(_ *fisk.ParseContext) error {
 
 	opts := c.opts
 
+	scope, err := c.resetScope()
+	if err != nil {
+		return err
+	}
+
 	log.Warnf("Ensure that the process is stopped prior to resetting")
 
 	if !c.force {
+		msg := fmt.Sprintf("Really reset the %s agent", opts.Name)
+		if scope != resetAll {
+			msg = fmt.Sprintf("Really reset the %s of the %s agent", scope, opts.Name)
+		}
+
 		var ok bool
-		err = survey.AskOne(&survey.Confirm{
-			Message: fmt.Sprintf("Really reset the %s agent", opts.Name),
-		}, &ok)
+		err = survey.AskOne(&survey.Confirm{Message: msg}, &ok)
 		if err != nil {
 			return err
 		}
@@ -38,68 +123,52 @@ func (c *cliInstance) resetCommand(_ *fisk.ParseContext) error {
 		}
 	}
 
-	if FileExist(opts.ServerStorageDirectory) {
-		log.Warnf("Removing state storage directory %s", opts.ServerStorageDirectory)
-		err = os.RemoveAll(opts.ServerStorageDirectory)
-		if err != nil {
-			log.Errorf("Could not remove storage directory: %v", err)
-		}
+	err = resetAgent(opts, c.cfgFile, scope, c.resetArchive, log)
+	if err != nil {
+		return err
 	}
 
-	if FileExist(opts.MachinesDirectory) {
-		log.Warnf("Removing autonomous agent store %s", opts.MachinesDirectory)
-		err = os.RemoveAll(opts.MachinesDirectory)
-		if err != nil {
-			log.Errorf("Could not remove autonomous agent store: %v", err)
-		}
+	if scope == resetAll {
+		log.Warnf("Agent has been reset")
+	} else {
+		log.Warnf("Agent %s has been reset", scope)
 	}
 
-	if FileExist(opts.FactsFile) {
-		log.Warnf("Removing instance facts file %s", opts.FactsFile)
-		err = os.Remove(opts.FactsFile)
-		if err != nil {
-			log.Warnf("Could not remove facts file: %v", err)
-		}
-	}
+	return nil
+}
 
-	if FileExist(opts.ServerJWTFile) {
-		log.Warnf("Removing JWT file %s", opts.ServerJWTFile)
-		err = os.Remove(opts.ServerJWTFile)
-		if err != nil {
-			log.Errorf("Could not remove jwt file: %v", err)
+// resetAgent removes the files in scope, first saving them in an archive in the backup directory when archive is set
+func resetAgent(opts *Options, cfgFile string, scope string, archive bool, log *logrus.Entry) error {
+	var items []resetItem
+	for _, item := range resetItems(opts, cfgFile) {
+		if (scope == resetAll || item.scope == scope) && FileExist(item.path) {
+			items = append(items, item)
 		}
 	}
 
-	if FileExist(opts.ServerSeedFile) {
-		log.Warnf("Removing Seed file %s", opts.ServerJWTFile)
-		err = os.Remove(opts.ServerSeedFile)
-		if err != nil {
-			log.Errorf("Could not remove seed file: %v", err)
+	if archive && len(items) > 0 {
+		var paths []string
+		for _, item := range items {
+			paths = append(paths, item.path)
 		}
-	}
 
-	if opts.ConfigurationDirectory != "" {
-		for _, f := range []string{defaultCaFile, defaultCertFile, defaultKeyFile, defaultNatsNkeyFile, defaultNatsCredentialFile} {
-			path := filepath.Join(opts.ConfigurationDirectory, f)
-			if FileExist(path) {
-				log.Warnf("Removing credential/x509 file %v", path)
-				err = os.Remove(path)
-				if err != nil {
-					log.Errorf("Could not remove %s: %v", f, err)
-				}
-			}
+		archive := filepath.Join(opts.BackupDirectory, fmt.Sprintf("%s-%s-%s.tgz", opts.Name, scope, time.Now().UTC().Format("20060102T150405")))
+		log.Warnf("Archiving %d files and directories to %s", len(paths), archive)
+
+		// nothing is removed unless the archive is complete
+		err := writeResetArchive(archive, scope, paths)
+		if err != nil {
+			return fmt.Errorf("could not archive: %w", err)
 		}
 	}
 
-	if FileExist(c.cfgFile) {
-		log.Warnf("Removing configuration file %v", c.cfgFile)
-		err = os.Remove(c.cfgFile)
+	for _, item := range items {
+		log.Warnf("Removing %s %s", item.description, item.path)
+		err := os.RemoveAll(item.path)
 		if err != nil {
-			log.Warnf("Could not remove configuration file: %v", err)
+			log.Errorf("Could not remove %s: %v", item.path, err)
 		}
 	}
 
-	log.Warnf("Agent has been reset")
-
 	return nil
 }
@@ -6,6 +6,8 @@ package machineroom
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -17,18 +19,38 @@ import (
 	"github.com/choria-io/go-choria/providers/provtarget"
 	cs "github.com/choria-io/go-choria/server"
 	"github.com/choria-io/machine-room/internal/autoagents/factsrefresh"
+	machinesmanager "github.com/choria-io/machine-room/internal/autoagents/machinesmanager"
+	"github.com/choria-io/machine-room/internal/autoagents/upgrade"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 	"github.com/sirupsen/logrus"
 )
 
+// the autonomous agents are registered once per process so they find the node specific configuration file and keys in
+// the facts of the server running them
+const (
+	configFileTemplate  = `{{ lookup "facts.machine_room.autonomous_agents.config_file" "" }}`
+	machinesKeyTemplate = `{{ lookup "facts.machine_room.autonomous_agents.machines_key" "" }}`
+	upgradeKeyTemplate  = `{{ lookup "facts.machine_room.autonomous_agents.upgrade_key" "" }}`
+)
+
+// settings that are global in Choria are set once per process using the options of the first agent
+var (
+	buildVersionOnce     sync.Once
+	registerMachinesOnce sync.Once
+)
+
 type server struct {
 	cfg  *config.Config
 	bi   *build.Info
 	fw   *choria.Framework
 	opts *Options
 	log  *logrus.Entry
+
+	// optional callbacks used by the Agent to track the server
+	onReady   func(context.Context)
+	onFailure func(error)
 }
 
 func newServer(opts *Options, configFile string, inproc nats.InProcessConnProvider, log *logrus.Entry) (*server, error) {
@@ -43,11 +65,9 @@ func newServer(opts *Options, configFile string, inproc nats.InProcessConnProvid
 		log:  log.WithField("machine_room", "server"),
 	}
 
-	srv.bi.SetProvisionJWTFile(opts.ProvisioningJWTFile)
 	srv.bi.SetProvisionUsingVersion2(false)
 	srv.bi.EnableProvisionModeAsDefault()
-	srv.bi.SetProvisionFacts(opts.FactsFile)
-	build.Version = opts.Version // TODO: wrap in bi
+	buildVersionOnce.Do(func() { build.Version = opts.Version })
 
 	hasRequiredFiles := choria.FileExist(configFile) && choria.FileExist(opts.ServerJWTFile) && choria.FileExist(opts.ServerSeedFile) && choria.FileExist(opts.NatsNkeySeedFile)
 
@@ -59,6 +79,7 @@ func newServer(opts *Options, configFile string, inproc nats.InProcessConnProvid
 		}
 
 		if srv.shouldProvision() {
+			srv.setProvisioningFiles()
 			provtarget.Configure(context.Background(), srv.cfg, srv.log.WithField("component", "provtarget"))
 
 			log.Warnf("Switching to provisioning configuration due to build defaults and configuration settings")
@@ -71,7 +92,13 @@ func newServer(opts *Options, configFile string, inproc nats.InProcessConnProvid
 
 			// auto agents are always on
 			srv.cfg.Choria.MachineSourceDir = opts.MachinesDirectory
-			srv.cfg.Choria.MachinesSignerPublicKey = opts.MachineSigningKey
+			// plugins are selected and re-signed locally after verifying the backend signature, see manageMachines
+			var mkey ed25519.PrivateKey
+			mkey, err = machinesSigningKey(opts)
+			if err != nil {
+				return nil, fmt.Errorf("could not load plugins signing key: %v", err)
+			}
+			srv.cfg.Choria.MachinesSignerPublicKey = hex.EncodeToString(mkey.Public().(ed25519.PublicKey))
 
 			// standard status file always
 			srv.cfg.Choria.StatusFilePath = opts.ServerStatusFile
@@ -105,13 +132,28 @@ func newServer(opts *Options, configFile string, inproc nats.InProcessConnProvid
 				srv.log.Errorf("Could not save NATS credentials: %v", err)
 			}
 
-			err = factsrefresh.Register(opts.CommandPath, opts.Version, opts.FactsRefreshInterval, configFile)
-			if err != nil {
-				srv.log.Errorf("Could not register facts refresh autonomous agent: %v", err)
-			}
+			registerMachinesOnce.Do(func() {
+				err := factsrefresh.Register(opts.CommandPath, opts.Version, opts.FactsRefreshInterval, configFileTemplate)
+				if err != nil {
+					srv.log.Errorf("Could not register facts refresh autonomous agent: %v", err)
+				}
+
+				// the upgrade command does nothing on agents with upgrades disabled
+				err = upgrade.Register(opts.CommandPath, opts.Version, configFileTemplate, resolvedConfigBucket, upgradeKeyTemplate)
+				if err != nil {
+					srv.log.Errorf("Could not register upgrade autonomous agent: %v", err)
+				}
+
+				err = machinesmanager.Register(machinesBucket, machinesKeyTemplate)
+				if err != nil {
+					srv.log.Errorf("Could not register plugins manager autonomous agent: %v", err)
+				}
+			})
 		}
 
 	default:
+		srv.setProvisioningFiles()
+
 		err = srv.createServerNKey()
 		if err != nil {
 			return nil, err
@@ -141,6 +183,13 @@ func newServer(opts *Options, configFile string, inproc nats.InProcessConnProvid
 	return srv, nil
 }
 
+// setProvisioningFiles sets the token and facts used while provisioning, Choria keeps these globally so they are only set
+// by a server that provisions
+func (s *server) setProvisioningFiles() {
+	s.bi.SetProvisionJWTFile(s.opts.ProvisioningJWTFile)
+	s.bi.SetProvisionFacts(s.opts.FactsFile)
+}
+
 func (s *server) Start(ctx context.Context, wg *sync.WaitGroup) error {
 	s.fw.ConfigureProvisioning(ctx)
 
@@ -155,11 +204,18 @@ func (s *server) Start(ctx context.Context, wg *sync.WaitGroup) error {
 		})
 	}
 
+	if s.onReady != nil {
+		instance.RegisterReadyCallback(s.onReady)
+	}
+
 	wg.Add(1)
 	go func() {
 		err := instance.Run(ctx, wg)
 		if err != nil {
 			s.log.Errorf("Server instance failed to start: %v", err)
+			if s.onFailure != nil {
+				s.onFailure(err)
+			}
 		}
 	}()
 
@@ -252,6 +308,10 @@ func (s *server) provisionConfig(f string, bi *build.Info) (*config.Config, erro
 
 	cfg.Choria.UseSRVRecords = false
 
+	// the provisioner signs a token for the existing seed when there is one, renewals keep the seed and stage the token
+	cfg.Choria.ChoriaSecuritySeedFile = s.opts.ServerSeedFile
+	cfg.Choria.ChoriaSecurityTokenFile = s.opts.ServerJWTFile
+
 	return cfg, nil
 }
 
@@ -0,0 +1,195 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	srcfg "github.com/choria-io/stream-replicator/config"
+	"github.com/nats-io/nats.go"
+)
+
+// ReplicationDirection indicates which way data flows for a ReplicatedStream
+type ReplicationDirection string
+
+const (
+	// ReplicateUpstream copies data from the site to the backend
+	ReplicateUpstream ReplicationDirection = "upstream"
+	// ReplicateDownstream copies data from the backend to the site
+	ReplicateDownstream ReplicationDirection = "downstream"
+
+	defaultAdditionalStreamMaxAge = 24 * time.Hour
+)
+
+// names used by the built-in replication, additional streams may not reuse them
+var reservedReplicationNames = []string{"REGISTRATION", "SUBMIT", "CHORIA_EVENTS", "CHORIA_MACHINE", "KV_CONFIG", "KV_" + machinesBucket, "KV_" + resolvedConfigBucket, "OBJ_" + pluginsBucket, jobsStream, jobResultsStream}
+
+// ReplicatedStream declares an additional stream or KV bucket replicated between the site and the backend
+type ReplicatedStream struct {
+	// Name is a unique name for this replication, used in consumer names and logs
+	Name string `json:"name"`
+	// Direction is the direction data flows, upstream for site to backend and downstream for backend to site
+	Direction ReplicationDirection `json:"direction"`
+	// Stream is the name of the stream to replicate, for upstream streams it will be created on the site broker
+	Stream string `json:"stream,omitempty"`
+	// Bucket is the name of a KV bucket to replicate, the site bucket will be created and Stream is set to KV_<Bucket>
+	Bucket string `json:"bucket,omitempty"`
+	// Subjects the site stream will listen on, required when not replicating a bucket
+	Subjects []string `json:"subjects,omitempty"`
+	// MaxAge is how long the site keeps messages in the stream, defaults to 24 hours, not used for buckets
+	MaxAge time.Duration `json:"max_age,omitempty"`
+	// TargetStream is the stream to store data in on the other end, defaults to the same as Stream, downstream streams create it on the site broker
+	TargetStream string `json:"target_stream,omitempty"`
+	// FilterSubject restricts replication to a subset of the stream
+	FilterSubject string `json:"filter_subject,omitempty"`
+	// TargetPrefix is a prefix added to subjects when storing them in TargetStream
+	TargetPrefix string `json:"target_prefix,omitempty"`
+	// TargetRemoveString is removed from subjects when storing them in TargetStream
+	TargetRemoveString string `json:"target_remove_string,omitempty"`
+}
+
+func (s *ReplicatedStream) streamName() string {
+	if s.Bucket != "" {
+		return fmt.Sprintf("KV_%s", s.Bucket)
+	}
+
+	return s.Stream
+}
+
+// siteStreamName is the stream on the site broker, downstream streams store data in TargetStream when set
+func (s *ReplicatedStream) siteStreamName() string {
+	if s.Direction == ReplicateDownstream && s.Bucket == "" && s.TargetStream != "" {
+		return s.TargetStream
+	}
+
+	return s.streamName()
+}
+
+func (s *ReplicatedStream) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	if slices.Contains(reservedReplicationNames, s.Name) {
+		return fmt.Errorf("%s is a reserved name", s.Name)
+	}
+
+	if s.Direction != ReplicateUpstream && s.Direction != ReplicateDownstream {
+		return fmt.Errorf("%s: direction must be %s or %s", s.Name, ReplicateUpstream, ReplicateDownstream)
+	}
+
+	if s.Stream == "" && s.Bucket == "" {
+		return fmt.Errorf("%s: a stream or bucket is required", s.Name)
+	}
+
+	if s.Stream != "" && s.Bucket != "" {
+		return fmt.Errorf("%s: only one of stream or bucket can be set", s.Name)
+	}
+
+	if slices.Contains(reservedReplicationNames, s.streamName()) {
+		return fmt.Errorf("%s: stream %s is managed by the machine room", s.Name, s.streamName())
+	}
+
+	if slices.Contains(reservedReplicationNames, s.siteStreamName()) {
+		return fmt.Errorf("%s: stream %s is managed by the machine room", s.Name, s.siteStreamName())
+	}
+
+	if s.Direction == ReplicateDownstream && s.Bucket != "" && s.TargetStream != "" {
+		return fmt.Errorf("%s: target stream can not be set for downstream buckets", s.Name)
+	}
+
+	if s.Bucket == "" && len(s.Subjects) == 0 {
+		return fmt.Errorf("%s: subjects are required for streams", s.Name)
+	}
+
+	return nil
+}
+
+// replicationConfig is the stream-replicator configuration for this stream
+func (s *ReplicatedStream) replicationConfig(backendUrl string, inproc nats.InProcessConnProvider, cc *srcfg.ChoriaConnection) *srcfg.Stream {
+	stream := &srcfg.Stream{
+		Name:               s.Name,
+		Stream:             s.streamName(),
+		TargetStream:       s.TargetStream,
+		FilterSubject:      s.FilterSubject,
+		TargetPrefix:       s.TargetPrefix,
+		TargetRemoveString: s.TargetRemoveString,
+		NoTargetCreate:     true,
+	}
+
+	if stream.TargetStream == "" {
+		stream.TargetStream = stream.Stream
+	}
+
+	switch s.Direction {
+	case ReplicateUpstream:
+		stream.TargetURL = backendUrl
+		stream.SourceURL = "nats://localhost:9222"
+		stream.SourceProcess = inproc
+		stream.SourceChoriaConn = cc
+
+	case ReplicateDownstream:
+		stream.SourceURL = backendUrl
+		stream.TargetURL = "nats://localhost:9222"
+		stream.TargetProcess = inproc
+		stream.TargetChoriaConn = cc
+		// like CONFIG we copy everything at start so sites always have the latest data
+		stream.Ephemeral = s.Bucket != ""
+	}
+
+	return stream
+}
+
+// createSiteStream creates the stream or bucket on the site broker if it does not exist, for downstream streams this is
+// the stream data is stored in
+func (s *ReplicatedStream) createSiteStream(js nats.JetStreamContext, replicas int) (bool, error) {
+	if s.Bucket != "" {
+		_, err := js.KeyValue(s.Bucket)
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, nats.ErrBucketNotFound) {
+			return false, err
+		}
+
+		_, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: s.Bucket, History: 1, Storage: nats.FileStorage, Replicas: replicas})
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	name := s.siteStreamName()
+
+	_, err := js.StreamInfo(name)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, nats.ErrStreamNotFound) {
+		return false, err
+	}
+
+	maxAge := s.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultAdditionalStreamMaxAge
+	}
+
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:     name,
+		Subjects: s.Subjects,
+		MaxAge:   maxAge,
+		Storage:  nats.FileStorage,
+		Replicas: replicas,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,520 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tlsKeyTypeRSA     = "rsa"
+	tlsKeyTypeECDSA   = "ecdsa"
+	tlsKeyTypeED25519 = "ed25519"
+
+	defaultTLSKeyType = tlsKeyTypeECDSA
+
+	// the CA is replaced a year before it expires, the previous CA stays in the
+	// trust bundle until it expires so anything holding old certs keeps working,
+	// and the new CA is cross signed by the previous one so anything trusting
+	// only the previous CA keeps trusting new certs
+	defaultCaValidity    = 10 * 365 * 24 * time.Hour
+	defaultCaRenewBefore = 365 * 24 * time.Hour
+
+	defaultCertValidity    = 365 * 24 * time.Hour
+	defaultCertRenewBefore = 30 * 24 * time.Hour
+
+	// how often a running broker checks if its certificate needs renewing
+	defaultCertCheckInterval = 24 * time.Hour
+)
+
+// localCA manages a persistent CA stored in the configuration directory used to
+// issue the certificate the local broker presents
+type localCA struct {
+	caFile    string
+	caKey     string
+	crossFile string
+	certFile  string
+	keyFile   string
+	keyType   string
+	identity  string
+	names     []string
+	log       *logrus.Entry
+
+	// managedBy is the leader creating and renewing a CA shared by clustered leaders, empty when this leader does
+	managedBy string
+
+	cert     *x509.Certificate
+	key      crypto.Signer
+	previous []*x509.Certificate
+}
+
+func validTLSKeyType(kt string) bool {
+	return kt == tlsKeyTypeRSA || kt == tlsKeyTypeECDSA || kt == tlsKeyTypeED25519
+}
+
+// Ensure loads the CA and leaf certificate from disk, creating or renewing them as needed, true when a new
+// certificate was issued
+func (l *localCA) Ensure(now time.Time) (bool, error) {
+	if !validTLSKeyType(l.keyType) {
+		return false, fmt.Errorf("invalid key type %q", l.keyType)
+	}
+
+	renewedCA, err := l.ensureCA(now)
+	if err != nil {
+		return false, fmt.Errorf("could not prepare CA: %w", err)
+	}
+
+	issued, err := l.ensureCert(now, renewedCA)
+	if err != nil {
+		return false, fmt.Errorf("could not prepare certificate: %w", err)
+	}
+
+	return issued, nil
+}
+
+func (l *localCA) ensureCA(now time.Time) (bool, error) {
+	err := l.loadCA(now)
+	switch {
+	case err != nil && l.managedBy != "":
+		return false, fmt.Errorf("%w, the CA shared by clustered leaders has to be copied from %s", err, l.managedBy)
+
+	case err != nil:
+		l.log.Warnf("Creating new local CA: %v", err)
+
+	case l.cert.NotAfter.Sub(now) < defaultCaRenewBefore && l.managedBy != "":
+		l.log.Warnf("Local CA expires on %v, copy the CA renewed by %s", l.cert.NotAfter, l.managedBy)
+		return false, nil
+
+	case l.cert.NotAfter.Sub(now) < defaultCaRenewBefore:
+		l.log.Warnf("Renewing local CA expiring %v", l.cert.NotAfter)
+		l.previous = append([]*x509.Certificate{l.cert}, l.previous...)
+
+	case keyType(l.cert.PublicKey) != l.keyType && l.managedBy != "":
+		return false, nil
+
+	case keyType(l.cert.PublicKey) != l.keyType:
+		l.log.Warnf("Renewing local CA using %s keys, previous CA used %s keys", l.keyType, keyType(l.cert.PublicKey))
+		l.previous = append([]*x509.Certificate{l.cert}, l.previous...)
+
+	default:
+		return false, nil
+	}
+
+	// the CA being replaced, nil when creating the first one
+	prevCert, prevKey := l.cert, l.key
+	if err != nil {
+		prevCert, prevKey = nil, nil
+	}
+
+	l.key, err = generateTLSKey(l.keyType)
+	if err != nil {
+		return false, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return false, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Choria.IO"},
+			Country:      []string{"MT"},
+			CommonName:   fmt.Sprintf("Machine Room CA %s", l.identity),
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(defaultCaValidity),
+		IsCA:                  true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, l.key.Public(), l.key)
+	if err != nil {
+		return false, err
+	}
+
+	l.cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return false, err
+	}
+
+	keyPEM, err := encodeTLSKey(l.key)
+	if err != nil {
+		return false, err
+	}
+
+	err = writeFileAtomic(l.caKey, keyPEM, 0400)
+	if err != nil {
+		return false, err
+	}
+
+	err = l.crossSign(tmpl, prevCert, prevKey)
+	if err != nil {
+		return false, err
+	}
+
+	err = writeFileAtomic(l.caFile, l.bundle(now), 0644)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// crossSign issues the CA in tmpl signed by the previous CA, certificates include it so peers that did not yet receive
+// the renewed CA trust them
+func (l *localCA) crossSign(tmpl *x509.Certificate, prevCert *x509.Certificate, prevKey crypto.Signer) error {
+	if prevCert == nil {
+		if FileExist(l.crossFile) {
+			return os.Remove(l.crossFile)
+		}
+
+		return nil
+	}
+
+	cross := *tmpl
+	cross.NotAfter = prevCert.NotAfter
+
+	der, err := x509.CreateCertificate(rand.Reader, &cross, prevCert, l.key.Public(), prevKey)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(l.crossFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// crossCert is the current CA signed by the previous CA while it is valid
+func (l *localCA) crossCert(now time.Time) *x509.Certificate {
+	if !FileExist(l.crossFile) {
+		return nil
+	}
+
+	certs, err := readCertificates(l.crossFile)
+	if err != nil {
+		l.log.Warnf("Could not read cross signed CA: %v", err)
+		return nil
+	}
+
+	cross := certs[0]
+	if now.After(cross.NotAfter) || !publicKeysEqual(cross.PublicKey, l.cert.PublicKey) {
+		return nil
+	}
+
+	return cross
+}
+
+// bundle is the current CA followed by any previous CAs that are still valid
+func (l *localCA) bundle(now time.Time) []byte {
+	buf := new(bytes.Buffer)
+	pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: l.cert.Raw})
+
+	for _, prev := range l.previous {
+		if now.After(prev.NotAfter) {
+			continue
+		}
+		pem.Encode(buf, &pem.Block{Type: "CERTIFICATE", Bytes: prev.Raw})
+	}
+
+	return buf.Bytes()
+}
+
+func (l *localCA) loadCA(now time.Time) error {
+	if !FileExist(l.caFile) || !FileExist(l.caKey) {
+		return fmt.Errorf("no CA found in %s", l.caFile)
+	}
+
+	certs, err := readCertificates(l.caFile)
+	if err != nil {
+		return err
+	}
+
+	key, err := readTLSKey(l.caKey)
+	if err != nil {
+		return err
+	}
+
+	l.previous = nil
+	for _, c := range certs[1:] {
+		if now.Before(c.NotAfter) {
+			l.previous = append(l.previous, c)
+		}
+	}
+
+	ca := certs[0]
+	if !ca.IsCA {
+		return fmt.Errorf("%s is not a CA", l.caFile)
+	}
+	if now.After(ca.NotAfter) {
+		return fmt.Errorf("CA expired on %v", ca.NotAfter)
+	}
+	if !publicKeysEqual(ca.PublicKey, key.Public()) {
+		return fmt.Errorf("CA key does not match the CA certificate")
+	}
+
+	l.cert = ca
+	l.key = key
+
+	return nil
+}
+
+func (l *localCA) ensureCert(now time.Time, renewedCA bool) (bool, error) {
+	reason := ""
+	if renewedCA {
+		reason = "CA was renewed"
+	} else {
+		reason = l.checkCert(now)
+	}
+	if reason == "" {
+		return false, nil
+	}
+
+	l.log.Warnf("Issuing new broker certificate: %s", reason)
+
+	key, err := generateTLSKey(l.keyType)
+	if err != nil {
+		return false, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return false, err
+	}
+
+	dns, ips := l.sans()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Choria.IO"},
+			Country:      []string{"MT"},
+			CommonName:   l.identity,
+		},
+		IPAddresses: ips,
+		DNSNames:    dns,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(defaultCertValidity),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, l.cert, key.Public(), l.key)
+	if err != nil {
+		return false, err
+	}
+
+	keyPEM, err := encodeTLSKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	err = writeFileAtomic(l.keyFile, keyPEM, 0400)
+	if err != nil {
+		return false, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if cross := l.crossCert(now); cross != nil {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cross.Raw})...)
+	}
+
+	err = writeFileAtomic(l.certFile, certPEM, 0644)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// checkCert returns a reason the current certificate needs replacing, empty when it is fine
+func (l *localCA) checkCert(now time.Time) string {
+	if !FileExist(l.certFile) || !FileExist(l.keyFile) {
+		return "no certificate found"
+	}
+
+	certs, err := readCertificates(l.certFile)
+	if err != nil {
+		return err.Error()
+	}
+	cert := certs[0]
+
+	key, err := readTLSKey(l.keyFile)
+	if err != nil {
+		return err.Error()
+	}
+
+	dns, ips := l.sans()
+
+	switch {
+	case !publicKeysEqual(cert.PublicKey, key.Public()):
+		return "key does not match certificate"
+	case cert.CheckSignatureFrom(l.cert) != nil:
+		return "certificate was not signed by the current CA"
+	case cert.NotAfter.Sub(now) < defaultCertRenewBefore:
+		return fmt.Sprintf("certificate expires on %v", cert.NotAfter)
+	case keyType(cert.PublicKey) != l.keyType:
+		return fmt.Sprintf("certificate uses %s keys", keyType(cert.PublicKey))
+	case !slices.Equal(cert.DNSNames, dns):
+		return "DNS names changed"
+	case !slices.EqualFunc(cert.IPAddresses, ips, func(a net.IP, b net.IP) bool { return a.Equal(b) }):
+		return "IP addresses changed"
+	}
+
+	return ""
+}
+
+func (l *localCA) sans() ([]string, []net.IP) {
+	dns := []string{"localhost"}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.IPv6loopback}
+
+	if l.identity != "" {
+		dns = append(dns, l.identity)
+	}
+
+	for _, n := range l.names {
+		ip := net.ParseIP(n)
+		switch {
+		case ip == nil && !slices.Contains(dns, n):
+			dns = append(dns, n)
+		case ip != nil && !slices.ContainsFunc(ips, ip.Equal):
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	return dns, ips
+}
+
+func generateTLSKey(kt string) (crypto.Signer, error) {
+	switch kt {
+	case tlsKeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case tlsKeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case tlsKeyTypeED25519:
+		_, pk, err := ed25519.GenerateKey(rand.Reader)
+		return pk, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", kt)
+	}
+}
+
+func keyType(pub any) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return tlsKeyTypeRSA
+	case *ecdsa.PublicKey:
+		return tlsKeyTypeECDSA
+	case ed25519.PublicKey:
+		return tlsKeyTypeED25519
+	default:
+		return "unknown"
+	}
+}
+
+func publicKeysEqual(a any, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return false
+	}
+
+	return k.Equal(b)
+}
+
+func encodeTLSKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func readTLSKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key in %s", path)
+	}
+
+	return signer, nil
+}
+
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return certs, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,507 @@
+// Copyright (c) R.I. Pienaar and the Choria Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package machineroom
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/choria-io/go-choria/backoff"
+	"github.com/choria-io/go-choria/choria"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// event kind published while upgrading the agent
+	eventUpgrade = "upgrade"
+
+	// key in the CONFIG bucket holding the UpgradeSpecification
+	upgradeSpecKey = "upgrade"
+
+	upgradeStarted    = "started"
+	upgradeSwapped    = "swapped"
+	upgradeVerifying  = "verifying"
+	upgradeCompleted  = "completed"
+	upgradeRolledBack = "rolled_back"
+	upgradeFailed     = "failed"
+
+	maxUpgradeArtifactSize = 512 * 1024 * 1024
+	upgradeDownloadTimeout = 10 * time.Minute
+	upgradeStateInterval   = 10 * time.Second
+
+	// how often the current binary starts a new binary that does not become ready before rolling back
+	maxUpgradeStarts = 3
+)
+
+// UpgradeSpecification is stored in the CONFIG bucket under the upgrade key to request nodes run a specific version
+type UpgradeSpecification struct {
+	// Version is the desired version, nodes running any other version will upgrade
+	Version string `json:"version"`
+	// Artifacts are the binaries to install keyed by GOOS/GOARCH like linux/amd64
+	Artifacts map[string]UpgradeArtifact `json:"artifacts"`
+	// Target selects the nodes that will upgrade, all nodes when empty
+	Target Selector `json:"target,omitzero"`
+}
+
+// UpgradeArtifact is a binary nodes can upgrade to
+type UpgradeArtifact struct {
+	// Source is the URL to download the binary from
+	Source string `json:"source"`
+	// Signature is the hex encoded signature made using SignUpgradeArtifact
+	Signature string `json:"signature"`
+}
+
+// upgradeState is stored on disk while an upgrade is in progress and after a rollback, the new binary is kept next to
+// the current one until it became ready
+type upgradeState struct {
+	State    string    `json:"state"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Next     string    `json:"next"`
+	Starts   int       `json:"starts,omitempty"`
+	Started  time.Time `json:"started"`
+	Deadline time.Time `json:"deadline,omitzero"`
+	Reported bool      `json:"reported,omitempty"`
+}
+
+// upgradeEvent is the data of upgrade events
+type upgradeEvent struct {
+	State    string `json:"state"`
+	Identity string `json:"identity"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SignUpgradeArtifact signs a binary for a specific version, the signature is set in UpgradeArtifact
+func SignUpgradeArtifact(version string, artifact []byte, key ed25519.PrivateKey) string {
+	return hex.EncodeToString(ed25519.Sign(key, upgradeSignedContent(version, artifact)))
+}
+
+// signing the version with the checksum prevents a signed binary being offered as a different version
+func upgradeSignedContent(version string, artifact []byte) []byte {
+	sum := sha256.Sum256(artifact)
+	return []byte(fmt.Sprintf("%s\n%x", version, sum))
+}
+
+// sameVersion compares versions ignoring a leading v so v1.2.3 and 1.2.3 are the same
+func sameVersion(a string, b string) bool {
+	return strings.TrimPrefix(strings.TrimSpace(a), "v") == strings.TrimPrefix(strings.TrimSpace(b), "v")
+}
+
+func verifyUpgradeArtifact(version string, artifact []byte, signature string, signingKey string) error {
+	pk, err := hex.DecodeString(signingKey)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid signing key")
+	}
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+
+	if !ed25519.Verify(pk, upgradeSignedContent(version, artifact), sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+
+	return nil
+}
+
+func upgradeStateFile(opts *Options) string {
+	return filepath.Join(opts.ConfigurationDirectory, defaultUpgradeStateFile)
+}
+
+// readUpgradeState reads the upgrade state, nil when no upgrade was done
+func readUpgradeState(opts *Options) (*upgradeState, error) {
+	if !choria.FileExist(upgradeStateFile(opts)) {
+		return nil, nil
+	}
+
+	sj, err := os.ReadFile(upgradeStateFile(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	var state upgradeState
+	err = json.Unmarshal(sj, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func saveUpgradeState(opts *Options, state *upgradeState) error {
+	sj, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(upgradeStateFile(opts), sj, 0600)
+}
+
+func publishUpgradeEvent(ctx context.Context, opts *Options, configFile string, evt upgradeEvent, log *logrus.Entry) {
+	evt.Identity = opts.Identity
+
+	var err error
+	backoff.Default.For(ctx, func(try int) error {
+		if try > 5 {
+			return nil
+		}
+
+		err = publishEventOnce(ctx, opts, configFile, eventUpgrade, evt, log)
+		return err
+	})
+	if err != nil {
+		log.Errorf("Could not publish upgrade event: %v", err)
+	}
+}
+
+// upgradeAgent installs the version requested in the CONFIG bucket, returns true when a new binary was installed
+func upgradeAgent(ctx context.Context, opts *Options, configFile string, log *logrus.Entry) (bool, error) {
+	cfg, nc, err := connectSiteBroker(ctx, opts, configFile, "upgrade", log)
+	if err != nil {
+		return false, err
+	}
+	opts.Identity = cfg.Identity
+	scope := configScope(cfg)
+
+	js, err := nc.JetStream(nats.Context(ctx))
+	if err != nil {
+		nc.Close()
+		return false, err
+	}
+
+	kv, err := js.KeyValue("CONFIG")
+	if err != nil {
+		nc.Close()
+		return false, fmt.Errorf("could not access CONFIG bucket: %w", err)
+	}
+
+	value, err := lookupVerifiedConfig(ctx, opts, configFile, kv, scope, upgradeSpecKey, log)
+	nc.Close()
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		log.Infof("No upgrade requested")
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var spec UpgradeSpecification
+	err = json.Unmarshal(value, &spec)
+	if err != nil {
+		return false, fmt.Errorf("invalid upgrade specification: %w", err)
+	}
+
+	if spec.Version == "" || sameVersion(spec.Version, opts.Version) {
+		log.Infof("Running desired version %s", opts.Version)
+		return false, nil
+	}
+
+	state, err := readUpgradeState(opts)
+	if err != nil {
+		return false, fmt.Errorf("could not read upgrade state: %w", err)
+	}
+	if state != nil {
+		switch {
+		case state.State == upgradeSwapped || state.State == upgradeVerifying:
+			log.Warnf("Upgrade to %s is in progress, not upgrading to %s", state.To, spec.Version)
+			return false, nil
+		case state.State == upgradeRolledBack && sameVersion(state.To, spec.Version):
+			log.Warnf("Not upgrading to version %s that was previously rolled back", spec.Version)
+			return false, nil
+		}
+	}
+
+	if !spec.Target.Empty() {
+		facts, err := readFacts(opts)
+		if err != nil {
+			log.Warnf("Could not read facts for upgrade targeting: %v", err)
+		}
+
+		matched, reason, err := spec.Target.Match(opts.Identity, facts)
+		if err != nil {
+			return false, err
+		}
+		if !matched {
+			log.Infof("Not upgrading to %s: %s", spec.Version, reason)
+			return false, nil
+		}
+	}
+
+	platform := fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH)
+	artifact, ok := spec.Artifacts[platform]
+	if !ok {
+		return false, fmt.Errorf("no artifact for %s in version %s", platform, spec.Version)
+	}
+
+	evt := upgradeEvent{State: upgradeStarted, From: opts.Version, To: spec.Version}
+	publishUpgradeEvent(ctx, opts, configFile, evt, log)
+
+	err = installUpgrade(ctx, opts, spec.Version, artifact, log)
+	if err != nil {
+		evt.State = upgradeFailed
+		evt.Error = err.Error()
+		publishUpgradeEvent(ctx, opts, configFile, evt, log)
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// installUpgrade downloads and verifies the artifact and swaps it with the running binary
+func installUpgrade(ctx context.Context, opts *Options, version string, artifact UpgradeArtifact, log *logrus.Entry) error {
+	log.Warnf("Upgrading from %s to %s using %s", opts.Version, version, artifact.Source)
+
+	to, cancel := context.WithTimeout(ctx, upgradeDownloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(to, http.MethodGet, artifact.Source, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUpgradeArtifactSize+1))
+	if err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+	if len(body) > maxUpgradeArtifactSize {
+		return fmt.Errorf("artifact exceeds %d bytes", maxUpgradeArtifactSize)
+	}
+
+	err = verifyUpgradeArtifact(version, body, artifact.Signature, opts.MachineSigningKey)
+	if err != nil {
+		return err
+	}
+
+	// we write next to the running binary so the rename is atomic once the new binary became ready
+	next := opts.CommandPath + ".next"
+
+	err = writeFileAtomic(next, body, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = exec.CommandContext(to, next, "buildinfo").Run()
+	if err != nil {
+		os.Remove(next)
+		return fmt.Errorf("new binary is not executable: %w", err)
+	}
+
+	err = saveUpgradeState(opts, &upgradeState{
+		State:   upgradeSwapped,
+		From:    opts.Version,
+		To:      version,
+		Next:    next,
+		Started: time.Now().UTC(),
+	})
+	if err != nil {
+		os.Remove(next)
+		return err
+	}
+
+	log.Warnf("Installed version %s, the agent will restart", version)
+
+	return nil
+}
+
+// upgradeCandidate is the new binary to start instead of the current one while an upgrade is verified, empty when
+// the current binary should run. The current binary counts the starts so a new binary that fails before it can verify
+// itself is rolled back
+func upgradeCandidate(opts *Options, log *logrus.Entry) string {
+	state, err := readUpgradeState(opts)
+	if err != nil {
+		log.Errorf("Could not read upgrade state: %v", err)
+		return ""
+	}
+	if state == nil || (state.State != upgradeSwapped && state.State != upgradeVerifying) || sameVersion(opts.Version, state.To) {
+		return ""
+	}
+
+	reason := ""
+	switch {
+	case state.Starts >= maxUpgradeStarts:
+		reason = fmt.Sprintf("started %d times without becoming ready", state.Starts)
+	case state.State == upgradeVerifying && time.Now().After(state.Deadline):
+		reason = "health check window expired during a previous start"
+	case !choria.FileExist(state.Next):
+		reason = fmt.Sprintf("%s does not exist", state.Next)
+	}
+
+	if reason != "" {
+		log.Errorf("Rolling back upgrade from %s to %s: %s", state.From, state.To, reason)
+
+		os.Remove(state.Next)
+		state.State = upgradeRolledBack
+		err = saveUpgradeState(opts, state)
+		if err != nil {
+			log.Errorf("Could not save upgrade state: %v", err)
+		}
+
+		return ""
+	}
+
+	state.Starts++
+	err = saveUpgradeState(opts, state)
+	if err != nil {
+		log.Errorf("Could not save upgrade state, not starting version %s: %v", state.To, err)
+		return ""
+	}
+
+	return state.Next
+}
+
+// verifyUpgrade checks the health of a newly upgraded agent, rolling back when it does not become ready in time
+func (a *Agent) verifyUpgrade(ctx context.Context) {
+	state, err := readUpgradeState(a.opts)
+	if err != nil {
+		a.log.Errorf("Could not read upgrade state: %v", err)
+		return
+	}
+	if state == nil {
+		return
+	}
+
+	switch {
+	case state.State == upgradeRolledBack:
+		if !state.Reported {
+			a.log.Warnf("Running version %s after rolling back from %s", a.opts.Version, state.To)
+			publishUpgradeEvent(ctx, a.opts, a.cfgFile, upgradeEvent{State: upgradeRolledBack, From: state.To, To: a.opts.Version}, a.log)
+			state.Reported = true
+			err = saveUpgradeState(a.opts, state)
+			if err != nil {
+				a.log.Errorf("Could not save upgrade state: %v", err)
+			}
+		}
+		return
+
+	case !sameVersion(a.opts.Version, state.To):
+		a.log.Warnf("Running version %s while upgrading to %s, abandoning upgrade", a.opts.Version, state.To)
+		os.Remove(state.Next)
+		os.Remove(upgradeStateFile(a.opts))
+		return
+
+	case state.State == upgradeSwapped:
+		state.State = upgradeVerifying
+		state.Deadline = time.Now().Add(a.opts.UpgradeHealthWindow).UTC()
+		err = saveUpgradeState(a.opts, state)
+		if err != nil {
+			a.log.Errorf("Could not save upgrade state: %v", err)
+		}
+
+	case state.State == upgradeVerifying && time.Now().After(state.Deadline):
+		a.rollbackUpgrade(state, "health check window expired during a previous start")
+		return
+	}
+
+	a.log.Warnf("Verifying upgrade from %s to %s until %v", state.From, state.To, state.Deadline)
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		timer := time.NewTimer(time.Until(state.Deadline))
+		defer timer.Stop()
+
+		select {
+		case <-a.Ready():
+			// the new binary replaces the current one only once it is known to work
+			err := os.Rename(state.Next, a.opts.CommandPath)
+			if err != nil {
+				a.log.Errorf("Could not replace %s: %v", a.opts.CommandPath, err)
+				publishUpgradeEvent(ctx, a.opts, a.cfgFile, upgradeEvent{State: upgradeFailed, From: state.From, To: state.To, Error: err.Error()}, a.log)
+				return
+			}
+
+			a.log.Warnf("Upgrade from %s to %s completed", state.From, state.To)
+			os.Remove(upgradeStateFile(a.opts))
+			publishUpgradeEvent(ctx, a.opts, a.cfgFile, upgradeEvent{State: upgradeCompleted, From: state.From, To: state.To}, a.log)
+
+		case <-timer.C:
+			a.rollbackUpgrade(state, "agent did not become ready")
+
+		case <-ctx.Done():
+		}
+	}()
+}
+
+func (a *Agent) rollbackUpgrade(state *upgradeState, reason string) {
+	a.log.Errorf("Rolling back upgrade from %s to %s: %s", state.From, state.To, reason)
+
+	// the previous binary is still in place, it reports the rollback once restarted
+	os.Remove(state.Next)
+
+	state.State = upgradeRolledBack
+	err := saveUpgradeState(a.opts, state)
+	if err != nil {
+		a.log.Errorf("Could not save upgrade state: %v", err)
+	}
+
+	a.restartProcess(fmt.Sprintf("rolled back to version %s", state.From))
+}
+
+// watchUpgrades restarts the agent once the upgrade command installed a new binary
+func (a *Agent) watchUpgrades(ctx context.Context) {
+	defer a.wg.Done()
+
+	ticker := time.NewTicker(upgradeStateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			state, err := readUpgradeState(a.opts)
+			if err == nil && state != nil && state.State == upgradeSwapped && !sameVersion(state.To, a.opts.Version) {
+				a.restartProcess(fmt.Sprintf("upgraded to version %s", state.To))
+				return
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// restartProcess stops the agent with ErrRestartRequired so the binary can be started again
+func (a *Agent) restartProcess(reason string) {
+	a.log.Warnf("Restarting the agent: %s", reason)
+
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = ErrRestartRequired
+	}
+	cancel := a.cancel
+	a.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
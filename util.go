@@ -17,8 +17,6 @@ import (
 	"time"
 
 	"github.com/choria-io/go-choria/build"
-	"github.com/choria-io/go-choria/choria"
-	"github.com/nats-io/nkeys"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,19 +29,7 @@ func (c *cliInstance) CommonConfigure() (RuntimeOptions, *logrus.Entry, error) {
 		return nil, nil, err
 	}
 
-	c.opts.StartTime = time.Now().UTC()
-	c.opts.ConfigurationDirectory = filepath.Dir(c.cfgFile)
-	c.opts.ServerSeedFile = filepath.Join(c.opts.ConfigurationDirectory, defaultServerSeedFileName)
-	c.opts.ServerJWTFile = filepath.Join(c.opts.ConfigurationDirectory, defaultServerJwtFileName)
-	c.opts.MachinesDirectory = filepath.Join(c.opts.ConfigurationDirectory, defaultMachineStore)
-	c.opts.ServerStatusFile = defaultServerStatusFile
-	c.opts.ServerSubmissionDirectory = defaultSubmissionSpool
-	c.opts.ServerSubmissionSpoolSize = defaultSubmissionSpoolSize
-	c.opts.ProvisioningJWTFile = filepath.Join(c.opts.ConfigurationDirectory, defaultProvisioningTokenFile)
-	c.opts.FactsFile = filepath.Join(c.opts.ConfigurationDirectory, defaultFactsFile)
-	c.opts.ServerStorageDirectory = defaultStorageDirectory
-	c.opts.NatsNkeySeedFile = filepath.Join(c.opts.ConfigurationDirectory, defaultNatsNkeyFile)
-	c.opts.NatsCredentialsFile = filepath.Join(c.opts.ConfigurationDirectory, defaultNatsCredentialFile)
+	c.opts.configurePaths(c.cfgFile)
 
 	build.ProvisionJWTFile = c.opts.ProvisioningJWTFile
 
@@ -91,35 +77,134 @@ func (c *cliInstance) CommonConfigure() (RuntimeOptions, *logrus.Entry, error) {
 	return c.opts.roCopy(), c.log, nil
 }
 
-func (c *cliInstance) validateOptions() error {
-	if c.opts.Help == "" {
-		c.opts.Help = defaultHelp
+// configurePaths sets the runtime paths derived from the configuration file location and storage directory, paths set by the caller are kept
+func (o *Options) configurePaths(cfgFile string) {
+	o.StartTime = time.Now().UTC()
+	o.ConfigFile = cfgFile
+
+	setDefault := func(path *string, value string) {
+		if *path == "" {
+			*path = value
+		}
 	}
 
-	if c.opts.Version == "" {
-		c.opts.Version = version
+	setDefault(&o.ConfigurationDirectory, filepath.Dir(cfgFile))
+	setDefault(&o.ServerSeedFile, filepath.Join(o.ConfigurationDirectory, defaultServerSeedFileName))
+	setDefault(&o.ServerJWTFile, filepath.Join(o.ConfigurationDirectory, defaultServerJwtFileName))
+	setDefault(&o.MachinesDirectory, filepath.Join(o.ConfigurationDirectory, defaultMachineStore))
+	setDefault(&o.ProvisioningJWTFile, filepath.Join(o.ConfigurationDirectory, defaultProvisioningTokenFile))
+	setDefault(&o.FactsFile, filepath.Join(o.ConfigurationDirectory, defaultFactsFile))
+	setDefault(&o.ExternalFactsDirectory, filepath.Join(o.ConfigurationDirectory, defaultExternalFactsDirectory))
+	setDefault(&o.DataPolicyFile, filepath.Join(o.ConfigurationDirectory, defaultDataPolicyFile))
+	setDefault(&o.NatsNkeySeedFile, filepath.Join(o.ConfigurationDirectory, defaultNatsNkeyFile))
+	setDefault(&o.NatsCredentialsFile, filepath.Join(o.ConfigurationDirectory, defaultNatsCredentialFile))
+	setDefault(&o.MachinesSigningSeedFile, filepath.Join(o.ConfigurationDirectory, defaultMachinesSeedFile))
+
+	setDefault(&o.ServerStorageDirectory, o.defaultStorageDirectory())
+	setDefault(&o.ServerStatusFile, filepath.Join(o.ServerStorageDirectory, defaultServerStatusFileName))
+	setDefault(&o.ServerSubmissionDirectory, filepath.Join(o.ServerStorageDirectory, defaultSubmissionSpoolName))
+	setDefault(&o.ReplicationStateDirectory, filepath.Join(o.ServerStorageDirectory, defaultReplicationStateDirectory))
+	setDefault(&o.AuditDirectory, filepath.Join(o.ServerStorageDirectory, defaultAuditDirectory))
+	setDefault(&o.BackupDirectory, filepath.Join(filepath.Dir(o.ServerStorageDirectory), o.Name+"-backups"))
+
+	if o.ServerSubmissionSpoolSize <= 0 {
+		o.ServerSubmissionSpoolSize = defaultSubmissionSpoolSize
+	}
+	if o.AuditLogMaxSize <= 0 {
+		o.AuditLogMaxSize = defaultAuditLogMaxSize
+	}
+	if o.AuditLogMaxFiles <= 0 {
+		o.AuditLogMaxFiles = defaultAuditLogMaxFiles
 	}
+	if o.PluginsPort <= 0 {
+		o.PluginsPort = defaultPluginsPort
+	}
+}
 
-	if c.opts.Name == "" {
-		c.opts.Name = defaultName
+// defaultStorageDirectory is the system wide storage directory for the agent name or, when rootless, one in the XDG state directory
+func (o *Options) defaultStorageDirectory() string {
+	name := o.Name
+	if name == "" {
+		name = defaultName
 	}
 
-	if c.opts.FactsRefreshInterval < time.Minute {
-		c.opts.FactsRefreshInterval = defaultFactsRefresh
+	if !o.Rootless {
+		return filepath.Join(defaultStorageRoot, name)
+	}
+
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" || !filepath.IsAbs(state) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			home = os.TempDir()
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(state, name)
+}
+
+// validate checks the options and sets defaults for optional values
+func (o *Options) validate() error {
+	if o.Help == "" {
+		o.Help = defaultHelp
+	}
+
+	if o.Version == "" {
+		o.Version = version
+	}
+
+	if o.Name == "" {
+		o.Name = defaultName
+	}
+
+	if o.FactsRefreshInterval < time.Minute {
+		o.FactsRefreshInterval = defaultFactsRefresh
 	}
 
 	var err error
-	if c.opts.CommandPath == "" {
-		c.opts.CommandPath, err = filepath.Abs(os.Args[0])
+	if o.CommandPath == "" {
+		o.CommandPath, err = filepath.Abs(os.Args[0])
 		if err != nil {
 			return fmt.Errorf("could not determine path to command: %v", err)
 		}
 	}
 
-	if c.opts.MachineSigningKey == "" {
+	if o.UpgradeHealthWindow <= 0 {
+		o.UpgradeHealthWindow = defaultUpgradeHealthWindow
+	}
+
+	if o.TokenRenewBefore <= 0 {
+		o.TokenRenewBefore = defaultTokenRenewBefore
+	}
+
+	if o.TokenRenewalTimeout <= 0 {
+		o.TokenRenewalTimeout = defaultTokenRenewalTimeout
+	}
+
+	if o.BrokerTLSKeyType == "" {
+		o.BrokerTLSKeyType = defaultTLSKeyType
+	}
+	if !validTLSKeyType(o.BrokerTLSKeyType) {
+		return fmt.Errorf("invalid broker TLS key type %q", o.BrokerTLSKeyType)
+	}
+
+	names := map[string]bool{}
+	for _, s := range o.AdditionalStreams {
+		err := s.validate()
+		if err != nil {
+			return fmt.Errorf("invalid additional stream: %v", err)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("invalid additional stream: duplicate name %s", s.Name)
+		}
+		names[s.Name] = true
+	}
+
+	if o.MachineSigningKey == "" {
 		return fmt.Errorf("autonomous agent signing key is required")
 	}
-	pk, err := hex.DecodeString(c.opts.MachineSigningKey)
+	pk, err := hex.DecodeString(o.MachineSigningKey)
 	if err != nil {
 		return fmt.Errorf("invalid autonomous agent signing key: %v", err)
 	}
@@ -161,37 +246,41 @@ func (c *cliInstance) interruptWatcher() {
 	}
 }
 
-func (c *cliInstance) createServerNKey() error {
-	if c.opts.NatsNkeySeedFile == "" {
-		return fmt.Errorf("no nkey seed configured")
-	}
-	if choria.FileExist(c.opts.NatsNkeySeedFile) {
-		return nil
+// FileExist checks if a file exist on disk
+func FileExist(path string) bool {
+	if path == "" {
+		return false
 	}
 
-	ukp, err := nkeys.CreateUser()
+	_, err := os.Stat(path)
+
+	return !os.IsNotExist(err)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it into place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tf, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s-*", filepath.Base(path)))
 	if err != nil {
-		return fmt.Errorf("could not generate user nkey: %v", err)
+		return err
 	}
-	ukps, err := ukp.Seed()
+	defer os.Remove(tf.Name())
+
+	_, err = tf.Write(data)
 	if err != nil {
-		return fmt.Errorf("could not generate user nkey: %v", err)
+		tf.Close()
+		return err
 	}
-	err = os.WriteFile(c.opts.NatsNkeySeedFile, ukps, 0400)
+
+	err = tf.Chmod(perm)
 	if err != nil {
-		return fmt.Errorf("could not generate user nkey: %v", err)
+		tf.Close()
+		return err
 	}
 
-	return nil
-}
-
-// FileExist checks if a file exist on disk
-func FileExist(path string) bool {
-	if path == "" {
-		return false
+	err = tf.Close()
+	if err != nil {
+		return err
 	}
 
-	_, err := os.Stat(path)
-
-	return !os.IsNotExist(err)
+	return os.Rename(tf.Name(), path)
 }